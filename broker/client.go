@@ -0,0 +1,472 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/TheSmallBoat/cabinet/mqtt"
+)
+
+// subscription is the entity linked to the topic tree for each topic filter
+// of a client. Shared subscriptions are linked wrapped in mqtt.Shared.
+type subscription struct {
+	c      *client
+	filter string // topic filter without the '$share/{group}/' prefix
+	opts   mqtt.SubscriptionOptions
+}
+
+type client struct {
+	s    *Server
+	conn net.Conn
+
+	id         string
+	username   string
+	assignedID bool
+	version    mqtt.Version
+	keepAlive  time.Duration
+	maxOut     int
+	persistent bool
+
+	// subs is keyed by the topic filter as sent on the wire
+	subs map[string]*subscription
+
+	// normal is set by a DISCONNECT packet, and shutdown by Server.Close
+	normal   bool
+	shutdown bool
+
+	wmu      sync.Mutex
+	packetID uint16
+
+	// done is closed once the client is cleaned up
+	done chan struct{}
+}
+
+func (c *client) serve() {
+	defer close(c.done)
+
+	br := bufio.NewReader(c.conn)
+
+	if err := c.connect(br); err != nil {
+		return
+	}
+	defer c.cleanup()
+
+	for {
+		if c.keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		}
+
+		p, err := mqtt.ReadPacketLimit(br, c.version, c.s.maxPacketSize())
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		if !c.handle(p) {
+			return
+		}
+	}
+}
+
+func (c *client) connect(br *bufio.Reader) error {
+	c.conn.SetReadDeadline(time.Now().Add(c.s.connectTimeout()))
+
+	p, err := mqtt.ReadPacketLimit(br, mqtt.V5, c.s.maxPacketSize())
+	if err != nil {
+		if errors.Is(err, mqtt.ErrUnsupportedVersion) {
+			c.version = mqtt.V311
+			c.write(&mqtt.Connack{ReasonCode: mqtt.UnsupportedProtocolVersion})
+		}
+		return err
+	}
+	c.conn.SetReadDeadline(time.Time{})
+
+	cp, ok := p.(*mqtt.Connect)
+	if !ok {
+		return errors.New("broker/client.connect: first packet is not CONNECT")
+	}
+	c.version = cp.Version
+	c.id = cp.ClientID
+	c.username = string(cp.Username)
+	c.keepAlive = time.Duration(cp.KeepAlive) * time.Second
+	c.maxOut = int(cp.Properties.MaximumPacketSize)
+	if c.version >= mqtt.V5 {
+		c.persistent = cp.Properties.SessionExpiryInterval != nil && *cp.Properties.SessionExpiryInterval > 0
+	} else {
+		c.persistent = !cp.CleanStart
+	}
+
+	if rc := c.checkConnect(cp); rc != mqtt.Success {
+		c.write(&mqtt.Connack{ReasonCode: rc})
+		return errors.New("broker/client.connect: " + rc.String())
+	}
+
+	old, err := c.s.register(c)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		old.disconnect(mqtt.SessionTakenOver)
+		<-old.done
+	}
+
+	// A delayed will is cancelled when the session resumes, and published
+	// right away when a clean start ends the session
+	if cp.CleanStart {
+		c.s.wills.Flush(c.id)
+	} else {
+		c.s.wills.Resume(c.id)
+	}
+	if cp.Will != nil {
+		c.s.wills.Set(c.id, willOf(cp))
+	} else {
+		c.s.wills.Discard(c.id)
+	}
+
+	var present bool
+	if cp.CleanStart {
+		err = c.s.sessionStore().Remove(c.id)
+	}
+	if err == nil {
+		present, err = c.s.sessionStore().Resume(c.id, c.resume)
+	}
+	if err != nil {
+		c.write(&mqtt.Connack{ReasonCode: mqtt.UnspecifiedError})
+		c.normal = true
+		c.cleanup()
+		return err
+	}
+
+	ack := &mqtt.Connack{SessionPresent: present}
+	if c.version >= mqtt.V5 {
+		maxQoS, unavailable := byte(1), byte(0)
+		ack.Properties.MaximumQoS = &maxQoS
+		ack.Properties.SubscriptionIdentifiersAvailable = &unavailable
+		ack.Properties.MaximumPacketSize = uint32(c.s.maxPacketSize())
+		if c.assignedID {
+			ack.Properties.AssignedClientIdentifier = c.id
+		}
+	}
+	if err := c.write(ack); err != nil {
+		c.cleanup()
+		return err
+	}
+	return nil
+}
+
+// resume returns the subscription of a topic filter recorded in the session
+func (c *client) resume(l cabinet.SessionLink) interface{} {
+	var opts mqtt.SubscriptionOptions
+	opts.UnmarshalBinary(l.Data)
+
+	_, filter, _, _ := cabinet.ShareGroup(l.Filter)
+	sub := &subscription{c: c, filter: string(filter), opts: opts}
+	c.subs[string(l.Filter)] = sub
+	return sub
+}
+
+func (c *client) checkConnect(cp *mqtt.Connect) mqtt.ReasonCode {
+	if cp.ClientID == "" && !cp.CleanStart && cp.Version < mqtt.V5 {
+		return mqtt.ClientIdentifierNotValid
+	}
+	if cp.Properties.AuthenticationMethod != "" {
+		return mqtt.BadAuthenticationMethod
+	}
+	if cp.Will != nil {
+		if cp.Will.QoS > 1 {
+			return mqtt.QoSNotSupported
+		}
+		if !validTopicName(cp.Will.Topic) {
+			return mqtt.TopicNameInvalid
+		}
+	}
+	return mqtt.Success
+}
+
+// handle processes one packet and returns false once the connection must end
+func (c *client) handle(p mqtt.Packet) bool {
+	switch p := p.(type) {
+	case *mqtt.Publish:
+		return c.handlePublish(p)
+
+	case *mqtt.Puback:
+		// Outgoing QoS 1 messages are not retried, so there is no state to release
+		return true
+
+	case *mqtt.Subscribe:
+		c.handleSubscribe(p)
+		return true
+
+	case *mqtt.Unsubscribe:
+		c.handleUnsubscribe(p)
+		return true
+
+	case *mqtt.Pingreq:
+		return c.write(&mqtt.Pingresp{}) == nil
+
+	case *mqtt.Disconnect:
+		if p.ReasonCode != mqtt.DisconnectWithWill {
+			c.normal = true
+		}
+		return false
+	}
+
+	c.disconnect(mqtt.ProtocolError)
+	return false
+}
+
+func (c *client) handlePublish(p *mqtt.Publish) bool {
+	switch {
+	case p.QoS > 1:
+		c.disconnect(mqtt.QoSNotSupported)
+		return false
+	case p.Properties.TopicAlias != 0:
+		c.disconnect(mqtt.TopicAliasInvalid)
+		return false
+	case !validTopicName(p.Topic):
+		c.disconnect(mqtt.TopicNameInvalid)
+		return false
+	}
+
+	if !c.authorized(cabinet.AccessPublish, p.Topic) {
+		if p.QoS == 1 {
+			return c.write(&mqtt.Puback{PacketID: p.PacketID, ReasonCode: mqtt.NotAuthorized}) == nil
+		}
+		return true
+	}
+
+	p.Properties.SubscriptionIdentifier = 0
+	c.s.publish(c, p)
+
+	if p.QoS == 1 {
+		return c.write(&mqtt.Puback{PacketID: p.PacketID}) == nil
+	}
+	return true
+}
+
+func (c *client) handleSubscribe(p *mqtt.Subscribe) {
+	ack := &mqtt.Suback{PacketID: p.PacketID, ReasonCodes: make([]mqtt.ReasonCode, len(p.Subscriptions))}
+
+	var retained []*mqtt.Publish
+	for i := range p.Subscriptions {
+		s := p.Subscriptions[i]
+		if s.Options.QoS > 1 {
+			s.Options.QoS = 1
+		}
+
+		wire := string(s.Filter)
+		_, existed := c.subs[wire]
+
+		_, filter, shared, _ := cabinet.ShareGroup(s.Filter)
+		if !c.authorized(cabinet.AccessSubscribe, filter) {
+			ack.ReasonCodes[i] = mqtt.NotAuthorized
+			if c.version < mqtt.V5 {
+				ack.ReasonCodes[i] = mqtt.Failure
+			}
+			continue
+		}
+		sub := &subscription{c: c, filter: string(filter), opts: s.Options}
+		data, _ := s.Options.MarshalBinary()
+		err := c.s.sessionStore().Link(c.id, s.Filter, data, sub)
+		ack.ReasonCodes[i] = mqtt.SubackCode(err, s.Options.QoS, c.version)
+		if err != nil {
+			continue
+		}
+		c.subs[wire] = sub
+
+		if shared || s.Options.RetainHandling == 2 || (s.Options.RetainHandling == 1 && existed) {
+			continue
+		}
+		for _, rp := range c.s.retainedMessages(filter) {
+			qos := rp.QoS
+			if s.Options.QoS < qos {
+				qos = s.Options.QoS
+			}
+			retained = append(retained, &mqtt.Publish{QoS: qos, Topic: rp.Topic, Properties: rp.Properties, Payload: rp.Payload})
+		}
+	}
+
+	if c.write(ack) != nil {
+		return
+	}
+	for _, rp := range retained {
+		c.deliver(rp, rp.QoS, true)
+	}
+}
+
+func (c *client) handleUnsubscribe(p *mqtt.Unsubscribe) {
+	ack := &mqtt.Unsuback{PacketID: p.PacketID, ReasonCodes: make([]mqtt.ReasonCode, len(p.Filters))}
+
+	for i, f := range p.Filters {
+		if _, ok := c.subs[string(f)]; !ok {
+			ack.ReasonCodes[i] = mqtt.NoSubscriptionExisted
+			continue
+		}
+		delete(c.subs, string(f))
+		ack.ReasonCodes[i] = mqtt.UnsubackCode(c.s.sessionStore().UnLink(c.id, f), c.version)
+	}
+
+	c.write(ack)
+}
+
+// deliver sends a message routed to the client with the granted QoS
+func (c *client) deliver(p *mqtt.Publish, qos byte, retain bool) {
+	out := &mqtt.Publish{QoS: qos, Retain: retain, Topic: p.Topic, Payload: p.Payload}
+	if c.version >= mqtt.V5 {
+		out.Properties = mqtt.Properties{
+			PayloadFormatIndicator: p.Properties.PayloadFormatIndicator,
+			MessageExpiryInterval:  p.Properties.MessageExpiryInterval,
+			ContentType:            p.Properties.ContentType,
+			ResponseTopic:          p.Properties.ResponseTopic,
+			CorrelationData:        p.Properties.CorrelationData,
+			UserProperties:         p.Properties.UserProperties,
+		}
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if qos > 0 {
+		c.packetID++
+		if c.packetID == 0 {
+			c.packetID = 1
+		}
+		out.PacketID = c.packetID
+	}
+	c.writeLocked(out)
+}
+
+func (c *client) write(p mqtt.Packet) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.writeLocked(p)
+}
+
+func (c *client) writeLocked(p mqtt.Packet) error {
+	b, err := mqtt.EncodePacket(p, c.version)
+	if err != nil {
+		return err
+	}
+	if c.maxOut > 0 && len(b) > c.maxOut {
+		// The client cannot receive the packet, which is discarded
+		return nil
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.s.writeTimeout()))
+	if _, err := c.conn.Write(b); err != nil {
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// disconnect closes the connection, telling MQTT 5.0 clients the reason
+func (c *client) disconnect(rc mqtt.ReasonCode) {
+	if c.version >= mqtt.V5 {
+		c.write(&mqtt.Disconnect{ReasonCode: rc})
+	}
+	c.conn.Close()
+}
+
+// fail closes the connection after a read error
+func (c *client) fail(err error) {
+	switch {
+	case errors.Is(err, mqtt.ErrPacketTooLarge):
+		c.disconnect(mqtt.PacketTooLarge)
+	case errors.Is(err, mqtt.ErrMalformedPacket):
+		c.disconnect(mqtt.MalformedPacket)
+	case errors.Is(err, mqtt.ErrProtocolError):
+		c.disconnect(mqtt.ProtocolError)
+	default:
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			c.disconnect(mqtt.KeepAliveTimeout)
+		}
+	}
+}
+
+// cleanup unlinks the subscriptions of the client, keeping them recorded for
+// a persistent session, and fires its will unless it disconnected normally.
+// Both are handled while the client is still registered, so that they cannot
+// affect a new connection.
+func (c *client) cleanup() {
+	if c.persistent {
+		c.s.sessionStore().Detach(c.id)
+	} else {
+		c.s.sessionStore().Remove(c.id)
+	}
+	c.subs = make(map[string]*subscription)
+	c.conn.Close()
+
+	c.s.mu.Lock()
+	shutdown := c.shutdown
+	c.s.mu.Unlock()
+
+	if c.normal || shutdown {
+		c.s.wills.Discard(c.id)
+	} else {
+		c.s.wills.Fire(c.id)
+	}
+	c.s.unregister(c)
+}
+
+// authorized reports whether the ACL of the server, if any, allows the client
+// access to a topic. Access is denied when the ACL fails, but for invalid
+// topics, which are left for the caller to reject with their reason code.
+func (c *client) authorized(access cabinet.Access, topic []byte) bool {
+	if c.s.ACL == nil {
+		return true
+	}
+
+	p := cabinet.Principal{Username: c.username, ClientID: c.id}
+	var (
+		ok  bool
+		err error
+	)
+	if access == cabinet.AccessPublish {
+		ok, err = c.s.ACL.CanPublish(p, topic)
+		if err != nil {
+			return cabinet.ValidateTopicName(topic) != nil
+		}
+	} else {
+		ok, err = c.s.ACL.CanSubscribe(p, topic)
+		if err != nil {
+			return cabinet.ValidateFilter(topic) != nil
+		}
+	}
+	return ok
+}
+
+// willOf returns the will of a CONNECT packet. MQTT 5.0 delays it by the Will
+// Delay Interval, bounded by the Session Expiry Interval.
+func willOf(cp *mqtt.Connect) *cabinet.Will {
+	var delay uint32
+	if cp.Version >= mqtt.V5 && cp.Properties.SessionExpiryInterval != nil {
+		delay = cp.Will.Properties.WillDelayInterval
+		if *cp.Properties.SessionExpiryInterval < delay {
+			delay = *cp.Properties.SessionExpiryInterval
+		}
+	}
+
+	return &cabinet.Will{
+		Topic: cp.Will.Topic,
+		Delay: time.Duration(delay) * time.Second,
+		Message: &mqtt.Publish{
+			QoS:        cp.Will.QoS,
+			Retain:     cp.Will.Retain,
+			Topic:      cp.Will.Topic,
+			Properties: cp.Will.Properties,
+			Payload:    cp.Will.Payload,
+		},
+	}
+}
+
+// validTopicName reports whether topic may be published to
+func validTopicName(topic []byte) bool {
+	return cabinet.ValidateTopicName(topic) == nil
+}
@@ -0,0 +1,366 @@
+// Package broker is a minimal embeddable MQTT 3.1.1 and 5.0 broker routing
+// messages through a cabinet topic tree. It supports QoS 0 and 1, retained
+// messages, will messages, persistent sessions, shared subscriptions and
+// ACLs, and is meant as a reference and integration test harness rather than
+// a production server. Persistent sessions keep their subscriptions only, not
+// the messages missed while disconnected.
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/TheSmallBoat/cabinet/mqtt"
+)
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("broker: Server closed")
+
+const (
+	// DefaultConnectTimeout bounds the wait for the CONNECT packet
+	DefaultConnectTimeout = 10 * time.Second
+
+	// DefaultWriteTimeout bounds every write to a connection
+	DefaultWriteTimeout = 10 * time.Second
+
+	// DefaultMaxPacketSize bounds the incoming packets when MaxPacketSize is
+	// not set
+	DefaultMaxPacketSize = 1 << 20
+)
+
+// Server is an MQTT broker. Its exported fields must be set before the first
+// call to Serve or ServeConn.
+type Server struct {
+	// MaxPacketSize bounds incoming packets, DefaultMaxPacketSize when 0 and
+	// up to mqtt.MaxRemainingLength
+	MaxPacketSize int
+
+	// ConnectTimeout and WriteTimeout default to DefaultConnectTimeout and
+	// DefaultWriteTimeout when 0
+	ConnectTimeout time.Duration
+	WriteTimeout   time.Duration
+
+	// SessionBackend persists the subscriptions of the sessions outliving
+	// their connection, in memory when nil. Sessions are kept until a clean
+	// start, the expiry interval of MQTT 5.0 sessions is not enforced.
+	SessionBackend cabinet.SessionBackend
+
+	// ACL authorizes publishing and subscribing when set, for the username
+	// and the client identifier of the CONNECT packet. Will messages and the
+	// subscriptions resumed from a session are not checked.
+	ACL *cabinet.ACL
+
+	tree         *cabinet.TTree
+	wills        *cabinet.WillRegistry
+	sessions     *cabinet.SessionStore
+	sessionsOnce sync.Once
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	clients   map[string]*client
+	retained  map[string]*mqtt.Publish
+	clientSeq uint64
+
+	wg sync.WaitGroup
+}
+
+// NewServer returns a broker routing through a new topic tree
+func NewServer() *Server {
+	s := &Server{
+		tree:      cabinet.NewTopicTree(),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		clients:   make(map[string]*client),
+		retained:  make(map[string]*mqtt.Publish),
+	}
+	s.wills = cabinet.NewWillRegistry(s.tree, s.deliverWill)
+
+	return s
+}
+
+// Tree returns the topic tree the server routes with. Entities linked by the
+// server are unexported subscription values.
+func (s *Server) Tree() *cabinet.TTree {
+	return s.tree
+}
+
+// ListenAndServe listens on the TCP network address addr and calls Serve
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves each in its own goroutine. It
+// always returns a non-nil error, ErrServerClosed after Close.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single connection carrying an MQTT byte stream, and
+// returns when it is closed. It lets other transports share the server.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	c := &client{s: s, conn: conn, subs: make(map[string]*subscription), done: make(chan struct{})}
+	c.serve()
+}
+
+// Close closes all listeners and connections, without publishing the will
+// messages of the clients nor the delayed ones, and waits for their
+// goroutines to return
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for _, c := range s.clients {
+		c.shutdown = true
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	s.wills.Close()
+
+	return s.tree.Close()
+}
+
+func (s *Server) connectTimeout() time.Duration {
+	if s.ConnectTimeout > 0 {
+		return s.ConnectTimeout
+	}
+	return DefaultConnectTimeout
+}
+
+func (s *Server) writeTimeout() time.Duration {
+	if s.WriteTimeout > 0 {
+		return s.WriteTimeout
+	}
+	return DefaultWriteTimeout
+}
+
+func (s *Server) sessionStore() *cabinet.SessionStore {
+	s.sessionsOnce.Do(func() {
+		backend := s.SessionBackend
+		if backend == nil {
+			backend = cabinet.NewMemorySessionBackend()
+		}
+		s.sessions = cabinet.NewSessionStore(mqtt.Linker(s.tree), backend)
+	})
+	return s.sessions
+}
+
+func (s *Server) maxPacketSize() int {
+	if s.MaxPacketSize > 0 {
+		return s.MaxPacketSize
+	}
+	return DefaultMaxPacketSize
+}
+
+// register makes c the connected client of its id, and returns the client it
+// takes over from, if any. The will of the previous client is only fired once
+// it is done, so the caller must wait for it before resuming the session.
+func (s *Server) register(c *client) (*client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrServerClosed
+	}
+	if c.id == "" {
+		s.clientSeq++
+		c.id = fmt.Sprintf("cabinet-%d-%d", time.Now().UnixNano(), s.clientSeq)
+		c.assignedID = true
+	}
+	old := s.clients[c.id]
+	s.clients[c.id] = c
+	return old, nil
+}
+
+func (s *Server) unregister(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clients[c.id] == c {
+		delete(s.clients, c.id)
+	}
+}
+
+// publish routes p to the subscriptions matching its topic, and updates the
+// retained messages
+func (s *Server) publish(from *client, p *mqtt.Publish) {
+	if p.Retain {
+		s.retain(p)
+	}
+
+	entities := make([]interface{}, 0, 16)
+	if err := s.tree.LinkedEntities(p.Topic, &entities); err != nil {
+		return
+	}
+	s.route(from, p, entities)
+}
+
+// deliverWill publishes a will message fired by the will registry
+func (s *Server) deliverWill(w *cabinet.Will, entities []interface{}) {
+	p := w.Message.(*mqtt.Publish)
+	if p.Retain {
+		s.retain(p)
+	}
+	s.route(nil, p, entities)
+}
+
+// route delivers p to the subscriptions linked to its topic. from is nil for
+// will messages.
+func (s *Server) route(from *client, p *mqtt.Publish, entities []interface{}) {
+	var (
+		deliveries = make(map[*client]*delivery)
+		groups     map[string][]*subscription
+	)
+	for _, e := range entities {
+		switch e := e.(type) {
+		case *subscription:
+			if e.opts.NoLocal && e.c == from {
+				continue
+			}
+			addDelivery(deliveries, e, p)
+		case mqtt.Shared:
+			sub := e.Entity.(*subscription)
+			if sub.opts.NoLocal && sub.c == from {
+				continue
+			}
+			if groups == nil {
+				groups = make(map[string][]*subscription)
+			}
+			key := e.Group + "\x00" + sub.filter
+			groups[key] = append(groups[key], sub)
+		}
+	}
+	for _, subs := range groups {
+		addDelivery(deliveries, subs[rand.Intn(len(subs))], p)
+	}
+
+	for c, d := range deliveries {
+		c.deliver(p, d.qos, d.retain)
+	}
+}
+
+type delivery struct {
+	qos    byte
+	retain bool
+}
+
+// addDelivery merges overlapping subscriptions of a client into one delivery
+// using the maximum QoS of all the matching subscriptions
+func addDelivery(deliveries map[*client]*delivery, sub *subscription, p *mqtt.Publish) {
+	qos := p.QoS
+	if sub.opts.QoS < qos {
+		qos = sub.opts.QoS
+	}
+	retain := p.Retain && sub.opts.RetainAsPublished
+
+	d, ok := deliveries[sub.c]
+	if !ok {
+		deliveries[sub.c] = &delivery{qos: qos, retain: retain}
+		return
+	}
+	if qos > d.qos {
+		d.qos = qos
+	}
+	d.retain = d.retain || retain
+}
+
+func (s *Server) retain(p *mqtt.Publish) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(p.Payload) == 0 {
+		delete(s.retained, string(p.Topic))
+		return
+	}
+	rp := *p
+	rp.Dup = false
+	rp.PacketID = 0
+	s.retained[string(p.Topic)] = &rp
+}
+
+// retainedMessages returns the retained messages whose topic matches filter,
+// a topic being matched by the filters covering it
+func (s *Server) retainedMessages(filter []byte) []*mqtt.Publish {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []*mqtt.Publish
+	for topic, p := range s.retained {
+		if ok, err := cabinet.Covers(filter, []byte(topic)); err == nil && ok {
+			msgs = append(msgs, p)
+		}
+	}
+	return msgs
+}
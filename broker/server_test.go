@@ -0,0 +1,444 @@
+package broker
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/TheSmallBoat/cabinet/mqtt"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	v    mqtt.Version
+}
+
+func startServer(t *testing.T) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewServer()
+	go s.Serve(l)
+
+	return s, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string, cp *mqtt.Connect) (*testClient, *mqtt.Connack) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	return connect(t, conn, cp)
+}
+
+func connect(t *testing.T, conn net.Conn, cp *mqtt.Connect) (*testClient, *mqtt.Connack) {
+	tc := &testClient{t: t, conn: conn, br: bufio.NewReader(conn), v: cp.Version}
+	tc.write(cp)
+
+	ack, ok := tc.read().(*mqtt.Connack)
+	require.True(t, ok)
+	return tc, ack
+}
+
+func (tc *testClient) write(p mqtt.Packet) {
+	require.NoError(tc.t, mqtt.WritePacket(tc.conn, p, tc.v))
+}
+
+func (tc *testClient) read() mqtt.Packet {
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := mqtt.ReadPacket(tc.br, tc.v)
+	require.NoError(tc.t, err)
+	return p
+}
+
+// quiet checks that nothing but the PINGRESP is pending on the connection
+func (tc *testClient) quiet() {
+	tc.write(&mqtt.Pingreq{})
+	_, ok := tc.read().(*mqtt.Pingresp)
+	require.True(tc.t, ok)
+}
+
+func (tc *testClient) subscribe(id uint16, filter string, qos byte) *mqtt.Suback {
+	tc.write(&mqtt.Subscribe{
+		PacketID:      id,
+		Subscriptions: []mqtt.Subscription{{Filter: []byte(filter), Options: mqtt.SubscriptionOptions{QoS: qos}}},
+	})
+	ack, ok := tc.read().(*mqtt.Suback)
+	require.True(tc.t, ok)
+	require.Equal(tc.t, id, ack.PacketID)
+	return ack
+}
+
+func (tc *testClient) close() {
+	tc.conn.Close()
+}
+
+func TestServerPublish(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s, addr := startServer(t)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	sub, ack := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, ClientID: "sub", CleanStart: true})
+	defer sub.close()
+	require.Equal(t, mqtt.Success, ack.ReasonCode)
+	require.Equal(t, byte(1), *ack.Properties.MaximumQoS)
+	require.Equal(t, uint32(DefaultMaxPacketSize), ack.Properties.MaximumPacketSize)
+
+	pub, ack := dial(t, addr, &mqtt.Connect{Version: mqtt.V311, CleanStart: true})
+	defer pub.close()
+	require.Equal(t, mqtt.Success, ack.ReasonCode)
+
+	require.Equal(t, []mqtt.ReasonCode{mqtt.GrantedQoS1}, sub.subscribe(1, "sport/tennis/+", 2).ReasonCodes)
+	require.Equal(t, []mqtt.ReasonCode{mqtt.GrantedQoS0}, sub.subscribe(2, "sport/#", 0).ReasonCodes)
+	require.Equal(t, []mqtt.ReasonCode{mqtt.TopicFilterInvalid}, sub.subscribe(3, "sport/#/x", 0).ReasonCodes)
+
+	pub.write(&mqtt.Publish{QoS: 1, PacketID: 7, Topic: []byte("sport/tennis/tom"), Payload: []byte("15-0")})
+	puback, ok := pub.read().(*mqtt.Puback)
+	require.True(t, ok)
+	require.Equal(t, uint16(7), puback.PacketID)
+
+	// Overlapping subscriptions are delivered once with the maximum QoS
+	msg, ok := sub.read().(*mqtt.Publish)
+	require.True(t, ok)
+	require.Equal(t, []byte("sport/tennis/tom"), msg.Topic)
+	require.Equal(t, []byte("15-0"), msg.Payload)
+	require.Equal(t, byte(1), msg.QoS)
+	require.NotEqual(t, uint16(0), msg.PacketID)
+	sub.write(&mqtt.Puback{PacketID: msg.PacketID})
+	sub.quiet()
+
+	pub.write(&mqtt.Publish{Topic: []byte("sport/golf"), Payload: []byte("birdie")})
+	msg, ok = sub.read().(*mqtt.Publish)
+	require.True(t, ok)
+	require.Equal(t, []byte("sport/golf"), msg.Topic)
+	require.Equal(t, byte(0), msg.QoS)
+
+	sub.write(&mqtt.Unsubscribe{PacketID: 4, Filters: [][]byte{[]byte("sport/#"), []byte("sport/+")}})
+	unsuback, ok := sub.read().(*mqtt.Unsuback)
+	require.True(t, ok)
+	require.Equal(t, []mqtt.ReasonCode{mqtt.Success, mqtt.NoSubscriptionExisted}, unsuback.ReasonCodes)
+
+	pub.write(&mqtt.Publish{Topic: []byte("sport/golf"), Payload: []byte("eagle")})
+	pub.quiet()
+	sub.quiet()
+}
+
+func TestServerNoLocal(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s, addr := startServer(t)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	c, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, ClientID: "c", CleanStart: true})
+	defer c.close()
+	other, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, ClientID: "other", CleanStart: true})
+	defer other.close()
+
+	// Neither plain nor shared subscriptions receive their own messages
+	c.write(&mqtt.Subscribe{PacketID: 1, Subscriptions: []mqtt.Subscription{
+		{Filter: []byte("news/+"), Options: mqtt.SubscriptionOptions{NoLocal: true}},
+		{Filter: []byte("$share/g/sport/+"), Options: mqtt.SubscriptionOptions{NoLocal: true}},
+	}})
+	ack, ok := c.read().(*mqtt.Suback)
+	require.True(t, ok)
+	require.Equal(t, []mqtt.ReasonCode{mqtt.GrantedQoS0, mqtt.GrantedQoS0}, ack.ReasonCodes)
+
+	c.write(&mqtt.Publish{Topic: []byte("news/today"), Payload: []byte("a")})
+	c.write(&mqtt.Publish{Topic: []byte("sport/golf"), Payload: []byte("b")})
+	c.quiet()
+
+	other.write(&mqtt.Publish{Topic: []byte("sport/golf"), Payload: []byte("c")})
+	msg, ok := c.read().(*mqtt.Publish)
+	require.True(t, ok)
+	require.Equal(t, []byte("c"), msg.Payload)
+	c.quiet()
+}
+
+func TestServerRetained(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s, addr := startServer(t)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	pub, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, ClientID: "pub", CleanStart: true})
+	defer pub.close()
+
+	pub.write(&mqtt.Publish{Retain: true, Topic: []byte("sport/tennis/score"), Payload: []byte("40-15")})
+	pub.write(&mqtt.Publish{Retain: true, Topic: []byte("sport/golf/score"), Payload: []byte("-3")})
+	pub.write(&mqtt.Publish{Retain: true, Topic: []byte("sport/golf/score"), Payload: nil})
+	pub.quiet()
+
+	sub, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V311, ClientID: "sub", CleanStart: true})
+	defer sub.close()
+
+	sub.subscribe(1, "sport/+/score", 1)
+	msg, ok := sub.read().(*mqtt.Publish)
+	require.True(t, ok)
+	require.True(t, msg.Retain)
+	require.Equal(t, []byte("sport/tennis/score"), msg.Topic)
+	require.Equal(t, []byte("40-15"), msg.Payload)
+	require.Equal(t, byte(0), msg.QoS)
+	sub.quiet()
+
+	// Retained messages are matched as the tree does, '#' not matching the
+	// parent level
+	sub.subscribe(2, "sport/tennis/score/#", 0)
+	sub.quiet()
+	sub.subscribe(3, "+/tennis/#", 0)
+	msg, ok = sub.read().(*mqtt.Publish)
+	require.True(t, ok)
+	require.Equal(t, []byte("sport/tennis/score"), msg.Topic)
+	sub.quiet()
+
+	// Retain is cleared on messages forwarded to established subscriptions
+	pub.write(&mqtt.Publish{Retain: true, Topic: []byte("sport/tennis/score"), Payload: []byte("game")})
+	msg, ok = sub.read().(*mqtt.Publish)
+	require.True(t, ok)
+	require.False(t, msg.Retain)
+	require.Equal(t, []byte("game"), msg.Payload)
+}
+
+func TestServerWill(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s, addr := startServer(t)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	sub, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, ClientID: "sub", CleanStart: true})
+	defer sub.close()
+	sub.subscribe(1, "status/#", 1)
+
+	will := &mqtt.Will{QoS: 1, Topic: []byte("status/dev1"), Payload: []byte("offline")}
+
+	// A normal disconnection discards the will message
+	dev, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, ClientID: "dev1", CleanStart: true, Will: will})
+	dev.write(&mqtt.Disconnect{})
+	dev.close()
+
+	// Losing the connection publishes it
+	dev, _ = dial(t, addr, &mqtt.Connect{Version: mqtt.V311, ClientID: "dev1", CleanStart: true, Will: will})
+	dev.close()
+
+	msg, ok := sub.read().(*mqtt.Publish)
+	require.True(t, ok)
+	require.Equal(t, []byte("status/dev1"), msg.Topic)
+	require.Equal(t, []byte("offline"), msg.Payload)
+	require.Equal(t, byte(1), msg.QoS)
+	sub.quiet()
+}
+
+func TestServerWillDelay(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s, addr := startServer(t)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	sub, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, ClientID: "sub", CleanStart: true})
+	defer sub.close()
+	sub.subscribe(1, "status/#", 1)
+
+	expiry := uint32(60)
+	cp := &mqtt.Connect{
+		Version:    mqtt.V5,
+		ClientID:   "dev1",
+		CleanStart: true,
+		Properties: mqtt.Properties{SessionExpiryInterval: &expiry},
+		Will: &mqtt.Will{
+			Topic:      []byte("status/dev1"),
+			Payload:    []byte("offline"),
+			Properties: mqtt.Properties{WillDelayInterval: 1},
+		},
+	}
+
+	// Resuming the session within the delay cancels the will
+	dev, _ := dial(t, addr, cp)
+	dev.close()
+	cp.CleanStart = false
+	dev, _ = dial(t, addr, cp)
+	sub.quiet()
+
+	// Starting a clean session publishes it right away
+	dev.close()
+	cp.CleanStart = true
+	dev, _ = dial(t, addr, cp)
+	defer dev.close()
+
+	msg, ok := sub.read().(*mqtt.Publish)
+	require.True(t, ok)
+	require.Equal(t, []byte("offline"), msg.Payload)
+}
+
+func TestServerSession(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := ioutil.TempDir("", "broker-sessions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	backend, err := cabinet.NewFileSessionBackend(dir)
+	require.NoError(t, err)
+
+	serve := func() (*Server, string) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		s := NewServer()
+		s.SessionBackend = backend
+		go s.Serve(l)
+		return s, l.Addr().String()
+	}
+	s, addr := serve()
+
+	cp := &mqtt.Connect{Version: mqtt.V311, ClientID: "sub"}
+	sub, ack := dial(t, addr, cp)
+	require.False(t, ack.SessionPresent)
+	sub.subscribe(1, "sport/#", 1)
+	sub.subscribe(2, "$share/g/news/+", 0)
+	sub.close()
+
+	// The subscriptions survive a reconnect
+	sub, ack = dial(t, addr, cp)
+	require.True(t, ack.SessionPresent)
+
+	pub, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V311, ClientID: "pub", CleanStart: true})
+	pub.write(&mqtt.Publish{QoS: 1, PacketID: 1, Topic: []byte("sport/tennis"), Payload: []byte("ace")})
+	_, ok := pub.read().(*mqtt.Puback)
+	require.True(t, ok)
+	msg, ok := sub.read().(*mqtt.Publish)
+	require.True(t, ok)
+	require.Equal(t, byte(1), msg.QoS)
+	require.Equal(t, []byte("ace"), msg.Payload)
+	sub.write(&mqtt.Puback{PacketID: msg.PacketID})
+	pub.close()
+	sub.close()
+
+	// and a restart of the server
+	require.NoError(t, s.Close())
+	s, addr = serve()
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	sub, ack = dial(t, addr, cp)
+	defer sub.close()
+	require.True(t, ack.SessionPresent)
+
+	pub, _ = dial(t, addr, &mqtt.Connect{Version: mqtt.V311, ClientID: "pub", CleanStart: true})
+	defer pub.close()
+	pub.write(&mqtt.Publish{Topic: []byte("news/today"), Payload: []byte("headline")})
+	msg, ok = sub.read().(*mqtt.Publish)
+	require.True(t, ok)
+	require.Equal(t, []byte("headline"), msg.Payload)
+
+	// A clean start ends the session
+	cp.CleanStart = true
+	sub2, ack := dial(t, addr, cp)
+	defer sub2.close()
+	require.False(t, ack.SessionPresent)
+	pub.write(&mqtt.Publish{Topic: []byte("sport/tennis"), Payload: []byte("ace")})
+	sub2.quiet()
+}
+
+func TestServerTakeover(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s, addr := startServer(t)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	first, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, ClientID: "dev", CleanStart: true})
+	defer first.close()
+
+	second, ack := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, ClientID: "dev", CleanStart: true})
+	defer second.close()
+	require.Equal(t, mqtt.Success, ack.ReasonCode)
+
+	d, ok := first.read().(*mqtt.Disconnect)
+	require.True(t, ok)
+	require.Equal(t, mqtt.SessionTakenOver, d.ReasonCode)
+	second.quiet()
+}
+
+func TestServerConnectRefused(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s, addr := startServer(t)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	c, ack := dial(t, addr, &mqtt.Connect{Version: mqtt.V311})
+	defer c.close()
+	require.Equal(t, mqtt.ClientIdentifierNotValid, ack.ReasonCode)
+
+	c5, ack := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, CleanStart: true})
+	defer c5.close()
+	require.Equal(t, mqtt.Success, ack.ReasonCode)
+	require.NotEqual(t, "", ack.Properties.AssignedClientIdentifier)
+
+	c5.write(&mqtt.Publish{QoS: 0, Topic: []byte("sport/+")})
+	d, ok := c5.read().(*mqtt.Disconnect)
+	require.True(t, ok)
+	require.Equal(t, mqtt.TopicNameInvalid, d.ReasonCode)
+}
+
+func TestServerACL(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	acl := cabinet.NewACL()
+	defer acl.Close()
+	require.NoError(t, acl.Add(cabinet.ACLRule{Filter: []byte("sport/#"), Access: cabinet.AccessAll}))
+	require.NoError(t, acl.Add(cabinet.ACLRule{Filter: []byte("users/%u/#"), Access: cabinet.AccessAll}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewServer()
+	s.ACL = acl
+	go s.Serve(l)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+	addr := l.Addr().String()
+
+	sub, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, ClientID: "sub", CleanStart: true, Username: []byte("alice")})
+	defer sub.close()
+	require.Equal(t, []mqtt.ReasonCode{mqtt.GrantedQoS1}, sub.subscribe(1, "sport/tennis/+", 1).ReasonCodes)
+	require.Equal(t, []mqtt.ReasonCode{mqtt.NotAuthorized}, sub.subscribe(2, "#", 1).ReasonCodes)
+	require.Equal(t, []mqtt.ReasonCode{mqtt.GrantedQoS0}, sub.subscribe(3, "$share/g/users/alice/+", 0).ReasonCodes)
+	require.Equal(t, []mqtt.ReasonCode{mqtt.NotAuthorized}, sub.subscribe(4, "users/bob/+", 0).ReasonCodes)
+	require.Equal(t, []mqtt.ReasonCode{mqtt.TopicFilterInvalid}, sub.subscribe(5, "sport/#/x", 0).ReasonCodes)
+
+	pub, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, ClientID: "pub", CleanStart: true, Username: []byte("bob")})
+	defer pub.close()
+	pub.write(&mqtt.Publish{QoS: 1, PacketID: 1, Topic: []byte("users/alice/x"), Payload: []byte("denied")})
+	puback, ok := pub.read().(*mqtt.Puback)
+	require.True(t, ok)
+	require.Equal(t, mqtt.NotAuthorized, puback.ReasonCode)
+
+	pub.write(&mqtt.Publish{Topic: []byte("sport/tennis/tom"), Payload: []byte("ace")})
+	msg, ok := sub.read().(*mqtt.Publish)
+	require.True(t, ok)
+	require.Equal(t, []byte("ace"), msg.Payload)
+	sub.quiet()
+
+	v3, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V311, ClientID: "v3", CleanStart: true})
+	defer v3.close()
+	require.Equal(t, []mqtt.ReasonCode{mqtt.Failure}, v3.subscribe(1, "news", 0).ReasonCodes)
+}
@@ -0,0 +1,326 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocketSubprotocol is the subprotocol of MQTT over WebSocket
+const WebSocketSubprotocol = "mqtt"
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation byte = 0x0
+	wsText         byte = 0x1
+	wsBinary       byte = 0x2
+	wsClose        byte = 0x8
+	wsPing         byte = 0x9
+	wsPong         byte = 0xA
+)
+
+// WebSocket close status codes
+const (
+	wsCloseNormal          = 1000
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+)
+
+var (
+	errWebSocketProtocol = errors.New("websocket protocol error")
+	errWebSocketClosed   = errors.New("websocket closed")
+)
+
+// WebSocketHandler returns an http.Handler upgrading requests to WebSocket
+// connections with the 'mqtt' subprotocol, which are then served like TCP
+// connections by ServeConn.
+func (s *Server) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(s.serveWebSocket)
+}
+
+// ListenAndServeWebSocket listens on the TCP network address addr and serves
+// MQTT over WebSocket on path
+func (s *Server) ListenAndServeWebSocket(addr, path string) error {
+	mux := http.NewServeMux()
+	mux.Handle(path, s.WebSocketHandler())
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	defer s.wg.Done()
+
+	hs := &http.Server{Handler: mux}
+	err = hs.Serve(l)
+	// Close the connections not upgraded yet, the upgraded ones being served
+	// and closed as the TCP ones
+	hs.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+	if s.closed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "broker: expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "broker: unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "broker: missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	if !headerContains(r.Header, "Sec-WebSocket-Protocol", WebSocketSubprotocol) {
+		http.Error(w, "broker: the 'mqtt' WebSocket subprotocol is required", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "broker: connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+
+	h := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n"+
+		"Sec-WebSocket-Protocol: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(h[:]), WebSocketSubprotocol)
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.ServeConn(&wsConn{Conn: conn, br: brw.Reader})
+}
+
+// headerContains reports whether the comma separated values of header name
+// include token, ignoring case
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn carries the MQTT byte stream in the binary frames of a server side
+// WebSocket connection. Frame boundaries are not significant.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	// remaining bytes of the current data frame and its masking key
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+
+	// whether the current message expects continuation frames
+	fragmented bool
+
+	wmu    sync.Mutex
+	closed bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers, answering control frames, up to the next
+// data frame
+func (c *wsConn) nextFrame() error {
+	var h [2]byte
+	if _, err := io.ReadFull(c.br, h[:]); err != nil {
+		return err
+	}
+
+	fin, opcode := h[0]&0x80 != 0, h[0]&0x0f
+	if h[0]&0x70 != 0 || h[1]&0x80 == 0 {
+		// Reserved bits without extension, or a frame the client did not mask
+		return c.fail(wsCloseProtocolError)
+	}
+
+	length := uint64(h[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case wsBinary, wsContinuation:
+		// A continuation frame follows a data frame without FIN, which is
+		// only followed by continuation frames
+		if (opcode == wsContinuation) != c.fragmented {
+			return c.fail(wsCloseProtocolError)
+		}
+		c.fragmented = !fin
+		c.remaining = length
+		return nil
+
+	case wsClose, wsPing, wsPong:
+		if !fin || length > 125 {
+			return c.fail(wsCloseProtocolError)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= c.mask[i&3]
+		}
+
+		switch opcode {
+		case wsClose:
+			c.writeClose(payload)
+			return io.EOF
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case wsText:
+		return c.fail(wsCloseUnsupportedData)
+	}
+	return c.fail(wsCloseProtocolError)
+}
+
+func (c *wsConn) fail(status uint16) error {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], status)
+	c.writeClose(b[:])
+	return errWebSocketProtocol
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return errWebSocketClosed
+	}
+	return c.writeFrameLocked(opcode, payload)
+}
+
+func (c *wsConn) writeFrameLocked(opcode byte, payload []byte) error {
+	h := make([]byte, 2, 10+len(payload))
+	h[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		h[1] = byte(n)
+	case n <= 0xffff:
+		h[1] = 126
+		h = append(h, byte(n>>8), byte(n))
+	default:
+		h[1] = 127
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		h = append(h, b[:]...)
+	}
+	_, err := c.Conn.Write(append(h, payload...))
+	return err
+}
+
+// writeClose sends the close frame once, echoing status
+func (c *wsConn) writeClose(status []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if len(status) > 2 {
+		status = status[:2]
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrameLocked(wsClose, status)
+}
+
+func (c *wsConn) Close() error {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], wsCloseNormal)
+	c.writeClose(b[:])
+	return c.Conn.Close()
+}
@@ -0,0 +1,265 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TheSmallBoat/cabinet/mqtt"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// wsClientConn is the client side of a WebSocket connection, masking the
+// frames it sends
+type wsClientConn struct {
+	net.Conn
+	br        *bufio.Reader
+	remaining int
+}
+
+func dialWebSocket(t *testing.T, addr string, protocol string) (*wsClientConn, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/mqtt", nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if protocol != "" {
+		req.Header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	require.NoError(t, req.Write(conn))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+
+	return &wsClientConn{Conn: conn, br: br}, resp
+}
+
+func (c *wsClientConn) writeFrame(opcode byte, payload []byte) error {
+	return c.writeFragment(opcode, payload, true)
+}
+
+// writeFragment writes a frame, which is the last one of its message when fin
+// is set
+func (c *wsClientConn) writeFragment(opcode byte, payload []byte, fin bool) error {
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	b := []byte{opcode}
+	if fin {
+		b[0] |= 0x80
+	}
+	if len(payload) < 126 {
+		b = append(b, 0x80|byte(len(payload)))
+	} else {
+		b = append(b, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	b = append(b, mask[:]...)
+	for i, c := range payload {
+		b = append(b, c^mask[i&3])
+	}
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+// Write splits p in two frames, as message boundaries are not significant
+func (c *wsClientConn) Write(p []byte) (int, error) {
+	half := len(p) / 2
+	if err := c.writeFragment(wsBinary, p[:half], false); err != nil {
+		return 0, err
+	}
+	if err := c.writeFrame(wsContinuation, p[half:]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsClientConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		opcode, payload, err := c.readFrame(false)
+		if err != nil {
+			return 0, err
+		}
+		if opcode == wsClose {
+			return 0, io.EOF
+		}
+		c.remaining = len(payload)
+	}
+	if len(p) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	c.remaining -= n
+	return n, err
+}
+
+// readFrame reads a frame header, and the payload of control frames or when
+// all is set
+func (c *wsClientConn) readFrame(all bool) (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(c.br, h[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(h[1] & 0x7f)
+	if n == 126 {
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = int(binary.BigEndian.Uint16(b[:]))
+	}
+	opcode := h[0] & 0x0f
+	if opcode < wsClose && !all {
+		return opcode, make([]byte, n), nil
+	}
+	payload := make([]byte, n)
+	_, err := io.ReadFull(c.br, payload)
+	return opcode, payload, err
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s := NewServer()
+	ts := httptest.NewServer(s.WebSocketHandler())
+	defer ts.Close()
+	defer s.Close()
+
+	addr := ts.Listener.Addr().String()
+
+	c, resp := dialWebSocket(t, addr, "")
+	c.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	c, resp = dialWebSocket(t, addr, "wamp, mqtt")
+	defer c.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	require.Equal(t, "mqtt", resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	h := sha1.Sum([]byte("dGhlIHNhbXBsZSBub25jZQ==" + websocketGUID))
+	require.Equal(t, base64.StdEncoding.EncodeToString(h[:]), resp.Header.Get("Sec-WebSocket-Accept"))
+	require.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+
+	// Pings are answered with the same payload
+	require.NoError(t, c.writeFrame(wsPing, []byte("hello")))
+	opcode, payload, err := c.readFrame(true)
+	require.NoError(t, err)
+	require.Equal(t, wsPong, opcode)
+	require.Equal(t, []byte("hello"), payload)
+
+	// Text frames are refused
+	require.NoError(t, c.writeFrame(wsText, []byte("hello")))
+	opcode, payload, err = c.readFrame(true)
+	require.NoError(t, err)
+	require.Equal(t, wsClose, opcode)
+	require.Equal(t, []byte{0x03, 0xeb}, payload)
+
+	// So are continuation frames without a data frame to continue
+	c, resp = dialWebSocket(t, addr, "mqtt")
+	defer c.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	require.NoError(t, c.writeFrame(wsContinuation, []byte{0x10}))
+	opcode, payload, err = c.readFrame(true)
+	require.NoError(t, err)
+	require.Equal(t, wsClose, opcode)
+	require.Equal(t, []byte{0x03, 0xea}, payload)
+
+	// And data frames interrupting a fragmented message
+	c, resp = dialWebSocket(t, addr, "mqtt")
+	defer c.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	require.NoError(t, c.writeFragment(wsBinary, []byte{0x10}, false))
+	require.NoError(t, c.writeFrame(wsBinary, []byte{0x00}))
+	opcode, payload, err = c.readFrame(true)
+	require.NoError(t, err)
+	require.Equal(t, wsClose, opcode)
+	require.Equal(t, []byte{0x03, 0xea}, payload)
+}
+
+func TestListenAndServeWebSocket(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	s := NewServer()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.ListenAndServeWebSocket(addr, "/mqtt")
+	}()
+
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	wc, resp := dialWebSocket(t, addr, "mqtt")
+	defer wc.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	c, ack := connect(t, wc, &mqtt.Connect{Version: mqtt.V5, ClientID: "c", CleanStart: true})
+	require.Equal(t, mqtt.Success, ack.ReasonCode)
+
+	// Close closes the listener and the connections, and waits for them
+	require.NoError(t, s.Close())
+	require.True(t, errors.Is(<-errs, ErrServerClosed))
+	_, err = mqtt.ReadPacket(c.br, c.v)
+	require.Error(t, err)
+	_, err = net.Dial("tcp", addr)
+	require.Error(t, err)
+}
+
+func TestWebSocketRouting(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s, addr := startServer(t)
+	ts := httptest.NewServer(s.WebSocketHandler())
+	defer ts.Close()
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	wc, resp := dialWebSocket(t, ts.Listener.Addr().String(), "mqtt")
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	sub, ack := connect(t, wc, &mqtt.Connect{Version: mqtt.V5, ClientID: "dashboard", CleanStart: true})
+	defer sub.close()
+	require.Equal(t, mqtt.Success, ack.ReasonCode)
+	sub.subscribe(1, "sensors/+/temp", 1)
+
+	pub, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V311, ClientID: "sensor", CleanStart: true})
+	defer pub.close()
+
+	// A payload large enough for the extended frame length
+	payload := make([]byte, 300)
+	pub.write(&mqtt.Publish{QoS: 1, PacketID: 1, Topic: []byte("sensors/s1/temp"), Payload: payload})
+	_, ok := pub.read().(*mqtt.Puback)
+	require.True(t, ok)
+
+	msg, ok := sub.read().(*mqtt.Publish)
+	require.True(t, ok)
+	require.Equal(t, []byte("sensors/s1/temp"), msg.Topic)
+	require.Equal(t, payload, msg.Payload)
+
+	// Sessions are shared: the TCP connection takes over the WebSocket one
+	tcp, _ := dial(t, addr, &mqtt.Connect{Version: mqtt.V5, ClientID: "dashboard", CleanStart: true})
+	defer tcp.close()
+	d, ok := sub.read().(*mqtt.Disconnect)
+	require.True(t, ok)
+	require.Equal(t, mqtt.SessionTakenOver, d.ReasonCode)
+}
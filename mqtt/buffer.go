@@ -0,0 +1,169 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+// reader decodes the primitive data types of the MQTT wire format. The first
+// failure is kept in err and every later read returns zero values, so decoders
+// check the error once at the end.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format+": %w", append(args, ErrMalformedPacket)...)
+	}
+	r.b = nil
+}
+
+func (r *reader) len() int {
+	return len(r.b)
+}
+
+func (r *reader) byte() byte {
+	if len(r.b) < 1 {
+		r.fail("mqtt/reader: byte out of range")
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *reader) uint16() uint16 {
+	if len(r.b) < 2 {
+		r.fail("mqtt/reader: two byte integer out of range")
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *reader) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.fail("mqtt/reader: four byte integer out of range")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *reader) varint() uint32 {
+	var v uint32
+	for i := uint(0); i < 4; i++ {
+		c := r.byte()
+		v |= uint32(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			return v
+		}
+	}
+	r.fail("mqtt/reader: variable byte integer exceeds 4 bytes")
+	return 0
+}
+
+// binary returns length-prefixed binary data. The result aliases the packet body.
+func (r *reader) binary() []byte {
+	n := int(r.uint16())
+	if len(r.b) < n {
+		r.fail("mqtt/reader: binary data of %d bytes out of range", n)
+		return nil
+	}
+	v := r.b[:n:n]
+	r.b = r.b[n:]
+	return v
+}
+
+// utf8 returns a length-prefixed UTF-8 encoded string as bytes
+func (r *reader) utf8() []byte {
+	v := r.binary()
+	if r.err == nil && !validUTF8(v) {
+		r.fail("mqtt/reader: invalid UTF-8 string")
+		return nil
+	}
+	return v
+}
+
+func (r *reader) string() string {
+	return string(r.utf8())
+}
+
+// validUTF8 reports whether b is well-formed UTF-8 without the null character
+func validUTF8(b []byte) bool {
+	for _, c := range b {
+		if c == 0 {
+			return false
+		}
+	}
+	return utf8.Valid(b)
+}
+
+// writer encodes the primitive data types of the MQTT wire format. Like the
+// reader, it keeps the first failure in err.
+type writer struct {
+	b   []byte
+	err error
+}
+
+func (w *writer) byte(c byte) {
+	w.b = append(w.b, c)
+}
+
+func (w *writer) uint16(v uint16) {
+	w.b = append(w.b, byte(v>>8), byte(v))
+}
+
+func (w *writer) uint32(v uint32) {
+	w.b = append(w.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *writer) varint(v uint32) {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v > 0 {
+			c |= 0x80
+		}
+		w.b = append(w.b, c)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func (w *writer) binary(v []byte) {
+	if len(v) > 0xffff {
+		if w.err == nil {
+			w.err = fmt.Errorf("mqtt/writer: %d bytes exceed the two byte length prefix: %w", len(v), ErrMalformedPacket)
+		}
+		return
+	}
+	w.uint16(uint16(len(v)))
+	w.b = append(w.b, v...)
+}
+
+func (w *writer) string(v string) {
+	if len(v) > 0xffff {
+		if w.err == nil {
+			w.err = fmt.Errorf("mqtt/writer: %d bytes exceed the two byte length prefix: %w", len(v), ErrMalformedPacket)
+		}
+		return
+	}
+	w.uint16(uint16(len(v)))
+	w.b = append(w.b, v...)
+}
+
+func varintLen(v uint32) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
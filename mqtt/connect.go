@@ -0,0 +1,190 @@
+package mqtt
+
+import (
+	"fmt"
+)
+
+// Will is the Will Message of a CONNECT packet
+type Will struct {
+	Topic      []byte
+	Payload    []byte
+	QoS        byte
+	Retain     bool
+	Properties Properties
+}
+
+// Connect is the CONNECT packet. Its protocol version is decoded from the
+// packet itself, so the version passed to ReadPacket is ignored.
+type Connect struct {
+	ProtocolName string
+	Version      Version
+	CleanStart   bool
+	KeepAlive    uint16
+	Properties   Properties
+	ClientID     string
+	Will         *Will
+
+	// Username and Password are nil when absent
+	Username []byte
+	Password []byte
+}
+
+func (p *Connect) Type() Type {
+	return CONNECT
+}
+
+func (p *Connect) decode(r *reader, flags byte, _ Version) error {
+	if flags != 0 {
+		return fmt.Errorf("mqtt/Connect.decode: fixed header flags 0x%X: %w", flags, ErrMalformedPacket)
+	}
+
+	p.ProtocolName = r.string()
+	p.Version = Version(r.byte())
+	if r.err != nil {
+		return r.err
+	}
+	if p.ProtocolName != "MQTT" {
+		return fmt.Errorf("mqtt/Connect.decode: protocol name %q: %w", p.ProtocolName, ErrProtocolError)
+	}
+	if p.Version != V311 && p.Version != V5 {
+		return fmt.Errorf("mqtt/Connect.decode: protocol version %d: %w", p.Version, ErrUnsupportedVersion)
+	}
+
+	c := r.byte()
+	if c&0x01 != 0 {
+		return fmt.Errorf("mqtt/Connect.decode: reserved flag set: %w", ErrMalformedPacket)
+	}
+	p.CleanStart = c&0x02 != 0
+	willFlag := c&0x04 != 0
+	willQoS := (c >> 3) & 0x03
+	willRetain := c&0x20 != 0
+	passwordFlag := c&0x40 != 0
+	usernameFlag := c&0x80 != 0
+
+	if willQoS > 2 || (!willFlag && (willQoS != 0 || willRetain)) {
+		return fmt.Errorf("mqtt/Connect.decode: will flags 0x%X: %w", c, ErrMalformedPacket)
+	}
+	if p.Version < V5 && passwordFlag && !usernameFlag {
+		return fmt.Errorf("mqtt/Connect.decode: password without user name: %w", ErrMalformedPacket)
+	}
+
+	p.KeepAlive = r.uint16()
+	if p.Version >= V5 {
+		if err := p.Properties.decode(r); err != nil {
+			return err
+		}
+	}
+
+	p.ClientID = r.string()
+	if willFlag {
+		p.Will = &Will{QoS: willQoS, Retain: willRetain}
+		if p.Version >= V5 {
+			if err := p.Will.Properties.decode(r); err != nil {
+				return err
+			}
+		}
+		p.Will.Topic = r.utf8()
+		p.Will.Payload = r.binary()
+	}
+	if usernameFlag {
+		p.Username = append([]byte{}, r.utf8()...)
+	}
+	if passwordFlag {
+		p.Password = append([]byte{}, r.binary()...)
+	}
+	return nil
+}
+
+func (p *Connect) encode(w *writer, _ Version) (byte, error) {
+	name := p.ProtocolName
+	if name == "" {
+		name = "MQTT"
+	}
+	w.string(name)
+	w.byte(byte(p.Version))
+
+	var c byte
+	if p.CleanStart {
+		c |= 0x02
+	}
+	if p.Will != nil {
+		c |= 0x04 | (p.Will.QoS&0x03)<<3
+		if p.Will.Retain {
+			c |= 0x20
+		}
+	}
+	if p.Password != nil {
+		c |= 0x40
+	}
+	if p.Username != nil {
+		c |= 0x80
+	}
+	w.byte(c)
+
+	w.uint16(p.KeepAlive)
+	if p.Version >= V5 {
+		p.Properties.encode(w)
+	}
+	w.string(p.ClientID)
+	if p.Will != nil {
+		if p.Version >= V5 {
+			p.Will.Properties.encode(w)
+		}
+		w.binary(p.Will.Topic)
+		w.binary(p.Will.Payload)
+	}
+	if p.Username != nil {
+		w.binary(p.Username)
+	}
+	if p.Password != nil {
+		w.binary(p.Password)
+	}
+	return 0, nil
+}
+
+// Connack is the CONNACK packet. ReasonCode always holds the MQTT 5.0 code,
+// which is mapped to the 3.1.1 return code on the wire.
+type Connack struct {
+	SessionPresent bool
+	ReasonCode     ReasonCode
+	Properties     Properties
+}
+
+func (p *Connack) Type() Type {
+	return CONNACK
+}
+
+func (p *Connack) decode(r *reader, flags byte, v Version) error {
+	if flags != 0 {
+		return fmt.Errorf("mqtt/Connack.decode: fixed header flags 0x%X: %w", flags, ErrMalformedPacket)
+	}
+
+	c := r.byte()
+	if c&0xfe != 0 {
+		return fmt.Errorf("mqtt/Connack.decode: reserved flags set: %w", ErrMalformedPacket)
+	}
+	p.SessionPresent = c&0x01 != 0
+
+	if v < V5 {
+		p.ReasonCode = connackV5(r.byte())
+		return nil
+	}
+	p.ReasonCode = ReasonCode(r.byte())
+	return p.Properties.decode(r)
+}
+
+func (p *Connack) encode(w *writer, v Version) (byte, error) {
+	if p.SessionPresent {
+		w.byte(0x01)
+	} else {
+		w.byte(0)
+	}
+
+	if v < V5 {
+		w.byte(connackV311(p.ReasonCode))
+		return 0, nil
+	}
+	w.byte(byte(p.ReasonCode))
+	p.Properties.encode(w)
+	return 0, nil
+}
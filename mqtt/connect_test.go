@@ -0,0 +1,89 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestConnectRoundTrip(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	expiry := uint32(30)
+	connects := []*Connect{
+		{ProtocolName: "MQTT", Version: V311, CleanStart: true, KeepAlive: 60, ClientID: "dev1"},
+		{
+			ProtocolName: "MQTT",
+			Version:      V5,
+			KeepAlive:    10,
+			Properties:   Properties{SessionExpiryInterval: &expiry, ReceiveMaximum: 10},
+			ClientID:     "dev2",
+			Will: &Will{
+				Topic:      []byte("status/dev2"),
+				Payload:    []byte("offline"),
+				QoS:        1,
+				Retain:     true,
+				Properties: Properties{WillDelayInterval: 5, ContentType: "text/plain"},
+			},
+			Username: []byte("user"),
+			Password: []byte{},
+		},
+	}
+
+	for _, cp := range connects {
+		b, err := EncodePacket(cp, cp.Version)
+		require.NoError(t, err)
+
+		// The protocol version is taken from the packet
+		p, err := ReadPacket(bytes.NewReader(b), V311)
+		require.NoError(t, err)
+		require.Equal(t, cp, p)
+	}
+}
+
+func TestConnectDecodeFailure(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	header := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T'}
+	bodies := [][]byte{
+		{0x00, 0x04, 'M', 'Q', 'T', 'X', 0x04, 0x02, 0x00, 0x00, 0x00, 0x00},
+		append(header, 0x04, 0x03, 0x00, 0x00, 0x00, 0x00), // reserved flag
+		append(header, 0x04, 0x1a, 0x00, 0x00, 0x00, 0x00), // will QoS 3
+		append(header, 0x04, 0x10, 0x00, 0x00, 0x00, 0x00), // will QoS without will flag
+		append(header, 0x04, 0x40, 0x00, 0x00, 0x00, 0x00), // password without user name
+	}
+
+	for i, b := range bodies {
+		require.Error(t, DecodePacket(&Connect{}, 0, b, V5), "case %d", i)
+	}
+
+	err := DecodePacket(&Connect{}, 0, append(header, 0x03, 0x02, 0x00, 0x00, 0x00, 0x00), V5)
+	require.True(t, errors.Is(err, ErrUnsupportedVersion))
+}
+
+func TestConnackVersions(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ack := &Connack{SessionPresent: true, ReasonCode: BadUserNameOrPassword}
+
+	b, err := EncodePacket(ack, V311)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x20, 0x02, 0x01, 0x04}, b)
+
+	p, err := ReadPacket(bytes.NewReader(b), V311)
+	require.NoError(t, err)
+	require.Equal(t, ack, p)
+
+	maxQoS := byte(1)
+	ack.Properties.MaximumQoS = &maxQoS
+	b, err = EncodePacket(ack, V5)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x20, 0x05, 0x01, 0x86, 0x02, 0x24, 0x01}, b)
+
+	p, err = ReadPacket(bytes.NewReader(b), V5)
+	require.NoError(t, err)
+	require.Equal(t, ack, p)
+}
@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"fmt"
+)
+
+// Pingreq is the PINGREQ packet
+type Pingreq struct{}
+
+func (p *Pingreq) Type() Type {
+	return PINGREQ
+}
+
+func (p *Pingreq) decode(r *reader, flags byte, _ Version) error {
+	return decodeEmpty(PINGREQ, r, flags)
+}
+
+func (p *Pingreq) encode(w *writer, _ Version) (byte, error) {
+	return 0, nil
+}
+
+// Pingresp is the PINGRESP packet
+type Pingresp struct{}
+
+func (p *Pingresp) Type() Type {
+	return PINGRESP
+}
+
+func (p *Pingresp) decode(r *reader, flags byte, _ Version) error {
+	return decodeEmpty(PINGRESP, r, flags)
+}
+
+func (p *Pingresp) encode(w *writer, _ Version) (byte, error) {
+	return 0, nil
+}
+
+func decodeEmpty(t Type, r *reader, flags byte) error {
+	if flags != 0 || r.len() != 0 {
+		return fmt.Errorf("mqtt/decodeEmpty: %s with flags 0x%X and %d bytes: %w", t, flags, r.len(), ErrMalformedPacket)
+	}
+	return nil
+}
+
+// Disconnect is the DISCONNECT packet. Reason code and properties are MQTT 5.0
+// only.
+type Disconnect struct {
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (p *Disconnect) Type() Type {
+	return DISCONNECT
+}
+
+func (p *Disconnect) decode(r *reader, flags byte, v Version) error {
+	if flags != 0 {
+		return fmt.Errorf("mqtt/Disconnect.decode: fixed header flags 0x%X: %w", flags, ErrMalformedPacket)
+	}
+	if v < V5 || r.len() == 0 {
+		return nil
+	}
+
+	p.ReasonCode = ReasonCode(r.byte())
+	if r.len() == 0 {
+		return nil
+	}
+	return p.Properties.decode(r)
+}
+
+func (p *Disconnect) encode(w *writer, v Version) (byte, error) {
+	if v < V5 {
+		return 0, nil
+	}
+
+	pw := &writer{}
+	p.Properties.encode(pw)
+	if p.ReasonCode == NormalDisconnection && len(pw.b) == 1 {
+		return 0, pw.err
+	}
+	w.byte(byte(p.ReasonCode))
+	w.b = append(w.b, pw.b...)
+	return 0, pw.err
+}
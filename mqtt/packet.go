@@ -0,0 +1,272 @@
+// Package mqtt encodes and decodes MQTT 3.1.1 and 5.0 control packets and
+// translates them into operations on a cabinet topic tree.
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the MQTT protocol level carried in the CONNECT packet
+type Version byte
+
+const (
+	// V311 is MQTT 3.1.1
+	V311 Version = 4
+
+	// V5 is MQTT 5.0
+	V5 Version = 5
+)
+
+// Type is the MQTT control packet type
+type Type byte
+
+const (
+	CONNECT Type = iota + 1
+	CONNACK
+	PUBLISH
+	PUBACK
+	PUBREC
+	PUBREL
+	PUBCOMP
+	SUBSCRIBE
+	SUBACK
+	UNSUBSCRIBE
+	UNSUBACK
+	PINGREQ
+	PINGRESP
+	DISCONNECT
+	AUTH
+)
+
+var typeNames = [...]string{
+	CONNECT:     "CONNECT",
+	CONNACK:     "CONNACK",
+	PUBLISH:     "PUBLISH",
+	PUBACK:      "PUBACK",
+	PUBREC:      "PUBREC",
+	PUBREL:      "PUBREL",
+	PUBCOMP:     "PUBCOMP",
+	SUBSCRIBE:   "SUBSCRIBE",
+	SUBACK:      "SUBACK",
+	UNSUBSCRIBE: "UNSUBSCRIBE",
+	UNSUBACK:    "UNSUBACK",
+	PINGREQ:     "PINGREQ",
+	PINGRESP:    "PINGRESP",
+	DISCONNECT:  "DISCONNECT",
+	AUTH:        "AUTH",
+}
+
+func (t Type) String() string {
+	if int(t) < len(typeNames) && typeNames[t] != "" {
+		return typeNames[t]
+	}
+	return fmt.Sprintf("Type(%d)", byte(t))
+}
+
+// MaxRemainingLength is the largest remaining length the fixed header can encode
+const MaxRemainingLength = 268435455
+
+var (
+	// ErrMalformedPacket is returned when a packet does not follow the wire format
+	ErrMalformedPacket = errors.New("malformed packet")
+
+	// ErrProtocolError is returned when a well-formed packet violates the protocol
+	ErrProtocolError = errors.New("protocol error")
+
+	// ErrUnsupportedPacket is returned for packet types this package cannot decode
+	ErrUnsupportedPacket = errors.New("unsupported packet type")
+
+	// ErrPacketTooLarge is returned for packets exceeding the size limit of the reader
+	ErrPacketTooLarge = errors.New("packet too large")
+
+	// ErrUnsupportedVersion is returned for CONNECT packets of unknown protocol levels
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+// Packet is a decoded MQTT control packet
+type Packet interface {
+	// Type returns the control packet type
+	Type() Type
+
+	decode(r *reader, flags byte, v Version) error
+	encode(w *writer, v Version) (flags byte, err error)
+}
+
+func newPacket(t Type) (Packet, error) {
+	switch t {
+	case CONNECT:
+		return &Connect{}, nil
+	case CONNACK:
+		return &Connack{}, nil
+	case PUBLISH:
+		return &Publish{}, nil
+	case PUBACK:
+		return &Puback{}, nil
+	case SUBSCRIBE:
+		return &Subscribe{}, nil
+	case SUBACK:
+		return &Suback{}, nil
+	case UNSUBSCRIBE:
+		return &Unsubscribe{}, nil
+	case UNSUBACK:
+		return &Unsuback{}, nil
+	case PINGREQ:
+		return &Pingreq{}, nil
+	case PINGRESP:
+		return &Pingresp{}, nil
+	case DISCONNECT:
+		return &Disconnect{}, nil
+	}
+	return nil, fmt.Errorf("mqtt/newPacket: %s: %w", t, ErrUnsupportedPacket)
+}
+
+// ReadPacket reads one control packet from r using the rules of protocol version v
+func ReadPacket(r io.Reader, v Version) (Packet, error) {
+	return ReadPacketLimit(r, v, MaxRemainingLength)
+}
+
+// ReadPacketLimit is ReadPacket refusing packets whose remaining length exceeds
+// limit with ErrPacketTooLarge, before their body is read
+func ReadPacketLimit(r io.Reader, v Version, limit int) (Packet, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &byteReader{r: r}
+	}
+
+	header, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := readVarint(br)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if int(length) > limit {
+		return nil, fmt.Errorf("mqtt/ReadPacketLimit: remaining length %d exceeds %d: %w", length, limit, ErrPacketTooLarge)
+	}
+
+	// The body is consumed even for unsupported packets, so that the stream
+	// stays aligned on the next fixed header
+	body, err := readBody(r, int(length))
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := newPacket(Type(header >> 4))
+	if err != nil {
+		return nil, err
+	}
+
+	return p, DecodePacket(p, header&0x0f, body, v)
+}
+
+// DecodePacket decodes the variable header and payload of a packet whose fixed
+// header carried flags
+func DecodePacket(p Packet, flags byte, body []byte, v Version) error {
+	rd := &reader{b: body}
+	if err := p.decode(rd, flags, v); err != nil {
+		return err
+	}
+	if rd.err != nil {
+		return fmt.Errorf("mqtt/DecodePacket: %s: %w", p.Type(), rd.err)
+	}
+	if len(rd.b) != 0 {
+		return fmt.Errorf("mqtt/DecodePacket: %s: %d trailing bytes: %w", p.Type(), len(rd.b), ErrMalformedPacket)
+	}
+	return nil
+}
+
+// WritePacket encodes p with the rules of protocol version v and writes it to w
+func WritePacket(w io.Writer, p Packet, v Version) error {
+	b, err := EncodePacket(p, v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// EncodePacket returns the wire form of p, fixed header included
+func EncodePacket(p Packet, v Version) ([]byte, error) {
+	body := &writer{}
+	flags, err := p.encode(body, v)
+	if err == nil {
+		err = body.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(body.b) > MaxRemainingLength {
+		return nil, fmt.Errorf("mqtt/EncodePacket: %s: remaining length %d too large: %w", p.Type(), len(body.b), ErrMalformedPacket)
+	}
+
+	out := &writer{b: make([]byte, 0, len(body.b)+5)}
+	out.byte(byte(p.Type())<<4 | flags)
+	out.varint(uint32(len(body.b)))
+	out.b = append(out.b, body.b...)
+
+	return out.b, nil
+}
+
+// byteReader reads the fixed header one byte at a time, so that nothing past
+// the header is consumed from the underlying reader
+// bodyChunk is the length of the bodies allocated before being read. Longer
+// ones grow as they are read, so that a length alone does not allocate them.
+const bodyChunk = 64 << 10
+
+// readBody reads the n bytes of a packet body
+func readBody(r io.Reader, n int) ([]byte, error) {
+	var (
+		body []byte
+		err  error
+	)
+	if n <= bodyChunk {
+		body = make([]byte, n)
+		_, err = io.ReadFull(r, body)
+	} else {
+		var buf bytes.Buffer
+		buf.Grow(bodyChunk)
+		_, err = io.CopyN(&buf, r, int64(n))
+		body = buf.Bytes()
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return body, err
+}
+
+type byteReader struct {
+	r io.Reader
+	b [1]byte
+}
+
+func (br *byteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(br.r, br.b[:])
+	return br.b[0], err
+}
+
+func readVarint(br io.ByteReader) (uint32, error) {
+	var value uint32
+	for i := uint(0); i < 4; i++ {
+		c, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		value |= uint32(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			return value, nil
+		}
+	}
+	return 0, fmt.Errorf("mqtt/readVarint: variable byte integer exceeds 4 bytes: %w", ErrMalformedPacket)
+}
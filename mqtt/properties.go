@@ -0,0 +1,315 @@
+package mqtt
+
+import (
+	"fmt"
+)
+
+// MQTT 5.0 property identifiers
+const (
+	propPayloadFormatIndicator          byte = 0x01
+	propMessageExpiryInterval           byte = 0x02
+	propContentType                     byte = 0x03
+	propResponseTopic                   byte = 0x08
+	propCorrelationData                 byte = 0x09
+	propSubscriptionIdentifier          byte = 0x0B
+	propSessionExpiryInterval           byte = 0x11
+	propAssignedClientIdentifier        byte = 0x12
+	propServerKeepAlive                 byte = 0x13
+	propAuthenticationMethod            byte = 0x15
+	propAuthenticationData              byte = 0x16
+	propRequestProblemInformation       byte = 0x17
+	propWillDelayInterval               byte = 0x18
+	propRequestResponseInformation      byte = 0x19
+	propResponseInformation             byte = 0x1A
+	propServerReference                 byte = 0x1C
+	propReasonString                    byte = 0x1F
+	propReceiveMaximum                  byte = 0x21
+	propTopicAliasMaximum               byte = 0x22
+	propTopicAlias                      byte = 0x23
+	propMaximumQoS                      byte = 0x24
+	propRetainAvailable                 byte = 0x25
+	propUserProperty                    byte = 0x26
+	propMaximumPacketSize               byte = 0x27
+	propWildcardSubscriptionAvailable   byte = 0x28
+	propSubscriptionIdentifierAvailable byte = 0x29
+	propSharedSubscriptionAvailable     byte = 0x2A
+)
+
+// UserProperty is a name and value pair carried in MQTT 5.0 properties
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties holds the MQTT 5.0 properties of a packet. They are ignored when
+// encoding and never set when decoding with protocol version V311.
+//
+// Properties whose zero value is meaningful are pointers, nil when absent.
+// The others are absent when zero.
+type Properties struct {
+	PayloadFormatIndicator byte
+	MessageExpiryInterval  *uint32
+	ContentType            string
+	ResponseTopic          []byte
+	CorrelationData        []byte
+
+	// SubscriptionIdentifier of a SUBSCRIBE or PUBLISH packet
+	SubscriptionIdentifier uint32
+
+	SessionExpiryInterval      *uint32
+	AssignedClientIdentifier   string
+	ServerKeepAlive            *uint16
+	AuthenticationMethod       string
+	AuthenticationData         []byte
+	RequestProblemInformation  *byte
+	WillDelayInterval          uint32
+	RequestResponseInformation byte
+	ResponseInformation        string
+	ServerReference            string
+
+	// ReasonString is a human readable diagnostic of an acknowledgement
+	ReasonString string
+
+	ReceiveMaximum                   uint16
+	TopicAliasMaximum                uint16
+	TopicAlias                       uint16
+	MaximumQoS                       *byte
+	RetainAvailable                  *byte
+	MaximumPacketSize                uint32
+	WildcardSubscriptionAvailable    *byte
+	SubscriptionIdentifiersAvailable *byte
+	SharedSubscriptionAvailable      *byte
+
+	// UserProperties in the order they appear on the wire
+	UserProperties []UserProperty
+}
+
+func (p *Properties) decode(r *reader) error {
+	n := int(r.varint())
+	if r.err != nil {
+		return r.err
+	}
+	if n > r.len() {
+		r.fail("mqtt/Properties.decode: property length %d out of range", n)
+		return r.err
+	}
+
+	pr := &reader{b: r.b[:n]}
+	r.b = r.b[n:]
+
+	var seen uint64
+	for pr.len() > 0 && pr.err == nil {
+		id := pr.byte()
+		if id != propUserProperty {
+			if id < 64 && seen&(1<<id) != 0 {
+				return fmt.Errorf("mqtt/Properties.decode: property 0x%02X included more than once: %w", id, ErrProtocolError)
+			}
+			if id < 64 {
+				seen |= 1 << id
+			}
+		}
+
+		switch id {
+		case propPayloadFormatIndicator:
+			p.PayloadFormatIndicator = pr.byte()
+		case propMessageExpiryInterval:
+			v := pr.uint32()
+			p.MessageExpiryInterval = &v
+		case propContentType:
+			p.ContentType = pr.string()
+		case propResponseTopic:
+			p.ResponseTopic = pr.utf8()
+		case propCorrelationData:
+			p.CorrelationData = pr.binary()
+		case propSubscriptionIdentifier:
+			p.SubscriptionIdentifier = pr.varint()
+			if pr.err == nil && p.SubscriptionIdentifier == 0 {
+				return fmt.Errorf("mqtt/Properties.decode: subscription identifier of 0: %w", ErrProtocolError)
+			}
+		case propSessionExpiryInterval:
+			v := pr.uint32()
+			p.SessionExpiryInterval = &v
+		case propAssignedClientIdentifier:
+			p.AssignedClientIdentifier = pr.string()
+		case propServerKeepAlive:
+			v := pr.uint16()
+			p.ServerKeepAlive = &v
+		case propAuthenticationMethod:
+			p.AuthenticationMethod = pr.string()
+		case propAuthenticationData:
+			p.AuthenticationData = pr.binary()
+		case propRequestProblemInformation:
+			v := pr.byte()
+			p.RequestProblemInformation = &v
+		case propWillDelayInterval:
+			p.WillDelayInterval = pr.uint32()
+		case propRequestResponseInformation:
+			p.RequestResponseInformation = pr.byte()
+		case propResponseInformation:
+			p.ResponseInformation = pr.string()
+		case propServerReference:
+			p.ServerReference = pr.string()
+		case propReasonString:
+			p.ReasonString = pr.string()
+		case propReceiveMaximum:
+			p.ReceiveMaximum = pr.uint16()
+			if pr.err == nil && p.ReceiveMaximum == 0 {
+				return fmt.Errorf("mqtt/Properties.decode: receive maximum of 0: %w", ErrProtocolError)
+			}
+		case propTopicAliasMaximum:
+			p.TopicAliasMaximum = pr.uint16()
+		case propTopicAlias:
+			p.TopicAlias = pr.uint16()
+		case propMaximumQoS:
+			v := pr.byte()
+			p.MaximumQoS = &v
+		case propRetainAvailable:
+			v := pr.byte()
+			p.RetainAvailable = &v
+		case propUserProperty:
+			k := pr.string()
+			v := pr.string()
+			p.UserProperties = append(p.UserProperties, UserProperty{Key: k, Value: v})
+		case propMaximumPacketSize:
+			p.MaximumPacketSize = pr.uint32()
+			if pr.err == nil && p.MaximumPacketSize == 0 {
+				return fmt.Errorf("mqtt/Properties.decode: maximum packet size of 0: %w", ErrProtocolError)
+			}
+		case propWildcardSubscriptionAvailable:
+			v := pr.byte()
+			p.WildcardSubscriptionAvailable = &v
+		case propSubscriptionIdentifierAvailable:
+			v := pr.byte()
+			p.SubscriptionIdentifiersAvailable = &v
+		case propSharedSubscriptionAvailable:
+			v := pr.byte()
+			p.SharedSubscriptionAvailable = &v
+		default:
+			return fmt.Errorf("mqtt/Properties.decode: unknown property 0x%02X: %w", id, ErrMalformedPacket)
+		}
+	}
+
+	if pr.err != nil {
+		r.err = pr.err
+	}
+	return r.err
+}
+
+func (p *Properties) encode(w *writer) {
+	pw := &writer{}
+	if p.PayloadFormatIndicator != 0 {
+		pw.byte(propPayloadFormatIndicator)
+		pw.byte(p.PayloadFormatIndicator)
+	}
+	if p.MessageExpiryInterval != nil {
+		pw.byte(propMessageExpiryInterval)
+		pw.uint32(*p.MessageExpiryInterval)
+	}
+	if p.ContentType != "" {
+		pw.byte(propContentType)
+		pw.string(p.ContentType)
+	}
+	if p.ResponseTopic != nil {
+		pw.byte(propResponseTopic)
+		pw.binary(p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		pw.byte(propCorrelationData)
+		pw.binary(p.CorrelationData)
+	}
+	if p.SubscriptionIdentifier != 0 {
+		pw.byte(propSubscriptionIdentifier)
+		pw.varint(p.SubscriptionIdentifier)
+	}
+	if p.SessionExpiryInterval != nil {
+		pw.byte(propSessionExpiryInterval)
+		pw.uint32(*p.SessionExpiryInterval)
+	}
+	if p.AssignedClientIdentifier != "" {
+		pw.byte(propAssignedClientIdentifier)
+		pw.string(p.AssignedClientIdentifier)
+	}
+	if p.ServerKeepAlive != nil {
+		pw.byte(propServerKeepAlive)
+		pw.uint16(*p.ServerKeepAlive)
+	}
+	if p.AuthenticationMethod != "" {
+		pw.byte(propAuthenticationMethod)
+		pw.string(p.AuthenticationMethod)
+	}
+	if p.AuthenticationData != nil {
+		pw.byte(propAuthenticationData)
+		pw.binary(p.AuthenticationData)
+	}
+	if p.RequestProblemInformation != nil {
+		pw.byte(propRequestProblemInformation)
+		pw.byte(*p.RequestProblemInformation)
+	}
+	if p.WillDelayInterval != 0 {
+		pw.byte(propWillDelayInterval)
+		pw.uint32(p.WillDelayInterval)
+	}
+	if p.RequestResponseInformation != 0 {
+		pw.byte(propRequestResponseInformation)
+		pw.byte(p.RequestResponseInformation)
+	}
+	if p.ResponseInformation != "" {
+		pw.byte(propResponseInformation)
+		pw.string(p.ResponseInformation)
+	}
+	if p.ServerReference != "" {
+		pw.byte(propServerReference)
+		pw.string(p.ServerReference)
+	}
+	if p.ReasonString != "" {
+		pw.byte(propReasonString)
+		pw.string(p.ReasonString)
+	}
+	if p.ReceiveMaximum != 0 {
+		pw.byte(propReceiveMaximum)
+		pw.uint16(p.ReceiveMaximum)
+	}
+	if p.TopicAliasMaximum != 0 {
+		pw.byte(propTopicAliasMaximum)
+		pw.uint16(p.TopicAliasMaximum)
+	}
+	if p.TopicAlias != 0 {
+		pw.byte(propTopicAlias)
+		pw.uint16(p.TopicAlias)
+	}
+	if p.MaximumQoS != nil {
+		pw.byte(propMaximumQoS)
+		pw.byte(*p.MaximumQoS)
+	}
+	if p.RetainAvailable != nil {
+		pw.byte(propRetainAvailable)
+		pw.byte(*p.RetainAvailable)
+	}
+	for _, up := range p.UserProperties {
+		pw.byte(propUserProperty)
+		pw.string(up.Key)
+		pw.string(up.Value)
+	}
+	if p.MaximumPacketSize != 0 {
+		pw.byte(propMaximumPacketSize)
+		pw.uint32(p.MaximumPacketSize)
+	}
+	if p.WildcardSubscriptionAvailable != nil {
+		pw.byte(propWildcardSubscriptionAvailable)
+		pw.byte(*p.WildcardSubscriptionAvailable)
+	}
+	if p.SubscriptionIdentifiersAvailable != nil {
+		pw.byte(propSubscriptionIdentifierAvailable)
+		pw.byte(*p.SubscriptionIdentifiersAvailable)
+	}
+	if p.SharedSubscriptionAvailable != nil {
+		pw.byte(propSharedSubscriptionAvailable)
+		pw.byte(*p.SharedSubscriptionAvailable)
+	}
+
+	if pw.err != nil && w.err == nil {
+		w.err = pw.err
+	}
+	w.varint(uint32(len(pw.b)))
+	w.b = append(w.b, pw.b...)
+}
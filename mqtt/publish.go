@@ -0,0 +1,115 @@
+package mqtt
+
+import (
+	"fmt"
+)
+
+// Publish is the PUBLISH packet
+type Publish struct {
+	Dup    bool
+	QoS    byte
+	Retain bool
+	Topic  []byte
+
+	// PacketID is only present with QoS 1 and 2
+	PacketID   uint16
+	Properties Properties
+	Payload    []byte
+}
+
+func (p *Publish) Type() Type {
+	return PUBLISH
+}
+
+func (p *Publish) decode(r *reader, flags byte, v Version) error {
+	p.Dup = flags&0x08 != 0
+	p.QoS = (flags >> 1) & 0x03
+	p.Retain = flags&0x01 != 0
+	if p.QoS > 2 || (p.QoS == 0 && p.Dup) {
+		return fmt.Errorf("mqtt/Publish.decode: fixed header flags 0x%X: %w", flags, ErrMalformedPacket)
+	}
+
+	p.Topic = r.utf8()
+	if p.QoS > 0 {
+		p.PacketID = r.uint16()
+		if r.err == nil && p.PacketID == 0 {
+			return fmt.Errorf("mqtt/Publish.decode: packet identifier of 0: %w", ErrMalformedPacket)
+		}
+	}
+	if v >= V5 {
+		if err := p.Properties.decode(r); err != nil {
+			return err
+		}
+	}
+
+	p.Payload = r.b
+	r.b = nil
+	return nil
+}
+
+func (p *Publish) encode(w *writer, v Version) (byte, error) {
+	if p.QoS > 2 {
+		return 0, fmt.Errorf("mqtt/Publish.encode: QoS %d: %w", p.QoS, ErrMalformedPacket)
+	}
+
+	w.binary(p.Topic)
+	if p.QoS > 0 {
+		w.uint16(p.PacketID)
+	}
+	if v >= V5 {
+		p.Properties.encode(w)
+	}
+	w.b = append(w.b, p.Payload...)
+
+	flags := p.QoS << 1
+	if p.Dup {
+		flags |= 0x08
+	}
+	if p.Retain {
+		flags |= 0x01
+	}
+	return flags, nil
+}
+
+// Puback is the PUBACK packet
+type Puback struct {
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (p *Puback) Type() Type {
+	return PUBACK
+}
+
+func (p *Puback) decode(r *reader, flags byte, v Version) error {
+	if flags != 0 {
+		return fmt.Errorf("mqtt/Puback.decode: fixed header flags 0x%X: %w", flags, ErrMalformedPacket)
+	}
+
+	p.PacketID = r.uint16()
+	if v < V5 || r.len() == 0 {
+		return nil
+	}
+	p.ReasonCode = ReasonCode(r.byte())
+	if r.len() == 0 {
+		return nil
+	}
+	return p.Properties.decode(r)
+}
+
+func (p *Puback) encode(w *writer, v Version) (byte, error) {
+	w.uint16(p.PacketID)
+	if v < V5 {
+		return 0, nil
+	}
+
+	pw := &writer{}
+	p.Properties.encode(pw)
+	if p.ReasonCode == Success && len(pw.b) == 1 {
+		return 0, pw.err
+	}
+	w.byte(byte(p.ReasonCode))
+	w.b = append(w.b, pw.b...)
+	return 0, pw.err
+}
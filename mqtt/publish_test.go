@@ -0,0 +1,54 @@
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestPublishRoundTrip(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	expiry := uint32(60)
+	publishes := []*Publish{
+		{Topic: []byte("sport/tennis"), Payload: []byte("15-0")},
+		{Dup: true, QoS: 1, Retain: true, Topic: []byte("sport/golf"), PacketID: 3, Payload: []byte{}},
+		{QoS: 2, Topic: []byte("a"), PacketID: 4, Properties: Properties{MessageExpiryInterval: &expiry, CorrelationData: []byte{1, 2}}, Payload: []byte("x")},
+	}
+
+	for _, v := range []Version{V311, V5} {
+		for _, pub := range publishes {
+			if v < V5 && pub.Properties.MessageExpiryInterval != nil {
+				continue
+			}
+			b, err := EncodePacket(pub, v)
+			require.NoError(t, err)
+
+			p, err := ReadPacket(bytes.NewReader(b), v)
+			require.NoError(t, err)
+			require.Equal(t, pub, p)
+		}
+	}
+
+	require.Error(t, DecodePacket(&Publish{}, 0x06, []byte{0x00, 0x01, 'a', 0x00, 0x01}, V311))
+	require.Error(t, DecodePacket(&Publish{}, 0x08, []byte{0x00, 0x01, 'a'}, V311))
+	require.Error(t, DecodePacket(&Publish{}, 0x02, []byte{0x00, 0x01, 'a', 0x00, 0x00}, V311))
+}
+
+func TestPubackShortForm(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	b, err := EncodePacket(&Puback{PacketID: 5}, V5)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x40, 0x02, 0x00, 0x05}, b)
+
+	b, err = EncodePacket(&Puback{PacketID: 5, ReasonCode: NoMatchingSubscribers}, V5)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x40, 0x04, 0x00, 0x05, 0x10, 0x00}, b)
+
+	p, err := ReadPacket(bytes.NewReader(b), V5)
+	require.NoError(t, err)
+	require.Equal(t, &Puback{PacketID: 5, ReasonCode: NoMatchingSubscribers}, p)
+}
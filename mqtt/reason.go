@@ -0,0 +1,133 @@
+package mqtt
+
+import (
+	"fmt"
+)
+
+// ReasonCode is the result of an operation reported in acknowledgement
+// packets. MQTT 3.1.1 SUBACK only knows the granted QoS values and Failure,
+// and CONNACK return codes are mapped to and from their MQTT 5.0 equivalent.
+type ReasonCode byte
+
+const (
+	Success                             ReasonCode = 0x00
+	NormalDisconnection                 ReasonCode = 0x00
+	GrantedQoS0                         ReasonCode = 0x00
+	GrantedQoS1                         ReasonCode = 0x01
+	GrantedQoS2                         ReasonCode = 0x02
+	DisconnectWithWill                  ReasonCode = 0x04
+	NoMatchingSubscribers               ReasonCode = 0x10
+	NoSubscriptionExisted               ReasonCode = 0x11
+	UnspecifiedError                    ReasonCode = 0x80
+	MalformedPacket                     ReasonCode = 0x81
+	ProtocolError                       ReasonCode = 0x82
+	ImplementationSpecificError         ReasonCode = 0x83
+	UnsupportedProtocolVersion          ReasonCode = 0x84
+	ClientIdentifierNotValid            ReasonCode = 0x85
+	BadUserNameOrPassword               ReasonCode = 0x86
+	NotAuthorized                       ReasonCode = 0x87
+	ServerUnavailable                   ReasonCode = 0x88
+	ServerBusy                          ReasonCode = 0x89
+	ServerShuttingDown                  ReasonCode = 0x8B
+	BadAuthenticationMethod             ReasonCode = 0x8C
+	KeepAliveTimeout                    ReasonCode = 0x8D
+	SessionTakenOver                    ReasonCode = 0x8E
+	TopicFilterInvalid                  ReasonCode = 0x8F
+	TopicNameInvalid                    ReasonCode = 0x90
+	PacketIdentifierInUse               ReasonCode = 0x91
+	ReceiveMaximumExceeded              ReasonCode = 0x93
+	TopicAliasInvalid                   ReasonCode = 0x94
+	PacketTooLarge                      ReasonCode = 0x95
+	QuotaExceeded                       ReasonCode = 0x97
+	PayloadFormatInvalid                ReasonCode = 0x99
+	RetainNotSupported                  ReasonCode = 0x9A
+	QoSNotSupported                     ReasonCode = 0x9B
+	SharedSubscriptionsNotSupported     ReasonCode = 0x9E
+	SubscriptionIdentifiersNotSupported ReasonCode = 0xA1
+	WildcardSubscriptionsNotSupported   ReasonCode = 0xA2
+
+	// Failure is the MQTT 3.1.1 SUBACK return code of a refused subscription
+	Failure ReasonCode = 0x80
+)
+
+var reasonNames = map[ReasonCode]string{
+	Success:                             "Success",
+	GrantedQoS1:                         "Granted QoS 1",
+	GrantedQoS2:                         "Granted QoS 2",
+	DisconnectWithWill:                  "Disconnect with Will Message",
+	NoMatchingSubscribers:               "No matching subscribers",
+	NoSubscriptionExisted:               "No subscription existed",
+	UnspecifiedError:                    "Unspecified error",
+	MalformedPacket:                     "Malformed Packet",
+	ProtocolError:                       "Protocol Error",
+	ImplementationSpecificError:         "Implementation specific error",
+	UnsupportedProtocolVersion:          "Unsupported Protocol Version",
+	ClientIdentifierNotValid:            "Client Identifier not valid",
+	BadUserNameOrPassword:               "Bad User Name or Password",
+	NotAuthorized:                       "Not authorized",
+	ServerUnavailable:                   "Server unavailable",
+	ServerBusy:                          "Server busy",
+	ServerShuttingDown:                  "Server shutting down",
+	BadAuthenticationMethod:             "Bad authentication method",
+	KeepAliveTimeout:                    "Keep Alive timeout",
+	SessionTakenOver:                    "Session taken over",
+	TopicFilterInvalid:                  "Topic Filter invalid",
+	TopicNameInvalid:                    "Topic Name invalid",
+	PacketIdentifierInUse:               "Packet Identifier in use",
+	ReceiveMaximumExceeded:              "Receive Maximum exceeded",
+	TopicAliasInvalid:                   "Topic Alias invalid",
+	PacketTooLarge:                      "Packet too large",
+	QuotaExceeded:                       "Quota exceeded",
+	PayloadFormatInvalid:                "Payload format invalid",
+	RetainNotSupported:                  "Retain not supported",
+	QoSNotSupported:                     "QoS not supported",
+	SharedSubscriptionsNotSupported:     "Shared Subscriptions not supported",
+	SubscriptionIdentifiersNotSupported: "Subscription Identifiers not supported",
+	WildcardSubscriptionsNotSupported:   "Wildcard Subscriptions not supported",
+}
+
+func (rc ReasonCode) String() string {
+	if s, ok := reasonNames[rc]; ok {
+		return s
+	}
+	return fmt.Sprintf("ReasonCode(0x%02X)", byte(rc))
+}
+
+// IsError reports whether the reason code signals a failure
+func (rc ReasonCode) IsError() bool {
+	return rc >= 0x80
+}
+
+// connackV311 maps a reason code to the MQTT 3.1.1 CONNACK return code
+func connackV311(rc ReasonCode) byte {
+	switch rc {
+	case Success:
+		return 0
+	case UnsupportedProtocolVersion:
+		return 1
+	case ClientIdentifierNotValid:
+		return 2
+	case BadUserNameOrPassword:
+		return 4
+	case NotAuthorized:
+		return 5
+	}
+	return 3
+}
+
+// connackV5 maps an MQTT 3.1.1 CONNACK return code to its reason code
+func connackV5(c byte) ReasonCode {
+	switch c {
+	case 0:
+		return Success
+	case 1:
+		return UnsupportedProtocolVersion
+	case 2:
+		return ClientIdentifierNotValid
+	case 4:
+		return BadUserNameOrPassword
+	case 5:
+		return NotAuthorized
+	}
+	return ServerUnavailable
+}
@@ -0,0 +1,180 @@
+package mqtt
+
+import (
+	"fmt"
+)
+
+// SubscriptionOptions are the options byte following each topic filter of a
+// SUBSCRIBE packet. Only QoS exists in MQTT 3.1.1.
+type SubscriptionOptions struct {
+	// QoS is the maximum QoS the server may use to deliver messages
+	QoS byte
+
+	// NoLocal asks not to receive messages published by the same connection
+	NoLocal bool
+
+	// RetainAsPublished keeps the RETAIN flag of forwarded messages
+	RetainAsPublished bool
+
+	// RetainHandling selects when retained messages are sent: 0 at subscribe,
+	// 1 at subscribe only if the subscription is new, 2 never
+	RetainHandling byte
+}
+
+func (o *SubscriptionOptions) decode(c byte, v Version) error {
+	o.QoS = c & 0x03
+	if o.QoS > 2 {
+		return fmt.Errorf("mqtt/SubscriptionOptions.decode: QoS %d: %w", o.QoS, ErrMalformedPacket)
+	}
+
+	if v < V5 {
+		if c&0xfc != 0 {
+			return fmt.Errorf("mqtt/SubscriptionOptions.decode: reserved bits set: %w", ErrMalformedPacket)
+		}
+		return nil
+	}
+
+	o.NoLocal = c&0x04 != 0
+	o.RetainAsPublished = c&0x08 != 0
+	o.RetainHandling = (c >> 4) & 0x03
+	if o.RetainHandling > 2 {
+		return fmt.Errorf("mqtt/SubscriptionOptions.decode: retain handling %d: %w", o.RetainHandling, ErrProtocolError)
+	}
+	if c&0xc0 != 0 {
+		return fmt.Errorf("mqtt/SubscriptionOptions.decode: reserved bits set: %w", ErrMalformedPacket)
+	}
+	return nil
+}
+
+func (o *SubscriptionOptions) encode(v Version) byte {
+	c := o.QoS & 0x03
+	if v < V5 {
+		return c
+	}
+	if o.NoLocal {
+		c |= 0x04
+	}
+	if o.RetainAsPublished {
+		c |= 0x08
+	}
+	return c | (o.RetainHandling&0x03)<<4
+}
+
+// MarshalBinary encodes the options as the MQTT 5.0 options byte, to be kept
+// along with a subscription
+func (o SubscriptionOptions) MarshalBinary() ([]byte, error) {
+	return []byte{o.encode(V5)}, nil
+}
+
+// UnmarshalBinary decodes options encoded by MarshalBinary
+func (o *SubscriptionOptions) UnmarshalBinary(data []byte) error {
+	if len(data) != 1 {
+		return fmt.Errorf("mqtt/SubscriptionOptions.UnmarshalBinary: %d bytes: %w", len(data), ErrMalformedPacket)
+	}
+	*o = SubscriptionOptions{}
+	return o.decode(data[0], V5)
+}
+
+// Subscription is one topic filter of a SUBSCRIBE packet
+type Subscription struct {
+	// Filter is the topic filter as sent on the wire, '$share/' prefix included
+	Filter []byte
+
+	Options SubscriptionOptions
+}
+
+// Subscribe is the SUBSCRIBE packet
+type Subscribe struct {
+	PacketID      uint16
+	Properties    Properties
+	Subscriptions []Subscription
+}
+
+func (p *Subscribe) Type() Type {
+	return SUBSCRIBE
+}
+
+func (p *Subscribe) decode(r *reader, flags byte, v Version) error {
+	if flags != 0x02 {
+		return fmt.Errorf("mqtt/Subscribe.decode: fixed header flags 0x%X: %w", flags, ErrMalformedPacket)
+	}
+
+	p.PacketID = r.uint16()
+	if r.err == nil && p.PacketID == 0 {
+		return fmt.Errorf("mqtt/Subscribe.decode: packet identifier of 0: %w", ErrMalformedPacket)
+	}
+	if v >= V5 {
+		if err := p.Properties.decode(r); err != nil {
+			return err
+		}
+	}
+
+	for r.len() > 0 && r.err == nil {
+		var s Subscription
+		s.Filter = r.utf8()
+		if err := s.Options.decode(r.byte(), v); err != nil && r.err == nil {
+			return err
+		}
+		p.Subscriptions = append(p.Subscriptions, s)
+	}
+
+	if r.err == nil && len(p.Subscriptions) == 0 {
+		return fmt.Errorf("mqtt/Subscribe.decode: no topic filter: %w", ErrProtocolError)
+	}
+	return nil
+}
+
+func (p *Subscribe) encode(w *writer, v Version) (byte, error) {
+	if len(p.Subscriptions) == 0 {
+		return 0, fmt.Errorf("mqtt/Subscribe.encode: no topic filter: %w", ErrProtocolError)
+	}
+
+	w.uint16(p.PacketID)
+	if v >= V5 {
+		p.Properties.encode(w)
+	}
+	for i := range p.Subscriptions {
+		w.binary(p.Subscriptions[i].Filter)
+		w.byte(p.Subscriptions[i].Options.encode(v))
+	}
+	return 0x02, nil
+}
+
+// Suback is the SUBACK packet, holding one reason code per subscription
+type Suback struct {
+	PacketID    uint16
+	Properties  Properties
+	ReasonCodes []ReasonCode
+}
+
+func (p *Suback) Type() Type {
+	return SUBACK
+}
+
+func (p *Suback) decode(r *reader, flags byte, v Version) error {
+	if flags != 0 {
+		return fmt.Errorf("mqtt/Suback.decode: fixed header flags 0x%X: %w", flags, ErrMalformedPacket)
+	}
+
+	p.PacketID = r.uint16()
+	if v >= V5 {
+		if err := p.Properties.decode(r); err != nil {
+			return err
+		}
+	}
+	for r.len() > 0 && r.err == nil {
+		p.ReasonCodes = append(p.ReasonCodes, ReasonCode(r.byte()))
+	}
+	return nil
+}
+
+func (p *Suback) encode(w *writer, v Version) (byte, error) {
+	w.uint16(p.PacketID)
+	if v >= V5 {
+		p.Properties.encode(w)
+	}
+	for _, rc := range p.ReasonCodes {
+		w.byte(byte(rc))
+	}
+	return 0, nil
+}
@@ -0,0 +1,143 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestSubscribeDecodeV311(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	raw := []byte{
+		0x82, 0x10, // SUBSCRIBE, remaining length 16
+		0x00, 0x0a, // packet identifier 10
+		0x00, 0x05, 's', 'p', 'o', 'r', 't', 0x01, // "sport" QoS 1
+		0x00, 0x04, 'a', '/', '+', '/', 0x02, // "a/+/" QoS 2
+	}
+	raw[1] = byte(len(raw) - 2)
+
+	p, err := ReadPacket(bytes.NewReader(raw), V311)
+	require.NoError(t, err)
+
+	sub, ok := p.(*Subscribe)
+	require.True(t, ok)
+	require.Equal(t, uint16(10), sub.PacketID)
+	require.Equal(t, 2, len(sub.Subscriptions))
+	require.Equal(t, []byte("sport"), sub.Subscriptions[0].Filter)
+	require.Equal(t, byte(1), sub.Subscriptions[0].Options.QoS)
+	require.Equal(t, []byte("a/+/"), sub.Subscriptions[1].Filter)
+	require.Equal(t, byte(2), sub.Subscriptions[1].Options.QoS)
+
+	b, err := EncodePacket(sub, V311)
+	require.NoError(t, err)
+	require.Equal(t, raw, b)
+}
+
+func TestSubscribeRoundTripV5(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	sub := &Subscribe{
+		PacketID: 7,
+		Properties: Properties{
+			SubscriptionIdentifier: 268435455,
+			UserProperties:         []UserProperty{{Key: "region", Value: "eu"}},
+		},
+		Subscriptions: []Subscription{
+			{Filter: []byte("$share/g1/sport/#"), Options: SubscriptionOptions{QoS: 1, RetainHandling: 2}},
+			{Filter: []byte("sport/tennis/+"), Options: SubscriptionOptions{QoS: 0, NoLocal: true, RetainAsPublished: true}},
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WritePacket(&buf, sub, V5))
+
+	p, err := ReadPacket(&buf, V5)
+	require.NoError(t, err)
+	require.Equal(t, sub, p)
+	require.Equal(t, 0, buf.Len())
+}
+
+func TestSubscribeDecodeFailure(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	bodies := []struct {
+		flags byte
+		body  []byte
+		v     Version
+	}{
+		{0x00, []byte{0x00, 0x01, 0x00, 0x01, 'a', 0x00}, V311},                 // wrong fixed header flags
+		{0x02, []byte{0x00, 0x00, 0x00, 0x01, 'a', 0x00}, V311},                 // packet identifier 0
+		{0x02, []byte{0x00, 0x01}, V311},                                        // no topic filter
+		{0x02, []byte{0x00, 0x01, 0x00, 0x01, 'a', 0x03}, V311},                 // QoS 3
+		{0x02, []byte{0x00, 0x01, 0x00, 0x01, 'a', 0x04}, V311},                 // reserved bit in 3.1.1
+		{0x02, []byte{0x00, 0x01, 0x00, 0x01, 'a', 0x30}, V5},                   // retain handling 3
+		{0x02, []byte{0x00, 0x01, 0x09, 0x00, 0x01, 'a', 0x00}, V5},             // property length out of range
+		{0x02, []byte{0x00, 0x01, 0x02, 0x0b, 0x00, 0x00, 0x01, 'a', 0x00}, V5}, // subscription identifier 0
+		{0x02, []byte{0x00, 0x01, 0x01, 0x7f, 0x00, 0x01, 'a', 0x00}, V5},       // unknown property
+		{0x02, []byte{0x00, 0x01, 0x00, 0x05, 'a', 0x00}, V311},                 // filter out of range
+		{0x02, []byte{0x00, 0x01, 0x00, 0x02, 0xc3, 0x28, 0x00}, V311},          // invalid UTF-8
+		{0x02, []byte{0x00, 0x01, 0x00, 0x01, 0x00, 0x00}, V311},                // null character
+		{0x02, []byte{0x00, 0x01, 0x00, 0x01, 'a'}, V311},                       // missing options
+	}
+
+	for i, b := range bodies {
+		err := DecodePacket(&Subscribe{}, b.flags, b.body, b.v)
+		require.Error(t, err, "case %d", i)
+	}
+}
+
+func TestSubackRoundTrip(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ack := &Suback{
+		PacketID:    3,
+		Properties:  Properties{ReasonString: "bad filter"},
+		ReasonCodes: []ReasonCode{GrantedQoS1, TopicFilterInvalid},
+	}
+
+	b, err := EncodePacket(ack, V5)
+	require.NoError(t, err)
+
+	p, err := ReadPacket(bytes.NewReader(b), V5)
+	require.NoError(t, err)
+	require.Equal(t, ack, p)
+
+	b, err = EncodePacket(ack, V311)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x90, 0x04, 0x00, 0x03, 0x01, 0x8f}, b)
+}
+
+func TestReadPacketUnsupported(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	r := bytes.NewReader([]byte{0xf0, 0x01, 0x00, 0xc0, 0x00})
+
+	_, err := ReadPacket(r, V5)
+	require.Error(t, err)
+	require.Equal(t, 2, r.Len())
+
+	_, err = ReadPacket(bytes.NewReader([]byte{0x82, 0xff, 0xff, 0xff, 0xff}), V5)
+	require.Error(t, err)
+
+	// A length of 256 MB is not allocated before the body is received
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = ReadPacket(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0x7f, 0x00, 0x01, 'a'}), V5)
+	runtime.ReadMemStats(&after)
+	require.True(t, errors.Is(err, io.ErrUnexpectedEOF), "%v", err)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	// and a long body is read as it arrives
+	pub := &Publish{Topic: []byte("a"), Payload: bytes.Repeat([]byte{1}, 3*bodyChunk)}
+	b, err := EncodePacket(pub, V311)
+	require.NoError(t, err)
+	p, err := ReadPacket(bytes.NewReader(b), V311)
+	require.NoError(t, err)
+	require.Equal(t, pub.Payload, p.(*Publish).Payload)
+}
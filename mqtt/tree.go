@@ -0,0 +1,131 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/TheSmallBoat/cabinet"
+)
+
+// ErrInvalidFilter is returned for topic filters the tree cannot accept
+var ErrInvalidFilter = errors.New("invalid topic filter")
+
+// Shared is linked to the topic tree in place of the entity of a shared
+// subscription, so that '$share/a/x' and '$share/b/x' remain distinct links of
+// the same entity. The entity must be comparable to be unlinked, as the tree
+// finds no entity equal to one which is not.
+type Shared struct {
+	Group  string
+	Entity interface{}
+}
+
+// Link links entity to the topic filter of every subscription in the packet
+// and returns the SUBACK answering it
+func (p *Subscribe) Link(tr *cabinet.TTree, entity interface{}, v Version) *Suback {
+	ack := &Suback{PacketID: p.PacketID, ReasonCodes: make([]ReasonCode, len(p.Subscriptions))}
+	for i := range p.Subscriptions {
+		s := &p.Subscriptions[i]
+		ack.ReasonCodes[i] = SubackCode(EntityLink(tr, s.Filter, entity), s.Options.QoS, v)
+	}
+	return ack
+}
+
+// UnLink unlinks entity from every topic filter of the packet and returns the
+// UNSUBACK answering it
+func (p *Unsubscribe) UnLink(tr *cabinet.TTree, entity interface{}, v Version) *Unsuback {
+	ack := &Unsuback{PacketID: p.PacketID, ReasonCodes: make([]ReasonCode, len(p.Filters))}
+	for i, f := range p.Filters {
+		ack.ReasonCodes[i] = UnsubackCode(EntityUnLink(tr, f, entity), v)
+	}
+	return ack
+}
+
+// EntityLink links entity to a topic filter as sent on the wire. A '$share/'
+// prefix is stripped, and the entity is wrapped in Shared.
+func EntityLink(tr *cabinet.TTree, filter []byte, entity interface{}) error {
+	topic, entity, err := splitFilter(filter, entity)
+	if err != nil {
+		return err
+	}
+	return tr.EntityLink(topic, entity)
+}
+
+// EntityUnLink reverts EntityLink
+func EntityUnLink(tr *cabinet.TTree, filter []byte, entity interface{}) error {
+	topic, entity, err := splitFilter(filter, entity)
+	if err != nil {
+		return err
+	}
+	return tr.EntityUnLink(topic, entity)
+}
+
+// Linker returns a cabinet.Linker linking the topic filters as sent on the
+// wire with EntityLink and EntityUnLink
+func Linker(tr *cabinet.TTree) cabinet.Linker {
+	return wireLinker{tr}
+}
+
+type wireLinker struct {
+	tr *cabinet.TTree
+}
+
+func (l wireLinker) EntityLink(filter []byte, entity interface{}) error {
+	return EntityLink(l.tr, filter, entity)
+}
+
+func (l wireLinker) EntityUnLink(filter []byte, entity interface{}) error {
+	return EntityUnLink(l.tr, filter, entity)
+}
+
+func splitFilter(filter []byte, entity interface{}) ([]byte, interface{}, error) {
+	group, topic, shared, err := cabinet.ShareGroup(filter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("mqtt/splitFilter: %s: %w", err, ErrInvalidFilter)
+	}
+	if len(topic) == 0 {
+		return nil, nil, fmt.Errorf("mqtt/splitFilter: empty topic filter: %w", ErrInvalidFilter)
+	}
+	if shared {
+		entity = Shared{Group: string(group), Entity: entity}
+	}
+	return topic, entity, nil
+}
+
+// SubackCode returns the SUBACK reason code for the error of linking a
+// subscription that requested qos: TopicFilterInvalid for invalid filters,
+// QuotaExceeded for the limits of the tree, and UnspecifiedError otherwise
+func SubackCode(err error, qos byte, v Version) ReasonCode {
+	switch {
+	case err == nil:
+		return ReasonCode(qos)
+	case v < V5:
+		return Failure
+	case errors.Is(err, cabinet.ErrLimitExceeded):
+		return QuotaExceeded
+	case filterInvalid(err):
+		return TopicFilterInvalid
+	default:
+		return UnspecifiedError
+	}
+}
+
+// filterInvalid reports whether err is the error of an invalid topic filter
+func filterInvalid(err error) bool {
+	var terr *cabinet.TopicError
+	return errors.Is(err, ErrInvalidFilter) || errors.As(err, &terr)
+}
+
+// UnsubackCode returns the UNSUBACK reason code for the error of unlinking a
+// topic filter
+func UnsubackCode(err error, v Version) ReasonCode {
+	switch {
+	case err == nil:
+		return Success
+	case errors.Is(err, cabinet.ErrNotLinked):
+		return NoSubscriptionExisted
+	case v >= V5 && filterInvalid(err):
+		return TopicFilterInvalid
+	default:
+		return UnspecifiedError
+	}
+}
@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/TheSmallBoat/cabinet"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestSubscribeLink(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	sub := &Subscribe{
+		PacketID: 1,
+		Subscriptions: []Subscription{
+			{Filter: []byte("sport/tennis/+"), Options: SubscriptionOptions{QoS: 1}},
+			{Filter: []byte("$share/g1/sport/#"), Options: SubscriptionOptions{QoS: 2}},
+			{Filter: []byte("sport/tennis#"), Options: SubscriptionOptions{QoS: 0}},
+			{Filter: []byte("$share/+/sport"), Options: SubscriptionOptions{QoS: 0}},
+			{Filter: []byte(""), Options: SubscriptionOptions{QoS: 0}},
+		},
+	}
+
+	ack := sub.Link(tt, "ent1", V5)
+	require.Equal(t, uint16(1), ack.PacketID)
+	require.Equal(t, []ReasonCode{GrantedQoS1, GrantedQoS2, TopicFilterInvalid, TopicFilterInvalid, TopicFilterInvalid}, ack.ReasonCodes)
+
+	ack = sub.Link(tt, "ent2", V311)
+	require.Equal(t, []ReasonCode{GrantedQoS1, GrantedQoS2, Failure, Failure, Failure}, ack.ReasonCodes)
+
+	entities := make([]interface{}, 0, 5)
+	require.NoError(t, tt.LinkedEntities([]byte("sport/tennis/tom"), &entities))
+	require.ElementsMatch(t, []interface{}{
+		"ent1", "ent2",
+		Shared{Group: "g1", Entity: "ent1"}, Shared{Group: "g1", Entity: "ent2"},
+	}, entities)
+
+	unsub := &Unsubscribe{
+		PacketID: 2,
+		Filters:  [][]byte{[]byte("sport/tennis/+"), []byte("$share/g1/sport/#"), []byte("sport/+"), []byte("sport/#/x")},
+	}
+
+	uack := unsub.UnLink(tt, "ent1", V5)
+	require.Equal(t, uint16(2), uack.PacketID)
+	require.Equal(t, []ReasonCode{Success, Success, NoSubscriptionExisted, TopicFilterInvalid}, uack.ReasonCodes)
+
+	uack = unsub.UnLink(tt, "ent1", V5)
+	require.Equal(t, []ReasonCode{NoSubscriptionExisted, NoSubscriptionExisted, NoSubscriptionExisted, TopicFilterInvalid}, uack.ReasonCodes)
+
+	unsub.UnLink(tt, "ent2", V311)
+	require.NoError(t, tt.LinkedEntities([]byte("sport/tennis/tom"), &entities))
+	require.Equal(t, 0, len(entities))
+}
+
+func TestSharedNotComparable(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := cabinet.NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	// Entities which are not comparable are linked without panicking, but
+	// cannot be unlinked
+	for _, entity := range []interface{}{[]int{1}, []int{1}, map[string]int{}} {
+		require.NoError(t, EntityLink(tt, []byte("$share/g/sport/#"), entity))
+	}
+	entities := make([]interface{}, 0, 3)
+	require.NoError(t, tt.LinkedEntities([]byte("sport/tennis"), &entities))
+	require.Len(t, entities, 3)
+	require.True(t, errors.Is(EntityUnLink(tt, []byte("$share/g/sport/#"), []int{1}), cabinet.ErrNotLinked))
+}
+
+func TestAckCodes(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	limit := cabinet.NewTopicTree(cabinet.WithLimits(cabinet.Limits{MaxLinksPerEntity: 1}))
+	require.NoError(t, limit.EntityLink([]byte("a"), "x"))
+	limited := limit.EntityLink([]byte("b"), "x")
+	require.NoError(t, limit.Close())
+
+	invalid := cabinet.ValidateFilter([]byte("sport/#/x"))
+	_, _, split := splitFilter([]byte("$share/+/sport"), "x")
+	other := errors.New("session not saved")
+
+	for _, tc := range []struct {
+		err          error
+		v5, v311     ReasonCode
+		unsub, un311 ReasonCode
+	}{
+		{nil, GrantedQoS1, GrantedQoS1, Success, Success},
+		{limited, QuotaExceeded, Failure, UnspecifiedError, UnspecifiedError},
+		{invalid, TopicFilterInvalid, Failure, TopicFilterInvalid, UnspecifiedError},
+		{fmt.Errorf("wrapped: %w", invalid), TopicFilterInvalid, Failure, TopicFilterInvalid, UnspecifiedError},
+		{split, TopicFilterInvalid, Failure, TopicFilterInvalid, UnspecifiedError},
+		{other, UnspecifiedError, Failure, UnspecifiedError, UnspecifiedError},
+		{cabinet.ErrNotLinked, UnspecifiedError, Failure, NoSubscriptionExisted, NoSubscriptionExisted},
+	} {
+		require.Equal(t, tc.v5, SubackCode(tc.err, 1, V5), "%v", tc.err)
+		require.Equal(t, tc.v311, SubackCode(tc.err, 1, V311), "%v", tc.err)
+		require.Equal(t, tc.unsub, UnsubackCode(tc.err, V5), "%v", tc.err)
+		require.Equal(t, tc.un311, UnsubackCode(tc.err, V311), "%v", tc.err)
+	}
+}
@@ -0,0 +1,100 @@
+package mqtt
+
+import (
+	"fmt"
+)
+
+// Unsubscribe is the UNSUBSCRIBE packet
+type Unsubscribe struct {
+	PacketID   uint16
+	Properties Properties
+
+	// Filters as sent on the wire, '$share/' prefix included
+	Filters [][]byte
+}
+
+func (p *Unsubscribe) Type() Type {
+	return UNSUBSCRIBE
+}
+
+func (p *Unsubscribe) decode(r *reader, flags byte, v Version) error {
+	if flags != 0x02 {
+		return fmt.Errorf("mqtt/Unsubscribe.decode: fixed header flags 0x%X: %w", flags, ErrMalformedPacket)
+	}
+
+	p.PacketID = r.uint16()
+	if r.err == nil && p.PacketID == 0 {
+		return fmt.Errorf("mqtt/Unsubscribe.decode: packet identifier of 0: %w", ErrMalformedPacket)
+	}
+	if v >= V5 {
+		if err := p.Properties.decode(r); err != nil {
+			return err
+		}
+	}
+
+	for r.len() > 0 && r.err == nil {
+		p.Filters = append(p.Filters, r.utf8())
+	}
+
+	if r.err == nil && len(p.Filters) == 0 {
+		return fmt.Errorf("mqtt/Unsubscribe.decode: no topic filter: %w", ErrProtocolError)
+	}
+	return nil
+}
+
+func (p *Unsubscribe) encode(w *writer, v Version) (byte, error) {
+	if len(p.Filters) == 0 {
+		return 0, fmt.Errorf("mqtt/Unsubscribe.encode: no topic filter: %w", ErrProtocolError)
+	}
+
+	w.uint16(p.PacketID)
+	if v >= V5 {
+		p.Properties.encode(w)
+	}
+	for _, f := range p.Filters {
+		w.binary(f)
+	}
+	return 0x02, nil
+}
+
+// Unsuback is the UNSUBACK packet. MQTT 3.1.1 carries neither properties nor
+// reason codes, so both are dropped when encoding with V311.
+type Unsuback struct {
+	PacketID    uint16
+	Properties  Properties
+	ReasonCodes []ReasonCode
+}
+
+func (p *Unsuback) Type() Type {
+	return UNSUBACK
+}
+
+func (p *Unsuback) decode(r *reader, flags byte, v Version) error {
+	if flags != 0 {
+		return fmt.Errorf("mqtt/Unsuback.decode: fixed header flags 0x%X: %w", flags, ErrMalformedPacket)
+	}
+
+	p.PacketID = r.uint16()
+	if v < V5 {
+		return nil
+	}
+	if err := p.Properties.decode(r); err != nil {
+		return err
+	}
+	for r.len() > 0 && r.err == nil {
+		p.ReasonCodes = append(p.ReasonCodes, ReasonCode(r.byte()))
+	}
+	return nil
+}
+
+func (p *Unsuback) encode(w *writer, v Version) (byte, error) {
+	w.uint16(p.PacketID)
+	if v < V5 {
+		return 0, nil
+	}
+	p.Properties.encode(w)
+	for _, rc := range p.ReasonCodes {
+		w.byte(byte(rc))
+	}
+	return 0, nil
+}
@@ -0,0 +1,49 @@
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestUnsubscribeRoundTrip(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	unsub := &Unsubscribe{
+		PacketID: 9,
+		Filters:  [][]byte{[]byte("sport/#"), []byte("$share/g/+/x")},
+	}
+
+	for _, v := range []Version{V311, V5} {
+		b, err := EncodePacket(unsub, v)
+		require.NoError(t, err)
+		require.Equal(t, byte(0xa2), b[0])
+
+		p, err := ReadPacket(bytes.NewReader(b), v)
+		require.NoError(t, err)
+		require.Equal(t, unsub, p)
+	}
+
+	require.Error(t, DecodePacket(&Unsubscribe{}, 0x02, []byte{0x00, 0x01}, V311))
+	require.Error(t, DecodePacket(&Unsubscribe{}, 0x00, []byte{0x00, 0x01, 0x00, 0x01, 'a'}, V311))
+}
+
+func TestUnsubackEncode(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ack := &Unsuback{PacketID: 9, ReasonCodes: []ReasonCode{Success, NoSubscriptionExisted}}
+
+	b, err := EncodePacket(ack, V311)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xb0, 0x02, 0x00, 0x09}, b)
+
+	b, err = EncodePacket(ack, V5)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xb0, 0x05, 0x00, 0x09, 0x00, 0x00, 0x11}, b)
+
+	p, err := ReadPacket(bytes.NewReader(b), V5)
+	require.NoError(t, err)
+	require.Equal(t, ack, p)
+}
@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package cabinet
+
+// raceEnabled is set when testing with the race detector, under which
+// sync.Pool drops items at random and allocation counts are meaningless
+const raceEnabled = true
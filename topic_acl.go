@@ -0,0 +1,264 @@
+package cabinet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidRule is returned when adding an ACL rule with an invalid filter or
+// no access
+var ErrInvalidRule = errors.New("invalid ACL rule")
+
+// Access is a set of operations on topics
+type Access byte
+
+const (
+	// AccessPublish allows publishing to the topics matched by a filter
+	AccessPublish Access = 1 << iota
+
+	// AccessSubscribe allows subscribing to filters covered by a filter
+	AccessSubscribe
+
+	// AccessAll is both AccessPublish and AccessSubscribe
+	AccessAll = AccessPublish | AccessSubscribe
+)
+
+// ACL placeholders, expanded in the filter of a rule for each request
+const (
+	PlaceholderUsername = "%u"
+	PlaceholderClientID = "%c"
+)
+
+// Principal is who a request is made for
+type Principal struct {
+	Username string
+	ClientID string
+}
+
+// ACLRule allows or denies some access to the topics matched by a filter
+type ACLRule struct {
+	// Username is the principal the rule applies to, every one when empty
+	Username string
+
+	// Filter may contain the placeholders %u and %c, replaced by the username
+	// and the client identifier of the principal
+	Filter []byte
+
+	Access Access
+	Deny   bool
+}
+
+// key identifies the rule for Remove
+func (r *ACLRule) key() string {
+	return fmt.Sprintf("%q %q %d %t", r.Username, r.Filter, r.Access, r.Deny)
+}
+
+// applies reports whether the rule grants or revokes access for p
+func (r *ACLRule) applies(p Principal, access Access) bool {
+	return r.Access&access != 0 && (r.Username == "" || r.Username == p.Username)
+}
+
+// ACL authorizes publishing and subscribing to MQTT topics. Nothing is allowed
+// unless a rule allows it, and a deny rule overrides any allow rule: a topic
+// is published to when an allow rule matches it and no deny rule does, and a
+// filter is subscribed to when an allow rule covers it and no deny rule
+// overlaps it.
+//
+// Rules without placeholders are linked to a topic tree and matched through
+// it, the ones with placeholders are expanded and checked one by one. A
+// placeholder expanding to an empty value or one that is not a single level,
+// like a username containing '/' or a wildcard, does not allow anything and
+// denies everything for a deny rule.
+type ACL struct {
+	mu       sync.RWMutex
+	tree     *TTree
+	rules    map[string]*ACLRule
+	patterns []*ACLRule
+}
+
+// NewACL returns an ACL without rules, which denies everything
+func NewACL() *ACL {
+	return &ACL{tree: NewTopicTree(), rules: make(map[string]*ACLRule)}
+}
+
+// Add adds a rule, unless it already exists
+func (a *ACL) Add(r ACLRule) error {
+	if r.Access&AccessAll == 0 {
+		return fmt.Errorf("topicACL/Add: no access: %w", ErrInvalidRule)
+	}
+	pattern := hasPlaceholder(r.Filter)
+	if _, ok := expand(r.Filter, Principal{Username: "u", ClientID: "c"}); !ok {
+		return fmt.Errorf("topicACL/Add: %s: %w", r.Filter, ErrInvalidRule)
+	}
+
+	r.Filter = append([]byte(nil), r.Filter...)
+	rule := &r
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := rule.key()
+	if _, ok := a.rules[key]; ok {
+		return nil
+	}
+	if pattern {
+		a.patterns = append(a.patterns, rule)
+	} else if err := a.tree.EntityLink(rule.Filter, rule); err != nil {
+		return fmt.Errorf("topicACL/Add: %w", err)
+	}
+	a.rules[key] = rule
+	return nil
+}
+
+// Remove removes a rule added with the same values
+func (a *ACL) Remove(r ACLRule) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := r.key()
+	rule, ok := a.rules[key]
+	if !ok {
+		return fmt.Errorf("topicACL/Remove: %w", ErrNotLinked)
+	}
+	delete(a.rules, key)
+
+	for i, pr := range a.patterns {
+		if pr == rule {
+			a.patterns = append(a.patterns[:i], a.patterns[i+1:]...)
+			return nil
+		}
+	}
+	return a.tree.EntityUnLink(rule.Filter, rule)
+}
+
+// CanPublish reports whether p may publish to topic, which must not contain
+// wildcards
+func (a *ACL) CanPublish(p Principal, topic []byte) (bool, error) {
+	if bytes.ContainsAny(topic, _WC) {
+		return false, errors.New("topicACL/CanPublish: wildcards in topic name")
+	}
+	levels, err := mqttSyntax.levels(topic)
+	if err != nil {
+		return false, fmt.Errorf("topicACL/CanPublish: %w", err)
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	entities := make([]interface{}, 0, 8)
+	if err := a.tree.LinkedEntities(topic, &entities); err != nil {
+		return false, fmt.Errorf("topicACL/CanPublish: %w", err)
+	}
+	var allowed bool
+	for _, e := range entities {
+		if r := e.(*ACLRule); r.applies(p, AccessPublish) {
+			if r.Deny {
+				return false, nil
+			}
+			allowed = true
+		}
+	}
+
+	deny, allow := a.checkPatterns(p, AccessPublish, func(rl [][]byte) (bool, bool) {
+		return mqttSyntax.covers(rl, levels), mqttSyntax.covers(rl, levels)
+	})
+	return !deny && (allowed || allow), nil
+}
+
+// CanSubscribe reports whether p may subscribe to filter
+func (a *ACL) CanSubscribe(p Principal, filter []byte) (bool, error) {
+	levels, err := mqttSyntax.levels(filter)
+	if err != nil {
+		return false, fmt.Errorf("topicACL/CanSubscribe: %w", err)
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	overlapping, err := a.tree.OverlappingFilters(filter)
+	if err != nil {
+		return false, fmt.Errorf("topicACL/CanSubscribe: %w", err)
+	}
+	var allowed bool
+	for _, fe := range overlapping {
+		for _, e := range fe.Entities {
+			r := e.(*ACLRule)
+			if !r.applies(p, AccessSubscribe) {
+				continue
+			}
+			if r.Deny {
+				return false, nil
+			}
+			if !allowed {
+				rl, _ := mqttSyntax.levels(fe.Filter)
+				allowed = mqttSyntax.covers(rl, levels)
+			}
+		}
+	}
+
+	deny, allow := a.checkPatterns(p, AccessSubscribe, func(rl [][]byte) (bool, bool) {
+		return mqttSyntax.overlaps(rl, levels), mqttSyntax.covers(rl, levels)
+	})
+	return !deny && (allowed || allow), nil
+}
+
+// checkPatterns expands the rules with placeholders applying to p, and reports
+// whether a deny rule denies and an allow rule allows, as checked by check
+// with the levels of the expanded filter
+func (a *ACL) checkPatterns(p Principal, access Access, check func(levels [][]byte) (deny, allow bool)) (bool, bool) {
+	var allowed bool
+	for _, r := range a.patterns {
+		if !r.applies(p, access) {
+			continue
+		}
+		levels, valid := expand(r.Filter, p)
+
+		switch {
+		case r.Deny && !valid:
+			return true, false
+		case !valid:
+		case r.Deny:
+			if deny, _ := check(levels); deny {
+				return true, false
+			}
+		case !allowed:
+			_, allowed = check(levels)
+		}
+	}
+	return false, allowed
+}
+
+// Close releases the rules
+func (a *ACL) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.rules, a.patterns = nil, nil
+	return a.tree.Close()
+}
+
+func hasPlaceholder(filter []byte) bool {
+	return bytes.Contains(filter, []byte(PlaceholderUsername)) || bytes.Contains(filter, []byte(PlaceholderClientID))
+}
+
+// expand replaces the placeholders of filter with the values of p, and returns
+// the levels of the expanded filter unless a value is not a single level
+func expand(filter []byte, p Principal) ([][]byte, bool) {
+	for _, ph := range []struct{ placeholder, v string }{
+		{PlaceholderUsername, p.Username},
+		{PlaceholderClientID, p.ClientID},
+	} {
+		if !bytes.Contains(filter, []byte(ph.placeholder)) {
+			continue
+		}
+		if ph.v == "" || strings.ContainsAny(ph.v, SEP+_WC+"{}") {
+			return nil, false
+		}
+		filter = bytes.ReplaceAll(filter, []byte(ph.placeholder), []byte(ph.v))
+	}
+	levels, err := mqttSyntax.levels(filter)
+	return levels, err == nil
+}
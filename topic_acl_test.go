@@ -0,0 +1,93 @@
+package cabinet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestACL(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	acl := NewACL()
+	defer func() {
+		require.NoError(t, acl.Close())
+	}()
+
+	for _, r := range []ACLRule{
+		{Filter: []byte("sport/#"), Access: AccessSubscribe},
+		{Filter: []byte("sport/tennis/secret/#"), Access: AccessAll, Deny: true},
+		{Username: "admin", Filter: []byte("#"), Access: AccessAll},
+		{Filter: []byte("users/%u/#"), Access: AccessAll},
+		{Filter: []byte("devices/%c/status"), Access: AccessPublish},
+		{Filter: []byte("users/%u/locked"), Access: AccessPublish, Deny: true},
+	} {
+		require.NoError(t, acl.Add(r))
+	}
+	require.True(t, errors.Is(acl.Add(ACLRule{Filter: []byte("a/#/b"), Access: AccessAll}), ErrInvalidRule))
+	require.True(t, errors.Is(acl.Add(ACLRule{Filter: []byte("a")}), ErrInvalidRule))
+
+	alice := Principal{Username: "alice", ClientID: "c1"}
+	admin := Principal{Username: "admin", ClientID: "c2"}
+	eve := Principal{Username: "ev/e", ClientID: "c3"}
+	mallory := Principal{Username: "{x}", ClientID: "c4"}
+
+	for _, c := range []struct {
+		p       Principal
+		publish bool
+		topic   string
+		want    bool
+	}{
+		{alice, false, "sport/tennis/+", true},
+		{alice, false, "sport/#", false}, // overlaps the deny rule
+		{alice, false, "#", false},
+		{alice, false, "+/tennis", false},
+		{alice, true, "sport/tennis", false},
+		{alice, false, "sport/tennis/secret/x", false},
+		{alice, false, "sport/+/secret", true},
+		{alice, false, "sport/+/secret/#", false}, // overlaps the deny rule
+		{admin, true, "news", true},
+		{admin, false, "#", false},
+		{admin, true, "sport/tennis/secret/x", false},
+		{alice, true, "users/alice/x", true},
+		{alice, false, "users/alice/#", true},
+		{alice, true, "users/bob/x", false},
+		{alice, true, "users/alice/locked", false},
+		{alice, false, "users/alice/+", true}, // the deny rule is for publishing
+		{alice, true, "devices/c1/status", true},
+		{alice, true, "devices/c2/status", false},
+		{eve, true, "users/ev/e/x", false},
+		{eve, false, "sport/#", false}, // the deny pattern cannot be expanded
+		{mallory, true, "users/bob/x", false},
+		{mallory, true, "users/{x}/x", false}, // nor expanded to a parameter
+	} {
+		var (
+			ok  bool
+			err error
+		)
+		if c.publish {
+			ok, err = acl.CanPublish(c.p, []byte(c.topic))
+		} else {
+			ok, err = acl.CanSubscribe(c.p, []byte(c.topic))
+		}
+		require.NoError(t, err)
+		require.Equal(t, c.want, ok, "%s %v %s", c.p.Username, c.publish, c.topic)
+	}
+
+	_, err := acl.CanPublish(alice, []byte("sport/+"))
+	require.Error(t, err)
+	_, err = acl.CanSubscribe(alice, []byte("sport/#/x"))
+	require.Error(t, err)
+
+	require.NoError(t, acl.Remove(ACLRule{Filter: []byte("sport/tennis/secret/#"), Access: AccessAll, Deny: true}))
+	require.NoError(t, acl.Remove(ACLRule{Filter: []byte("users/%u/locked"), Access: AccessPublish, Deny: true}))
+	require.True(t, errors.Is(acl.Remove(ACLRule{Filter: []byte("sport/#")}), ErrNotLinked))
+	ok, err := acl.CanSubscribe(alice, []byte("sport/tennis/secret/x"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = acl.CanPublish(alice, []byte("users/alice/locked"))
+	require.NoError(t, err)
+	require.True(t, ok)
+}
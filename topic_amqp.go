@@ -0,0 +1,95 @@
+package cabinet
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrUnsupportedSyntax is returned by the operations a syntax does not support
+var ErrUnsupportedSyntax = errors.New("unsupported by the syntax")
+
+// anyState is a node reached while matching a topic, and whether it is the node
+// of a multi-level wildcard, matching any level after it
+type anyState struct {
+	tn  *tNode
+	mwc bool
+}
+
+// anyStates keeps the sets of states of the matches, so that matching does not
+// allocate
+var anyStates = sync.Pool{New: func() interface{} {
+	return new([2][]anyState)
+}}
+
+// addState adds a state to a set, unless already in it
+func addState(states []anyState, s anyState) []anyState {
+	for _, o := range states {
+		if o.tn == s.tn {
+			return states
+		}
+	}
+	return append(states, s)
+}
+
+// closure adds the multi-level wildcards following the states of a set, as
+// they match zero levels
+func (sx *Syntax) closure(states []anyState) []anyState {
+	mwc := string(byteLevel(sx.MultiWildcard))
+	for i := 0; i < len(states); i++ {
+		if nltn, ok := states[i].tn.nltNodes[mwc]; ok {
+			states = addState(states, anyState{tn: nltn, mwc: true})
+		}
+	}
+	return states
+}
+
+// matchEntitiesAnywhere matches as matchEntities does, but with multi-level
+// wildcards anywhere in filters, matching zero or more levels. Rather than
+// backtracking over the levels a wildcard could match, it walks the tree one
+// topic level at a time, keeping the set of nodes reached so far, so that each
+// node is visited at most once per level and its entities added once.
+func (tn *tNode) matchEntitiesAnywhere(sx *Syntax, topic []byte, entities *[]interface{}) error {
+	sets := anyStates.Get().(*[2][]anyState)
+	defer anyStates.Put(sets)
+
+	cur := sx.closure(append(sets[0][:0], anyState{tn: tn}))
+	next := sets[1][:0]
+	for len(topic) > 0 && len(cur) > 0 {
+		ntl, rem, err := sx.nextLevel(topic)
+		if err != nil {
+			return err
+		}
+
+		level := string(ntl)
+
+		next = next[:0]
+		for _, s := range cur {
+			if s.mwc {
+				next = addState(next, s)
+			}
+			for k, nltn := range s.tn.nltNodes {
+				if k == level || sx.isSWC(k) {
+					next = addState(next, anyState{tn: nltn})
+				}
+			}
+			for k, nltn := range s.tn.globs {
+				if matchGlob(k, level) {
+					next = addState(next, anyState{tn: nltn})
+				}
+			}
+			for _, nltn := range s.tn.regexps {
+				if nltn.re.Match(ntl) {
+					next = addState(next, anyState{tn: nltn})
+				}
+			}
+		}
+		cur, next = sx.closure(next), cur
+		topic = rem
+	}
+
+	for _, s := range cur {
+		s.tn.appendEntities(entities)
+	}
+	sets[0], sets[1] = cur[:0], next[:0]
+	return nil
+}
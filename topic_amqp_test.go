@@ -0,0 +1,78 @@
+package cabinet
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// amqpMatch is a reference AMQP matcher, backtracking over the words '#' may
+// match
+func amqpMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if amqpMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && amqpMatch(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && words[0] == pattern[0] && amqpMatch(pattern[1:], words[1:])
+	}
+}
+
+func TestAMQPMatch(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree(WithSyntax(AMQP))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	patterns := []string{"#", "a.#", "#.z", "a.#.z", "a.*.#.z", "#.#", "a.#.#.z", "*.b.#", "#.b.#", "a.b.c", "*", "a.*", "#.*.#.z"}
+	for _, p := range patterns {
+		require.NoError(t, tt.EntityLink([]byte(p), p))
+	}
+
+	entities := make([]interface{}, 0, len(patterns))
+	for _, topic := range []string{"a", "z", "a.z", "a.b", "a.b.z", "a.b.c", "a.b.b.z", "x.b.y", "a.x.y.z", "b", "a.b.c.d.e.z"} {
+		require.NoError(t, tt.LinkedEntities([]byte(topic), &entities))
+
+		var want []interface{}
+		for _, p := range patterns {
+			if amqpMatch(strings.Split(p, "."), strings.Split(topic, ".")) {
+				want = append(want, p)
+			}
+		}
+		require.ElementsMatch(t, want, entities, topic)
+	}
+
+	// Matching does not allocate once warm
+	topic := []byte("a.b.c.d.e.z")
+	if !raceEnabled {
+		allocs := testing.AllocsPerRun(100, func() {
+			require.NoError(t, tt.LinkedEntities(topic, &entities))
+		})
+		require.Equal(t, 0.0, allocs)
+	}
+
+	captures := make([]CaptureMatch, 0, 1)
+	require.True(t, errors.Is(tt.LinkedCaptures(topic, &captures), ErrUnsupportedSyntax))
+	_, err := tt.OverlappingFilters([]byte("a.#"))
+	require.True(t, errors.Is(err, ErrUnsupportedSyntax))
+	_, err = AMQP.Covers([]byte("#"), []byte("a"))
+	require.True(t, errors.Is(err, ErrUnsupportedSyntax))
+
+	require.NoError(t, tt.EntityUnLink([]byte("a.#.z"), "a.#.z"))
+	require.NoError(t, tt.LinkedEntities([]byte("a.z"), &entities))
+	require.ElementsMatch(t, []interface{}{"#", "a.#", "#.z", "#.#", "a.#.#.z", "a.*", "#.*.#.z"}, entities)
+}
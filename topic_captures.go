@@ -0,0 +1,178 @@
+package cabinet
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// CaptureMatch is an entity matched by LinkedCaptures, with the levels of the
+// topic matched by the wildcards of its filter
+type CaptureMatch struct {
+	Entity interface{}
+
+	// Levels are subslices of the topic, one for each '+', named parameter
+	// and '#' of the filter in order. '#' matches the rest of the topic, and
+	// an empty level is an empty slice.
+	Levels [][]byte
+}
+
+// capture is a level of a topic and the wildcard of a filter that matched it
+type capture struct {
+	wildcard string
+	level    []byte
+	rest     int // the length of the topic from the level on
+}
+
+// original returns the level of topic matching the level captured in its
+// normal form. A normalizer leaves the separators unchanged, so the capture is
+// the level of topic at the same index, or the rest of topic from it for the
+// multi-level wildcard.
+func (sx *Syntax) original(c capture, normal, topic []byte) []byte {
+	index := 0
+	for _, b := range normal[:len(normal)-c.rest] {
+		if b == sx.Separator {
+			index++
+		}
+	}
+
+	start := 0
+	for ; index > 0 && start < len(topic); start++ {
+		if topic[start] == sx.Separator {
+			index--
+		}
+	}
+	if index > 0 {
+		// Not a normal form keeping the separators, the levels cannot be
+		// mapped back to the topic
+		return append([]byte(nil), c.level...)
+	}
+
+	if sx.isMWC(c.wildcard) {
+		return topic[start:]
+	}
+	if end := bytes.IndexByte(topic[start:], sx.Separator); end >= 0 {
+		return topic[start : start+end]
+	}
+	return topic[start:]
+}
+
+// captureStacks keeps the stacks of captures of the walks, so that matching
+// does not allocate
+var captureStacks = sync.Pool{New: func() interface{} {
+	caps := make([]capture, 0, 8)
+	return &caps
+}}
+
+// matchCapturesPooled runs matchCaptures with a stack from captureStacks
+func (tn *tNode) matchCapturesPooled(sx *Syntax, topic []byte, fn func(tn *tNode, caps []capture)) error {
+	caps := captureStacks.Get().(*[]capture)
+	defer captureStacks.Put(caps)
+
+	return tn.matchCaptures(sx, topic, (*caps)[:0], fn)
+}
+
+// LinkedCaptures returns the entities linked to the filters matching topic,
+// like LinkedEntities, along with the levels matched by the wildcards of each
+// filter. Returned values will be invalidated by the next LinkedCaptures call,
+// which reuses their memory.
+func (tr *TTree) LinkedCaptures(topic []byte, matches *[]CaptureMatch) error {
+	if tr.syntax.MultiWildcardAnywhere {
+		return fmt.Errorf("topicTree/LinkedCaptures: %w", ErrUnsupportedSyntax)
+	}
+	if tr.topicRewriter != nil {
+		topic = tr.topicRewriter.Rewrite(topic)
+	}
+	if err := tr.syntax.ValidateTopicName(topic); err != nil {
+		return fmt.Errorf("topicTree/LinkedCaptures: %w", err)
+	}
+	if err := tr.checkTopic(topic); err != nil {
+		return fmt.Errorf("topicTree/LinkedCaptures: %w", err)
+	}
+	original, normal := topic, []byte(nil)
+	if tr.normalizer != nil {
+		// The levels are mapped back to the topic, so the normal form does
+		// not outlive the call
+		buf := normBuffers.Get().(*[]byte)
+		defer normBuffers.Put(buf)
+		*buf = tr.normalizer((*buf)[:0], topic)
+		topic, normal = *buf, *buf
+	}
+
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+
+	*matches = (*matches)[0:0]
+
+	return tr.root.matchCapturesPooled(tr.syntax, topic, func(tn *tNode, caps []capture) {
+		for _, entity := range tn.entities {
+			n := len(*matches)
+			if n < cap(*matches) {
+				*matches = (*matches)[:n+1]
+			} else {
+				*matches = append(*matches, CaptureMatch{})
+			}
+			m := &(*matches)[n]
+			m.Entity, m.Levels = entity, m.Levels[:0]
+			for _, c := range caps {
+				if normal != nil {
+					c.level = tr.syntax.original(c, normal, original)
+				}
+				m.Levels = append(m.Levels, c.level)
+			}
+		}
+	})
+}
+
+// matchCaptures walks the tree as matchEntities does, and calls fn with each
+// matching node and the levels captured by wildcards on the way to it. The
+// captures are only valid during the call, their memory being reused by the
+// rest of the walk.
+func (tn *tNode) matchCaptures(sx *Syntax, topic []byte, caps []capture, fn func(tn *tNode, caps []capture)) error {
+	if len(topic) == 0 {
+		fn(tn, caps)
+		return nil
+	}
+
+	ntl, rem, err := sx.nextLevel(topic)
+	if err != nil {
+		return err
+	}
+
+	level := string(ntl)
+
+	value := sx.levelValue(topic, ntl)
+
+	for k, nltn := range tn.nltNodes {
+		switch {
+		case sx.isMWC(k):
+			fn(nltn, append(caps, capture{wildcard: k, level: topic, rest: len(topic)}))
+		case sx.isSWC(k):
+			if err := nltn.matchCaptures(sx, rem, append(caps, capture{wildcard: k, level: value, rest: len(topic)}), fn); err != nil {
+				return err
+			}
+		case k == level:
+			if err := nltn.matchCaptures(sx, rem, caps, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	for k, nltn := range tn.globs {
+		if matchGlob(k, string(value)) {
+			if err := nltn.matchCaptures(sx, rem, append(caps, capture{wildcard: k, level: value, rest: len(topic)}), fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	for k, nltn := range tn.regexps {
+		if nltn.re.Match(value) {
+			if err := nltn.matchCaptures(sx, rem, append(caps, capture{wildcard: k, level: value, rest: len(topic)}), fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package cabinet
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestLinkedCaptures(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	mqtt := *MQTT
+	mqtt.Params = true
+	tt := NewTopicTree(WithSyntax(&mqtt))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	require.NoError(t, tt.EntityLink([]byte("sport/+/player/+"), "ent1"))
+	require.NoError(t, tt.EntityLink([]byte("sport/#"), "ent2"))
+	require.NoError(t, tt.EntityLink([]byte("+/{sport}/#"), "ent3"))
+	require.NoError(t, tt.EntityLink([]byte("sport/tennis/player/7"), "ent4"))
+	require.NoError(t, tt.EntityLink([]byte("+/finance"), "ent5"))
+
+	levels := func(matches []CaptureMatch) map[interface{}][]string {
+		m := make(map[interface{}][]string)
+		for _, cm := range matches {
+			var s []string
+			for _, l := range cm.Levels {
+				s = append(s, string(l))
+			}
+			m[cm.Entity] = s
+		}
+		return m
+	}
+
+	topic := []byte("sport/tennis/player/7")
+	matches := make([]CaptureMatch, 0, 4)
+	require.NoError(t, tt.LinkedCaptures(topic, &matches))
+	require.Equal(t, map[interface{}][]string{
+		"ent1": {"tennis", "7"},
+		"ent2": {"tennis/player/7"},
+		"ent3": {"sport", "tennis", "player/7"},
+		"ent4": nil,
+	}, levels(matches))
+
+	// Captures are subslices of the topic, sharing the end of its memory
+	end := &topic[:cap(topic)][cap(topic)-1]
+	for _, m := range matches {
+		for _, l := range m.Levels {
+			require.True(t, &l[:cap(l)][cap(l)-1] == end, m.Entity)
+		}
+	}
+
+	require.NoError(t, tt.LinkedCaptures([]byte("/finance"), &matches))
+	require.Equal(t, map[interface{}][]string{"ent5": {""}}, levels(matches))
+
+	// Matching again reuses the memory of the matches
+	require.NoError(t, tt.LinkedCaptures(topic, &matches))
+	if !raceEnabled {
+		allocs := testing.AllocsPerRun(100, func() {
+			require.NoError(t, tt.LinkedCaptures(topic, &matches))
+		})
+		require.Equal(t, 0.0, allocs)
+	}
+
+	// and the named parameters are reported by name
+	params := make([]ParamMatch, 0, 4)
+	require.NoError(t, tt.LinkedParams(topic, &params))
+	sort.Slice(params, func(i, j int) bool {
+		return params[i].Entity.(string) < params[j].Entity.(string)
+	})
+	require.Equal(t, map[string]string{"sport": "tennis"}, params[2].Params)
+}
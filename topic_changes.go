@@ -0,0 +1,96 @@
+package cabinet
+
+// ChangeOp is the operation of a change of a tree
+type ChangeOp byte
+
+const (
+	// ChangeLink is a successful EntityLink, or a link restored from a snapshot
+	ChangeLink ChangeOp = iota + 1
+
+	// ChangeUnLink is a successful EntityUnLink
+	ChangeUnLink
+)
+
+// Change is a mutation of a tree, numbered in the order it was applied
+type Change struct {
+	Seq    uint64
+	Op     ChangeOp
+	Topic  []byte
+	Entity interface{} // nil when all the entities of Topic were unlinked
+}
+
+// Watcher receives the changes of a tree. Changes are never dropped: a watcher
+// too slow to keep up with the buffer of its channel is closed and marked as
+// lagging, and must catch up from a snapshot.
+type Watcher struct {
+	C <-chan Change
+
+	c      chan Change
+	tr     *TTree
+	lagged bool
+}
+
+// Watch returns a watcher receiving the changes applied after the sequence
+// number it also returns, buffering up to size of them
+func (tr *TTree) Watch(size int) (*Watcher, uint64) {
+	c := make(chan Change, size)
+	w := &Watcher{C: c, c: c, tr: tr}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if tr.watchers == nil {
+		tr.watchers = make(map[*Watcher]struct{})
+	}
+	tr.watchers[w] = struct{}{}
+
+	return w, tr.seq
+}
+
+// Seq returns the sequence number of the last change of the tree
+func (tr *TTree) Seq() uint64 {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+
+	return tr.seq
+}
+
+// Close stops the watcher and closes its channel
+func (w *Watcher) Close() {
+	w.tr.mu.Lock()
+	defer w.tr.mu.Unlock()
+
+	if _, ok := w.tr.watchers[w]; ok {
+		delete(w.tr.watchers, w)
+		close(w.c)
+	}
+}
+
+// Lagged reports whether the watcher was closed for falling behind
+func (w *Watcher) Lagged() bool {
+	w.tr.mu.RLock()
+	defer w.tr.mu.RUnlock()
+
+	return w.lagged
+}
+
+// notify numbers a change and sends it to the watchers, under the write lock,
+// and returns its sequence number
+func (tr *TTree) notify(op ChangeOp, topic []byte, entity interface{}) uint64 {
+	tr.seq++
+	if len(tr.watchers) == 0 {
+		return tr.seq
+	}
+
+	c := Change{Seq: tr.seq, Op: op, Topic: append([]byte(nil), topic...), Entity: entity}
+	for w := range tr.watchers {
+		select {
+		case w.c <- c:
+		default:
+			w.lagged = true
+			delete(tr.watchers, w)
+			close(w.c)
+		}
+	}
+	return tr.seq
+}
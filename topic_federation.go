@@ -0,0 +1,257 @@
+package cabinet
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrFederationLoop is returned when receiving a message that already went
+// through the local node
+var ErrFederationLoop = errors.New("federation loop")
+
+// FederatedMessage is a publish forwarded between federated trees
+type FederatedMessage struct {
+	Topic   []byte
+	Payload interface{}
+
+	// Hops are the identifiers of the nodes the message went through
+	Hops []string
+}
+
+// Peer is the link to the remote end of a federation
+type Peer interface {
+	// Subscribe asks the remote end to forward the messages matching filter
+	Subscribe(filter []byte) error
+
+	// Unsubscribe reverts Subscribe
+	Unsubscribe(filter []byte) error
+
+	// Publish sends a message matching a filter the remote end subscribed to
+	Publish(m *FederatedMessage) error
+}
+
+// Federation connects a tree to a remote one. Instead of every filter linked
+// to the tree, it subscribes upstream to the minimal set of filters covering
+// them, kept up to date as filters come and go: 'a/#' covers 'a/b/+'.
+// Messages carry the identifiers of the nodes they went through, so that they
+// never come back to one of them around a cycle. A node reached by several
+// paths still receives a message once per path.
+type Federation struct {
+	id     string
+	peerID string
+	peer   Peer
+
+	mu      sync.Mutex
+	filters map[string][][]byte // filters linked to the tree, in levels
+	cover   map[string]struct{} // the minimal covering subset of filters
+	err     error               // first error of the peer
+
+	tr         *TTree // the local tree, once given to it
+	remote     *TTree // filters the remote end subscribed to
+	remoteOnce sync.Once
+}
+
+// NewFederation returns the federation of node id with node peerID, reached
+// through peer. It must be given to the tree with WithFederation.
+func NewFederation(id, peerID string, peer Peer) *Federation {
+	return &Federation{
+		id:      id,
+		peerID:  peerID,
+		peer:    peer,
+		filters: make(map[string][][]byte),
+		cover:   make(map[string]struct{}),
+	}
+}
+
+// WithFederation keeps the upstream subscriptions of f up to date with the
+// filters of the tree
+func WithFederation(f *Federation) TreeOption {
+	hooks := WithHooks(Hooks{
+		OnFilterAdded:   f.filterAdded,
+		OnFilterRemoved: f.filterRemoved,
+	})
+	return func(tr *TTree) {
+		f.tr = tr
+		hooks(tr)
+	}
+}
+
+// syntax returns the syntax of the local tree
+func (f *Federation) syntax() *Syntax {
+	if f.tr == nil {
+		return &mqttSyntax
+	}
+	return f.tr.syntax
+}
+
+// remoteTree returns the tree of the filters the remote end subscribed to,
+// created on first use with the syntax of the local tree
+func (f *Federation) remoteTree() *TTree {
+	f.remoteOnce.Do(func() {
+		f.remote = NewTopicTree(WithSyntax(f.syntax()))
+	})
+	return f.remote
+}
+
+// Covering returns the filters subscribed upstream, sorted
+func (f *Federation) Covering() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cover := make([][]byte, 0, len(f.cover))
+	for filter := range f.cover {
+		cover = append(cover, []byte(filter))
+	}
+	sort.Slice(cover, func(i, j int) bool {
+		return string(cover[i]) < string(cover[j])
+	})
+	return cover
+}
+
+// Err returns the first error of the peer while updating the subscriptions
+func (f *Federation) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.err
+}
+
+// coveredBy returns a filter of the covering set other than except covering
+// levels, if any
+func (f *Federation) coveredBy(levels [][]byte, except string) (string, bool) {
+	for filter := range f.cover {
+		if filter != except && f.syntax().covers(f.filters[filter], levels) {
+			return filter, true
+		}
+	}
+	return "", false
+}
+
+func (f *Federation) filterAdded(filter []byte) {
+	levels, err := f.syntax().levels(filter)
+	if err != nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := string(filter)
+	f.filters[key] = levels
+	if _, ok := f.coveredBy(levels, key); ok {
+		return
+	}
+
+	f.subscribe(key)
+	for c := range f.cover {
+		if c != key && f.syntax().covers(levels, f.filters[c]) {
+			f.unsubscribe(c)
+		}
+	}
+}
+
+func (f *Federation) filterRemoved(filter []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := string(filter)
+	levels, ok := f.filters[key]
+	if !ok {
+		return
+	}
+	delete(f.filters, key)
+	if _, ok := f.cover[key]; !ok {
+		return
+	}
+
+	// The filters it covered alone join the covering set, unless covered by
+	// another of them. Of the filters covering each other, like 'a/+' and
+	// 'a/{x}', the first in order joins.
+	var uncovered []string
+	for c, cl := range f.filters {
+		if f.syntax().covers(levels, cl) {
+			if _, ok := f.coveredBy(cl, key); !ok {
+				uncovered = append(uncovered, c)
+			}
+		}
+	}
+	sort.Strings(uncovered)
+	for _, c := range uncovered {
+		minimal := true
+		for _, o := range uncovered {
+			if o != c && f.syntax().covers(f.filters[o], f.filters[c]) &&
+				(o < c || !f.syntax().covers(f.filters[c], f.filters[o])) {
+				minimal = false
+				break
+			}
+		}
+		if minimal {
+			f.subscribe(c)
+		}
+	}
+	f.unsubscribe(key)
+}
+
+// subscribe and unsubscribe update the covering set and the peer, under the
+// lock so that the peer sees the updates in order
+func (f *Federation) subscribe(filter string) {
+	f.cover[filter] = struct{}{}
+	if err := f.peer.Subscribe([]byte(filter)); err != nil && f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *Federation) unsubscribe(filter string) {
+	delete(f.cover, filter)
+	if err := f.peer.Unsubscribe([]byte(filter)); err != nil && f.err == nil {
+		f.err = err
+	}
+}
+
+// RemoteSubscribe records a filter the remote end subscribed to
+func (f *Federation) RemoteSubscribe(filter []byte) error {
+	return f.remoteTree().EntityLink(filter, f)
+}
+
+// RemoteUnsubscribe reverts RemoteSubscribe
+func (f *Federation) RemoteUnsubscribe(filter []byte) error {
+	return f.remoteTree().EntityUnLink(filter, f)
+}
+
+// Forward sends a message published on the local node to the peer, when it
+// matches a filter the remote end subscribed to and the peer has not seen it
+// yet. It reports whether it was sent.
+func (f *Federation) Forward(m *FederatedMessage) (bool, error) {
+	for _, hop := range m.Hops {
+		if hop == f.peerID {
+			return false, nil
+		}
+	}
+
+	entities := make([]interface{}, 0, 1)
+	if err := f.remoteTree().LinkedEntities(m.Topic, &entities); err != nil || len(entities) == 0 {
+		return false, err
+	}
+
+	fm := *m
+	fm.Hops = append(append(make([]string, 0, len(m.Hops)+1), m.Hops...), f.id)
+	return true, f.peer.Publish(&fm)
+}
+
+// Receive checks a message received from the peer before it is published on
+// the local node, and returns ErrFederationLoop when it already went through
+// it
+func (f *Federation) Receive(m *FederatedMessage) error {
+	for _, hop := range m.Hops {
+		if hop == f.id {
+			return ErrFederationLoop
+		}
+	}
+	return nil
+}
+
+// Close releases the filters the remote end subscribed to
+func (f *Federation) Close() error {
+	return f.remoteTree().Close()
+}
@@ -0,0 +1,157 @@
+package cabinet
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// fedNode is a node of a federation test, its peers delivering in memory
+type fedNode struct {
+	id        string
+	tree      *TTree
+	feds      []*Federation
+	delivered []string
+}
+
+type memPeer struct {
+	to  *fedNode
+	fed func() *Federation // the federation of the remote end
+}
+
+func (p *memPeer) Subscribe(filter []byte) error {
+	return p.fed().RemoteSubscribe(filter)
+}
+
+func (p *memPeer) Unsubscribe(filter []byte) error {
+	return p.fed().RemoteUnsubscribe(filter)
+}
+
+func (p *memPeer) Publish(m *FederatedMessage) error {
+	if err := p.fed().Receive(m); err != nil {
+		return err
+	}
+	p.to.publish(m)
+	return nil
+}
+
+// publish delivers a message to the local entities and forwards it
+func (n *fedNode) publish(m *FederatedMessage) {
+	entities := make([]interface{}, 0, 4)
+	n.tree.LinkedEntities(m.Topic, &entities)
+	for _, e := range entities {
+		n.delivered = append(n.delivered, fmt.Sprintf("%v:%s", e, m.Topic))
+	}
+	for _, f := range n.feds {
+		f.Forward(m)
+	}
+}
+
+// federate connects a to b in both directions
+func federate(a, b *fedNode, aopts, bopts *[]TreeOption) {
+	var ab, ba *Federation
+	ab = NewFederation(a.id, b.id, &memPeer{to: b, fed: func() *Federation { return ba }})
+	ba = NewFederation(b.id, a.id, &memPeer{to: a, fed: func() *Federation { return ab }})
+	a.feds = append(a.feds, ab)
+	b.feds = append(b.feds, ba)
+	*aopts = append(*aopts, WithFederation(ab))
+	*bopts = append(*bopts, WithFederation(ba))
+}
+
+func TestFederation(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	params := *MQTT
+	params.Params = true
+	a, b := &fedNode{id: "a"}, &fedNode{id: "b"}
+	aopts, bopts := []TreeOption{WithSyntax(&params)}, []TreeOption{WithSyntax(&params)}
+	federate(a, b, &aopts, &bopts)
+	a.tree, b.tree = NewTopicTree(aopts...), NewTopicTree(bopts...)
+	defer func() {
+		for _, n := range []*fedNode{a, b} {
+			require.NoError(t, n.tree.Close())
+			require.NoError(t, n.feds[0].Close())
+		}
+	}()
+	ab := a.feds[0]
+
+	covering := func() []string {
+		var filters []string
+		for _, f := range ab.Covering() {
+			filters = append(filters, string(f))
+		}
+		return filters
+	}
+
+	require.NoError(t, a.tree.EntityLink([]byte("sport/tennis/+"), "ent1"))
+	require.Equal(t, []string{"sport/tennis/+"}, covering())
+	require.NoError(t, a.tree.EntityLink([]byte("sport/#"), "ent2"))
+	require.Equal(t, []string{"sport/#"}, covering())
+	require.NoError(t, a.tree.EntityLink([]byte("sport/tennis/final"), "ent3"))
+	require.NoError(t, a.tree.EntityLink([]byte("news"), "ent4"))
+	require.Equal(t, []string{"news", "sport/#"}, covering())
+
+	// Removing a covering filter subscribes to the ones it covered
+	require.NoError(t, a.tree.EntityUnLink([]byte("sport/#"), "ent2"))
+	require.Equal(t, []string{"news", "sport/tennis/+"}, covering())
+	require.NoError(t, a.tree.EntityUnLink([]byte("sport/tennis/+"), nil))
+	require.Equal(t, []string{"news", "sport/tennis/final"}, covering())
+
+	// Of the filters covering each other, one stays subscribed
+	require.NoError(t, a.tree.EntityLink([]byte("weather/#"), "ent6"))
+	require.NoError(t, a.tree.EntityLink([]byte("weather/{city}"), "ent6"))
+	require.NoError(t, a.tree.EntityLink([]byte("weather/+"), "ent6"))
+	require.NoError(t, a.tree.EntityUnLink([]byte("weather/#"), "ent6"))
+	require.Equal(t, []string{"news", "sport/tennis/final", "weather/+"}, covering())
+	require.NoError(t, a.tree.EntityUnLink([]byte("weather/+"), "ent6"))
+	require.Equal(t, []string{"news", "sport/tennis/final", "weather/{city}"}, covering())
+	require.NoError(t, a.tree.EntityUnLink([]byte("weather/{city}"), "ent6"))
+	require.Equal(t, []string{"news", "sport/tennis/final"}, covering())
+	require.NoError(t, ab.Err())
+
+	// Messages published on b reach the entities of a, and are not sent back
+	require.NoError(t, b.tree.EntityLink([]byte("sport/+/final"), "ent5"))
+	b.publish(&FederatedMessage{Topic: []byte("sport/tennis/final")})
+	b.publish(&FederatedMessage{Topic: []byte("sport/tennis/semi")})
+	require.Equal(t, []string{"ent3:sport/tennis/final"}, a.delivered)
+	require.Equal(t, []string{"ent5:sport/tennis/final"}, b.delivered)
+}
+
+func TestFederationLoop(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// Three nodes federated in a cycle, all subscribing to everything
+	nodes := []*fedNode{{id: "a"}, {id: "b"}, {id: "c"}}
+	opts := make([][]TreeOption, len(nodes))
+	for i := range nodes {
+		j := (i + 1) % len(nodes)
+		federate(nodes[i], nodes[j], &opts[i], &opts[j])
+	}
+	for i, n := range nodes {
+		n.tree = NewTopicTree(opts[i]...)
+		require.NoError(t, n.tree.EntityLink([]byte("#"), "ent"+n.id))
+	}
+	defer func() {
+		for _, n := range nodes {
+			require.NoError(t, n.tree.Close())
+			for _, f := range n.feds {
+				require.NoError(t, f.Close())
+			}
+		}
+	}()
+
+	// The message does not come back to a, and reaches b and c both directly
+	// and through the other one
+	nodes[0].publish(&FederatedMessage{Topic: []byte("sport")})
+	require.Equal(t, []string{"enta:sport"}, nodes[0].delivered)
+	for _, n := range nodes[1:] {
+		require.Equal(t, []string{"ent" + n.id + ":sport", "ent" + n.id + ":sport"}, n.delivered)
+	}
+
+	// A message that went through a node is not received there again
+	err := nodes[0].feds[0].Receive(&FederatedMessage{Topic: []byte("sport"), Hops: []string{"c", "a"}})
+	require.True(t, errors.Is(err, ErrFederationLoop))
+}
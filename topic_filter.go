@@ -0,0 +1,81 @@
+package cabinet
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Covers reports whether every topic matched by filter b is also matched by
+// filter a, in the MQTT syntax: 'a/#' covers 'a/b/+' but not 'a'.
+func Covers(a, b []byte) (bool, error) {
+	return mqttSyntax.Covers(a, b)
+}
+
+// Overlaps reports whether some topic is matched by both filters a and b, in
+// the MQTT syntax
+func Overlaps(a, b []byte) (bool, error) {
+	return mqttSyntax.Overlaps(a, b)
+}
+
+// Intersect returns the filter matching exactly the topics matched by both
+// filters a and b, in the MQTT syntax and canonical form, or nil when they do
+// not overlap: 'sport/+/score' and '+/tennis/#' intersect as
+// 'sport/tennis/score'.
+func Intersect(a, b []byte) ([]byte, error) {
+	return mqttSyntax.Intersect(a, b)
+}
+
+// FilterEntities are the entities linked to a topic filter
+type FilterEntities struct {
+	Filter   []byte
+	Entities []interface{}
+}
+
+// OverlappingFilters returns the filters of the tree that overlap filter, that
+// is which could receive some of the topics it matches, and their entities:
+// 'sport/+/score' overlaps 'sport/#' and '+/tennis/score'. Filters are in
+// canonical form and sorted by level.
+func (tr *TTree) OverlappingFilters(filter []byte) ([]FilterEntities, error) {
+	if tr.syntax.MultiWildcardAnywhere || tr.syntax.patterned() {
+		return nil, fmt.Errorf("topicTree/OverlappingFilters: %w", ErrUnsupportedSyntax)
+	}
+	if tr.normalizer != nil {
+		filter = tr.normalizer(nil, filter)
+	}
+	levels, err := tr.syntax.levels(filter)
+	if err != nil {
+		return nil, fmt.Errorf("topicTree/OverlappingFilters: %w", err)
+	}
+
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+
+	var overlapping []FilterEntities
+	tr.root.walkOverlaps(tr.syntax, levels, make([]byte, 0, 64), func(filter []byte, entities []interface{}) {
+		overlapping = append(overlapping, FilterEntities{
+			Filter:   append([]byte(nil), filter...),
+			Entities: append([]interface{}(nil), entities...),
+		})
+	})
+	sort.Slice(overlapping, func(i, j int) bool {
+		return tr.syntax.lessFilter(overlapping[i].Filter, overlapping[j].Filter)
+	})
+	return overlapping, nil
+}
+
+// lessFilter orders filters by level, a filter before the longer ones it
+// starts with
+func (sx *Syntax) lessFilter(a, b []byte) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch {
+		case a[i] == b[i]:
+		case a[i] == sx.Separator:
+			return true
+		case b[i] == sx.Separator:
+			return false
+		default:
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
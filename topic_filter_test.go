@@ -0,0 +1,117 @@
+package cabinet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestFilterAlgebra(t *testing.T) {
+	for _, c := range []struct {
+		a, b      string
+		covers    bool
+		intersect string // empty when not overlapping
+	}{
+		{"a/#", "a/b/+", true, "a/b/+"},
+		{"a/#", "a/b", true, "a/b"},
+		{"a/#", "a", false, ""},
+		{"a/#", "a/#", true, "a/#"},
+		{"+/#", "a/#", true, "a/#"},
+		{"a/+", "a/#", false, "a/+"},
+		{"a/+", "a/b", true, "a/b"},
+		{"a/+", "a/+", true, "a/+"},
+		{"a/b", "a/+", false, "a/b"},
+		{"a/b", "a/c", false, ""},
+		{"#", "a/b/c", true, "a/b/c"},
+		{"+", "a/b", false, ""},
+		{"/a", "+/a", true, "+/a"},
+		{"sport/+/score", "+/tennis/#", false, "sport/tennis/score"},
+		{"sport/+/score", "sport/tennis", false, ""},
+	} {
+		covers, err := Covers([]byte(c.a), []byte(c.b))
+		require.NoError(t, err)
+		require.Equal(t, c.covers, covers, "%s covers %s", c.a, c.b)
+
+		for _, p := range [][2]string{{c.a, c.b}, {c.b, c.a}} {
+			overlaps, err := Overlaps([]byte(p[0]), []byte(p[1]))
+			require.NoError(t, err)
+			require.Equal(t, c.intersect != "", overlaps, "%s overlaps %s", p[0], p[1])
+
+			filter, err := Intersect([]byte(p[0]), []byte(p[1]))
+			require.NoError(t, err)
+			require.Equal(t, c.intersect, string(filter), "%s intersect %s", p[0], p[1])
+		}
+	}
+
+	_, err := Covers([]byte("a/#/b"), []byte("a"))
+	require.Error(t, err)
+	_, err = Overlaps([]byte("a"), []byte("a+"))
+	require.Error(t, err)
+	_, err = Intersect([]byte("a"), []byte("#a"))
+	require.Error(t, err)
+}
+
+func TestOverlappingFilters(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	stored := []string{"sport/#", "sport", "+/tennis/score", "sport/tennis/score", "sport/+/score/#",
+		"sport/golf/score", "news/tennis/score", "#", "+", "+/+", "sport/tennis/+/x"}
+	for i, filter := range stored {
+		require.NoError(t, tt.EntityLink([]byte(filter), i))
+	}
+	require.NoError(t, tt.EntityLink([]byte("sport/#"), "ent"))
+
+	filters := func(overlapping []FilterEntities) []string {
+		var filters []string
+		for _, fe := range overlapping {
+			filters = append(filters, string(fe.Filter))
+		}
+		return filters
+	}
+
+	overlapping, err := tt.OverlappingFilters([]byte("sport/+/score"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"#", "+/tennis/score", "sport/#", "sport/golf/score", "sport/tennis/score"}, filters(overlapping))
+	require.Equal(t, []interface{}{0, "ent"}, overlapping[2].Entities)
+
+	// The walk agrees with checking every filter of the tree
+	for _, query := range []string{"sport/+/score", "#", "+", "sport/#", "+/tennis/#", "sport", "x/y", "+/+/+/+",
+		"sport/tennis/score", "news/tennis/score/x", "sport/tennis/score/x"} {
+		overlapping, err := tt.OverlappingFilters([]byte(query))
+		require.NoError(t, err)
+
+		var want []string
+		links, _ := tt.links()
+		for _, l := range links {
+			ok, err := Overlaps([]byte(query), l.filter)
+			require.NoError(t, err)
+			if ok && (len(want) == 0 || want[len(want)-1] != string(l.filter)) {
+				want = append(want, string(l.filter))
+			}
+		}
+		require.Equal(t, want, filters(overlapping), query)
+	}
+
+	_, err = tt.OverlappingFilters([]byte("sport/#/score"))
+	require.Error(t, err)
+
+	// Named parameters of the tree overlap literal levels
+	params := *MQTT
+	params.Params = true
+	pt := NewTopicTree(WithSyntax(&params))
+	defer func() {
+		require.NoError(t, pt.Close())
+	}()
+	for _, filter := range []string{"weather/{city}/temp", "weather/paris/+", "weather/+/hum", "#"} {
+		require.NoError(t, pt.EntityLink([]byte(filter), "ent"))
+	}
+	overlapping, err = pt.OverlappingFilters([]byte("weather/paris/temp"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"#", "weather/paris/+", "weather/{city}/temp"}, filters(overlapping))
+}
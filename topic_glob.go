@@ -0,0 +1,41 @@
+package cabinet
+
+import (
+	"path"
+	"strings"
+)
+
+// With the Globs syntax option, a level of a filter holding any of the
+// characters '*', '?', '[' or '\' is a glob pattern matching single levels, as
+// path.Match does: 'sensors/temp*/value' matches 'sensors/temp1/value', and
+// 'logs/*.err' matches 'logs/db.err'. A lone single level wildcard is still
+// one, even when it is '*'. Glob levels are kept apart from the other children
+// of a node, and only tried at the nodes having some, so that the exact and
+// wildcard levels are looked up as fast as without globs.
+
+// globChars are the characters making a level a glob pattern
+const globChars = `*?[\`
+
+// isGlobChar reports whether a character makes a level a glob pattern
+func isGlobChar(c byte) bool {
+	return strings.IndexByte(globChars, c) >= 0
+}
+
+// isGlob reports whether a filter level is a glob pattern
+func (sx *Syntax) isGlob(level string) bool {
+	return sx.Globs && !sx.isMWC(level) && !sx.isSWC(level) && !sx.isRegexp(level) && strings.ContainsAny(level, globChars)
+}
+
+// validGlob returns a *TopicError when a glob level is malformed
+func validGlob(level string) error {
+	if _, err := path.Match(level, ""); err != nil {
+		return &TopicError{Level: level, Err: err}
+	}
+	return nil
+}
+
+// matchGlob reports whether a glob level matches a topic level
+func matchGlob(pattern, level string) bool {
+	ok, _ := path.Match(pattern, level)
+	return ok
+}
@@ -0,0 +1,124 @@
+package cabinet
+
+import (
+	"errors"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestGlobMatch(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	mqtt := *MQTT
+	mqtt.Globs = true
+	tt := NewTopicTree(WithSyntax(&mqtt))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	filters := []string{"sensors/temp*/value", "sensors/+/value", "sensors/temp1/value", "logs/*.err", "logs/#", "logs/app?.log", "logs/[ab]*/x"}
+	for _, f := range filters {
+		require.NoError(t, tt.EntityLink([]byte(f), f))
+	}
+
+	entities := make([]interface{}, 0, len(filters))
+	for topic, want := range map[string][]interface{}{
+		"sensors/temp1/value":  {"sensors/temp*/value", "sensors/+/value", "sensors/temp1/value"},
+		"sensors/temp/value":   {"sensors/temp*/value", "sensors/+/value"},
+		"sensors/humid/value":  {"sensors/+/value"},
+		"sensors/temp1/x":      nil,
+		"logs/db.err":          {"logs/*.err", "logs/#"},
+		"logs/db.err.gz":       {"logs/#"},
+		"logs/app1.log":        {"logs/#", "logs/app?.log"},
+		"logs/app12.log":       {"logs/#"},
+		"logs/b1/x":            {"logs/#", "logs/[ab]*/x"},
+		"logs/c1/x":            {"logs/#"},
+		"sensors/temp*/value":  {"sensors/temp*/value", "sensors/+/value"},
+		"sensors/temp/a/value": nil,
+	} {
+		require.NoError(t, tt.LinkedEntities([]byte(topic), &entities))
+		require.ElementsMatch(t, want, entities, topic)
+	}
+
+	// The levels matched by globs are captured
+	captures := make([]CaptureMatch, 0, 4)
+	require.NoError(t, tt.LinkedCaptures([]byte("sensors/temp2/value"), &captures))
+	require.Len(t, captures, 2)
+	for _, c := range captures {
+		require.Equal(t, [][]byte{[]byte("temp2")}, c.Levels)
+	}
+
+	// Globs are listed and unlinked as linked
+	links, _ := tt.links()
+	require.Len(t, links, len(filters))
+	require.Error(t, tt.EntityUnLink([]byte("logs/*.log"), "logs/*.err"))
+	require.NoError(t, tt.EntityUnLink([]byte("logs/*.err"), "logs/*.err"))
+	require.NoError(t, tt.LinkedEntities([]byte("logs/db.err"), &entities))
+	require.ElementsMatch(t, []interface{}{"logs/#"}, entities)
+
+	// Matching does not allocate once warm
+	topic := []byte("sensors/temp1/value")
+	if !raceEnabled {
+		allocs := testing.AllocsPerRun(100, func() {
+			require.NoError(t, tt.LinkedEntities(topic, &entities))
+		})
+		require.Equal(t, 0.0, allocs)
+	}
+
+	// Malformed globs are rejected before any node is added
+	st := tt.Stats()
+	err := tt.EntityLink([]byte("logs/[a/x"), "bad")
+	require.True(t, errors.Is(err, path.ErrBadPattern))
+	var terr *TopicError
+	require.True(t, errors.As(err, &terr))
+	require.Equal(t, "[a", terr.Level)
+	require.True(t, errors.Is(mqtt.ValidateFilter([]byte("p/q/[a")), path.ErrBadPattern))
+	require.True(t, errors.Is(tt.EntityLink([]byte("p/q/[a"), "bad"), path.ErrBadPattern))
+	require.Equal(t, st, tt.Stats())
+	st.Bytes = 0
+	require.Equal(t, st, walkStats(tt))
+	require.Error(t, tt.EntityLink([]byte("logs/a+/x"), "bad"))
+
+	_, err = tt.OverlappingFilters([]byte("logs/#"))
+	require.True(t, errors.Is(err, ErrUnsupportedSyntax))
+	_, err = mqtt.Covers([]byte("logs/#"), []byte("logs/*.err"))
+	require.True(t, errors.Is(err, ErrUnsupportedSyntax))
+}
+
+func TestGlobSyntax(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// The single level wildcard of NATS and AMQP is a glob character too
+	for _, sx := range []Syntax{*NATS, *AMQP} {
+		sx.Globs = true
+		tt := NewTopicTree(WithSyntax(&sx))
+
+		for _, f := range []string{"logs.*.err", "logs.*err", "logs.db*"} {
+			require.NoError(t, tt.EntityLink([]byte(f), f))
+		}
+
+		entities := make([]interface{}, 0, 3)
+		require.NoError(t, tt.LinkedEntities([]byte("logs.dberr.err"), &entities))
+		require.ElementsMatch(t, []interface{}{"logs.*.err"}, entities)
+		require.NoError(t, tt.LinkedEntities([]byte("logs.dberr"), &entities))
+		require.ElementsMatch(t, []interface{}{"logs.*err", "logs.db*"}, entities)
+
+		require.NoError(t, tt.Close())
+	}
+
+	// Glob characters are regular ones without the option
+	tt := NewTopicTree()
+	require.NoError(t, tt.EntityLink([]byte("logs/*.err"), "glob"))
+	entities := make([]interface{}, 0, 1)
+	require.NoError(t, tt.LinkedEntities([]byte("logs/db.err"), &entities))
+	require.Empty(t, entities)
+	require.NoError(t, tt.LinkedEntities([]byte("logs/*.err"), &entities))
+	require.Equal(t, []interface{}{"glob"}, entities)
+	require.NoError(t, tt.Close())
+
+	_, _, err := NATS.nextLevel([]byte("logs*"))
+	require.Error(t, err)
+}
@@ -1,25 +1,51 @@
 package cabinet
 
 import (
+	"bytes"
 	"fmt"
-	"regexp"
-	"strings"
 )
 
-const _GroupTopicRegexp = `^\$share/([0-9a-zA-Z_-]+)/(.*)$`
+func getGroupNameFromTopic(topic []byte) ([]byte, []byte, bool, error) {
+	group, filter, shared, err := mqttSyntax.splitShare(topic)
+	if err != nil {
+		return []byte(""), []byte(""), false, fmt.Errorf("topicGroup/groupNameFromTopic: %w", err)
+	}
+	if !shared {
+		return []byte(""), topic, false, nil
+	}
+	return group, filter, true, nil
+}
+
+// ShareGroup splits a '$share/{group}/{filter}' topic into the group name and the
+// topic filter. Topics without the '$share/' prefix are returned unchanged.
+func ShareGroup(topic []byte) (group []byte, filter []byte, shared bool, err error) {
+	return getGroupNameFromTopic(topic)
+}
 
-var groupCompile = regexp.MustCompile(_GroupTopicRegexp)
+// splitShare splits a '$share{sep}{group}{sep}{filter}' filter of the syntax
+// into the group name, made of ASCII letters, digits, '_' and '-', and the
+// filter, which must not be empty
+func (sx *Syntax) splitShare(filter []byte) (group, rest []byte, shared bool, err error) {
+	share := []byte{'$', 's', 'h', 'a', 'r', 'e', sx.Separator}
+	if !bytes.HasPrefix(filter, share) {
+		return nil, filter, false, nil
+	}
+	rest = filter[len(share):]
+	i := bytes.IndexByte(rest, sx.Separator)
+	if i <= 0 || i == len(rest)-1 || !validShareGroup(rest[:i]) {
+		return nil, nil, false, &TopicError{Level: string(filter), Err: ErrMalformedShare}
+	}
+	return rest[:i], rest[i+1:], true, nil
+}
 
-func getGroupNameFromTopic(topic []byte) ([]byte, []byte, bool, error) {
-	if strings.HasPrefix(string(topic), "$share/") {
-		substr := groupCompile.FindStringSubmatch(string(topic))
-		if len(substr) != 3 {
-			return []byte(""), []byte(""), false, fmt.Errorf("topicGroup/groupNameFromTopic: string match found error => [size %d != 3] ", len(substr))
+// validShareGroup reports whether group is a valid share group name
+func validShareGroup(group []byte) bool {
+	for _, c := range group {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '_', c == '-':
+		default:
+			return false
 		}
-		groupName := substr[1]
-		topic := substr[2]
-		return []byte(groupName), []byte(topic), true, nil
-	} else {
-		return []byte(""), topic, false, nil
 	}
+	return true
 }
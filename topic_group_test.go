@@ -63,6 +63,8 @@ func TestTopicGroupShareFailure(t *testing.T) {
 		[]byte("$share/-"),
 		[]byte("$share/+/tennis/#"),
 		[]byte("$share/finance"),
+		[]byte("$share/gr.up/tennis/#"),
+		[]byte("$share/sport/"),
 	}
 	for _, topic := range topics {
 		gn, tp, share, err := getGroupNameFromTopic(topic)
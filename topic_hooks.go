@@ -0,0 +1,78 @@
+package cabinet
+
+// Hooks are called after the mutations of a tree, outside its lock and in the
+// order of the mutations. They may read the tree, but must not change it. The
+// filter is the topic given to EntityLink or EntityUnLink in its canonical
+// form, with the levels the tree stores it under: '/a' is passed as '+/a'.
+// Restoring a snapshot or a write-ahead log does not run them.
+type Hooks struct {
+	// OnFilterAdded is called when a filter gains its first entity
+	OnFilterAdded func(filter []byte)
+
+	// OnFilterRemoved is called when a filter loses its last entity
+	OnFilterRemoved func(filter []byte)
+
+	// OnLink is called for each entity linked, not when already linked
+	OnLink func(filter []byte, entity interface{})
+
+	// OnUnLink is called for each entity unlinked
+	OnUnLink func(filter []byte, entity interface{})
+}
+
+func (h *Hooks) set() bool {
+	return h.OnFilterAdded != nil || h.OnFilterRemoved != nil || h.OnLink != nil || h.OnUnLink != nil
+}
+
+// WithHooks calls the hooks after each mutation of the tree, after the ones
+// of the previous options
+func WithHooks(h Hooks) TreeOption {
+	return func(tr *TTree) {
+		if h.set() {
+			tr.hooks = append(tr.hooks, h)
+		}
+	}
+}
+
+// runHooks calls the hooks for the mutation numbered seq, once those of the
+// previous mutations returned
+func (tr *TTree) runHooks(seq uint64, filter []byte, entity interface{}, op *nodeOp) {
+	if len(tr.hooks) == 0 {
+		return
+	}
+
+	tr.hmu.Lock()
+	defer tr.hmu.Unlock()
+
+	for tr.hseq != seq-1 {
+		tr.hcond.Wait()
+	}
+	defer tr.hcond.Broadcast()
+	tr.hseq = seq
+
+	if tr.normalizer != nil {
+		filter = tr.normalizer(nil, filter)
+	}
+	filter, _ = tr.syntax.canonical(filter)
+	for i := range tr.hooks {
+		tr.hooks[i].run(filter, entity, op)
+	}
+}
+
+func (h *Hooks) run(filter []byte, entity interface{}, op *nodeOp) {
+	if op.added {
+		if op.first && h.OnFilterAdded != nil {
+			h.OnFilterAdded(filter)
+		}
+		if h.OnLink != nil {
+			h.OnLink(filter, entity)
+		}
+	}
+	if h.OnUnLink != nil {
+		for _, e := range op.removed {
+			h.OnUnLink(filter, e)
+		}
+	}
+	if op.last && h.OnFilterRemoved != nil {
+		h.OnFilterRemoved(filter)
+	}
+}
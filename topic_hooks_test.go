@@ -0,0 +1,124 @@
+package cabinet
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestHooks(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var (
+		events []string
+		tt     *TTree
+	)
+	tt = NewTopicTree(WithHooks(Hooks{
+		OnFilterAdded: func(filter []byte) {
+			events = append(events, "added "+string(filter))
+		},
+		OnFilterRemoved: func(filter []byte) {
+			events = append(events, "removed "+string(filter))
+		},
+		OnLink: func(filter []byte, entity interface{}) {
+			// Hooks run outside the lock, so they may read the tree
+			entities := make([]interface{}, 0, 2)
+			require.NoError(t, tt.LinkedEntities([]byte("sport/tennis"), &entities))
+			events = append(events, fmt.Sprintf("link %s %v %d", filter, entity, len(entities)))
+		},
+		OnUnLink: func(filter []byte, entity interface{}) {
+			events = append(events, fmt.Sprintf("unlink %s %v", filter, entity))
+		},
+	}))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	require.NoError(t, tt.EntityLink([]byte("sport/+"), "ent1"))
+	require.NoError(t, tt.EntityLink([]byte("sport/+"), "ent2"))
+	require.NoError(t, tt.EntityLink([]byte("sport/+"), "ent2"))
+	require.Error(t, tt.EntityLink([]byte("sport/#/x"), "ent1"))
+	require.NoError(t, tt.EntityUnLink([]byte("sport/+"), "ent1"))
+	require.Error(t, tt.EntityUnLink([]byte("sport/+"), "ent1"))
+	require.NoError(t, tt.EntityLink([]byte("sport/#"), "ent3"))
+	require.NoError(t, tt.EntityUnLink([]byte("sport/+"), nil))
+	require.NoError(t, tt.EntityUnLink([]byte("sport/#"), "ent3"))
+
+	require.Equal(t, []string{
+		"added sport/+",
+		"link sport/+ ent1 1",
+		"link sport/+ ent2 2",
+		"unlink sport/+ ent1",
+		"added sport/#",
+		"link sport/# ent3 2",
+		"unlink sport/+ ent2",
+		"removed sport/+",
+		"unlink sport/# ent3",
+		"removed sport/#",
+	}, events)
+}
+
+func TestHooksOrder(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// The hooks run on the goroutines of the mutations, so they record the
+	// filters out of order to be checked by the test goroutine
+	var (
+		mu        sync.Mutex
+		count     = make(map[string]int)
+		disorders []string
+	)
+	tt := NewTopicTree(WithHooks(Hooks{
+		OnFilterAdded: func(filter []byte) {
+			mu.Lock()
+			if count[string(filter)]++; count[string(filter)] != 1 {
+				disorders = append(disorders, "added "+string(filter))
+			}
+			mu.Unlock()
+		},
+		OnFilterRemoved: func(filter []byte) {
+			mu.Lock()
+			if count[string(filter)]--; count[string(filter)] != 0 {
+				disorders = append(disorders, "removed "+string(filter))
+			}
+			mu.Unlock()
+		},
+	}))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	// Concurrent mutations of the same filter see their hooks in order
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				filter := []byte(fmt.Sprintf("sport/%d", j%3))
+				if err := tt.EntityLink(filter, i); err != nil {
+					errs <- err
+					return
+				}
+				if err := tt.EntityUnLink(filter, i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Empty(t, disorders)
+	for _, n := range count {
+		require.Equal(t, 0, n)
+	}
+}
@@ -0,0 +1,137 @@
+package cabinet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrLimitExceeded is returned, in a *LimitError, when an operation would take
+// the tree beyond its limits
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// Limits bounds the size of a tree, so that a client cannot exhaust its memory
+// with huge topics or filters, or with a flood of links. A zero limit is no
+// limit, beyond MaxTopicLength and MaxTopicLevels.
+type Limits struct {
+	// MaxLevels and MaxLength bound the number of levels and the length in
+	// bytes of the filters linked and the topics matched
+	MaxLevels int
+	MaxLength int
+
+	// MaxLinksPerEntity bounds the number of filters an entity is linked to.
+	// Only comparable entities are counted.
+	MaxLinksPerEntity int
+
+	// MaxNodes bounds the number of nodes of the tree, one for each level of
+	// the distinct filters it holds
+	MaxNodes int
+
+	// MaxWildcardFilters bounds the number of distinct filters with wildcards,
+	// which every topic matched may have to be compared with
+	MaxWildcardFilters int
+}
+
+// LimitError is the error of an operation exceeding a limit. It is
+// ErrLimitExceeded, and also ErrTopicTooDeep or ErrTopicTooLong for the
+// limits of topics.
+type LimitError struct {
+	Limit string // the name of the field of Limits
+	Max   int
+	Err   error
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s of %d exceeded", e.Limit, e.Max)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// WithLimits makes the tree enforce l in EntityLink and in the matching of
+// topics. Links restored from a snapshot or a write-ahead log are not limited.
+func WithLimits(l Limits) TreeOption {
+	return func(tr *TTree) {
+		tr.limits = l
+	}
+}
+
+// checkTopic returns a *LimitError when a topic to match is too long or deep
+func (tr *TTree) checkTopic(topic []byte) error {
+	l := &tr.limits
+	if l.MaxLength > 0 && len(topic) > l.MaxLength {
+		return &LimitError{Limit: "MaxLength", Max: l.MaxLength, Err: ErrTopicTooLong}
+	}
+	if l.MaxLevels > 0 && bytes.Count(topic, tr.syntax.sep())+1 > l.MaxLevels {
+		return &LimitError{Limit: "MaxLevels", Max: l.MaxLevels, Err: ErrTopicTooDeep}
+	}
+	return nil
+}
+
+// checkLink returns a *LimitError when linking entity to a valid filter would
+// exceed a limit
+func (tr *TTree) checkLink(filter []byte, entity interface{}) error {
+	l := &tr.limits
+	if *l == (Limits{}) {
+		return nil
+	}
+	if err := tr.checkTopic(filter); err != nil {
+		return err
+	}
+	if l.MaxNodes == 0 && l.MaxLinksPerEntity == 0 && l.MaxWildcardFilters == 0 {
+		return nil
+	}
+
+	if tr.normalizer != nil {
+		filter = tr.normalizer(nil, filter)
+	}
+	missing, tn, wildcard := tr.root.probe(tr.syntax, filter)
+	if l.MaxNodes > 0 && tr.counts.nodes+missing > l.MaxNodes {
+		return &LimitError{Limit: "MaxNodes", Max: l.MaxNodes}
+	}
+	if tn != nil && tn.linked(entity) {
+		return nil
+	}
+	if l.MaxLinksPerEntity > 0 && isComparable(reflect.ValueOf(entity)) && tr.counts.entities[entity] >= l.MaxLinksPerEntity {
+		return &LimitError{Limit: "MaxLinksPerEntity", Max: l.MaxLinksPerEntity}
+	}
+	if l.MaxWildcardFilters > 0 && wildcard && (tn == nil || len(tn.entities) == 0) && tr.counts.wildcards >= l.MaxWildcardFilters {
+		return &LimitError{Limit: "MaxWildcardFilters", Max: l.MaxWildcardFilters}
+	}
+	return nil
+}
+
+// probe walks the existing nodes of a valid filter, and returns the number of
+// the missing ones, its node when none is, and whether it has wildcards
+func (tn *tNode) probe(sx *Syntax, filter []byte) (missing int, end *tNode, wildcard bool) {
+	end = tn
+	for len(filter) > 0 {
+		ntl, rem, _ := sx.nextLevel(filter)
+		level := string(ntl)
+		wildcard = wildcard || sx.isWildcard(level)
+		if end != nil {
+			end = end.children(sx, level, false)[level]
+		}
+		if end == nil {
+			missing++
+		}
+		filter = rem
+	}
+	return missing, end, wildcard
+}
+
+// linked reports whether entity is linked to the node
+func (tn *tNode) linked(entity interface{}) bool {
+	for _, e := range tn.entities {
+		if equal(e, entity) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package cabinet
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestLimits(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree(WithLimits(Limits{MaxLevels: 4, MaxLength: 32, MaxLinksPerEntity: 3, MaxNodes: 8, MaxWildcardFilters: 2}))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	limit := func(err error, name string) {
+		t.Helper()
+		var lerr *LimitError
+		require.True(t, errors.Is(err, ErrLimitExceeded), "%v", err)
+		require.True(t, errors.As(err, &lerr))
+		require.Equal(t, name, lerr.Limit)
+	}
+
+	// Topics
+	err := tt.EntityLink([]byte("a/b/c/d/e"), "x")
+	limit(err, "MaxLevels")
+	require.True(t, errors.Is(err, ErrTopicTooDeep))
+	err = tt.EntityLink([]byte(strings.Repeat("a", 33)), "x")
+	limit(err, "MaxLength")
+	require.True(t, errors.Is(err, ErrTopicTooLong))
+
+	entities := make([]interface{}, 0, 4)
+	captures := make([]CaptureMatch, 0, 4)
+	params := make([]ParamMatch, 0, 4)
+	for _, tc := range []struct {
+		topic, limit string
+	}{
+		{"a/b/c/d/e", "MaxLevels"},
+		{strings.Repeat("a", 33), "MaxLength"},
+	} {
+		limit(tt.LinkedEntities([]byte(tc.topic), &entities), tc.limit)
+		limit(tt.LinkedCaptures([]byte(tc.topic), &captures), tc.limit)
+		limit(tt.LinkedParams([]byte(tc.topic), &params), tc.limit)
+	}
+
+	// Links per entity, relinking being no new link
+	for _, f := range []string{"a/b", "a/c", "a/d", "a/b"} {
+		require.NoError(t, tt.EntityLink([]byte(f), "x"))
+	}
+	limit(tt.EntityLink([]byte("a/e"), "x"), "MaxLinksPerEntity")
+	require.NoError(t, tt.EntityUnLink([]byte("a/d"), "x"))
+	require.NoError(t, tt.EntityLink([]byte("a/e"), "x"))
+
+	// Wildcard filters, linking more entities to one being no new filter
+	require.NoError(t, tt.EntityLink([]byte("a/+"), "y"))
+	require.NoError(t, tt.EntityLink([]byte("a/+"), "z"))
+	require.NoError(t, tt.EntityLink([]byte("#"), "y"))
+	limit(tt.EntityLink([]byte("+/b"), "z"), "MaxWildcardFilters")
+	require.NoError(t, tt.EntityUnLink([]byte("#"), "y"))
+	require.NoError(t, tt.EntityLink([]byte("+/b"), "z"))
+
+	// Nodes: a, a/b, a/c, a/e, a/+, + and +/b hold 7 of 8
+	require.Equal(t, 7, tt.counts.nodes)
+	limit(tt.EntityLink([]byte("b/c"), "w"), "MaxNodes")
+	require.NoError(t, tt.EntityLink([]byte("b"), "w"))
+
+	// Nothing was linked by the failed links
+	require.NoError(t, tt.LinkedEntities([]byte("b/c"), &entities))
+	require.Empty(t, entities)
+	require.NoError(t, tt.LinkedEntities([]byte("b/b"), &entities))
+	require.ElementsMatch(t, []interface{}{"z"}, entities)
+
+	// Counts are kept by unlinking
+	require.NoError(t, tt.EntityUnLink([]byte("a/+"), "y"))
+	require.NoError(t, tt.EntityUnLink([]byte("a/+"), "z"))
+	require.Equal(t, 7, tt.counts.nodes)
+	require.Equal(t, 1, tt.counts.wildcards)
+	require.Equal(t, map[interface{}]int{"x": 3, "z": 1, "w": 1}, tt.counts.entities)
+}
+
+func TestLimitsEntities(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree(WithLimits(Limits{MaxLinksPerEntity: 1}))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	// Entities which cannot be counted are not limited
+	type shared struct {
+		group  string
+		entity interface{}
+	}
+	fn := func() {}
+	for _, f := range []string{"a", "b"} {
+		require.NoError(t, tt.EntityLink([]byte(f), shared{group: "g", entity: []int{1}}))
+		require.NoError(t, tt.EntityLink([]byte(f), fn))
+	}
+	require.NoError(t, tt.EntityLink([]byte("a"), shared{group: "g", entity: 1}))
+	err := tt.EntityLink([]byte("b"), shared{group: "g", entity: 1})
+	require.True(t, errors.Is(err, ErrLimitExceeded))
+}
@@ -0,0 +1,111 @@
+package cabinet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Namespace is a view of a tree scoped to a mountpoint. Topics and filters
+// given to it are prefixed with the levels of the mountpoint, so that even
+// '#' only reaches the links of the namespace. The hooks, write-ahead log and
+// watchers of the tree see the prefixed topics.
+type Namespace struct {
+	tr     *TTree
+	prefix []byte // the mountpoint followed by the separator
+}
+
+// Namespace returns the view of the tree mounted at prefix, made of one or
+// more levels without wildcards
+func (tr *TTree) Namespace(prefix []byte) (*Namespace, error) {
+	if err := validMountpoint(tr.syntax, prefix); err != nil {
+		return nil, fmt.Errorf("topicTree/Namespace: %s: %w", prefix, err)
+	}
+	return &Namespace{tr: tr, prefix: append(append([]byte(nil), prefix...), tr.syntax.Separator)}, nil
+}
+
+// Namespace returns the view of the tree mounted at prefix within ns
+func (ns *Namespace) Namespace(prefix []byte) (*Namespace, error) {
+	if err := validMountpoint(ns.tr.syntax, prefix); err != nil {
+		return nil, fmt.Errorf("topicNamespace/Namespace: %s: %w", prefix, err)
+	}
+	scoped, _ := ns.scope(prefix)
+	return &Namespace{tr: ns.tr, prefix: append(scoped, ns.tr.syntax.Separator)}, nil
+}
+
+// Prefix returns the mountpoint of the namespace
+func (ns *Namespace) Prefix() []byte {
+	return append([]byte(nil), ns.prefix[:len(ns.prefix)-1]...)
+}
+
+func (ns *Namespace) EntityLink(topic []byte, entity interface{}) error {
+	scoped, err := ns.scope(topic)
+	if err != nil {
+		return fmt.Errorf("topicNamespace/EntityLink: %w", err)
+	}
+	return ns.tr.EntityLink(scoped, entity)
+}
+
+func (ns *Namespace) EntityUnLink(topic []byte, entity interface{}) error {
+	scoped, err := ns.scope(topic)
+	if err != nil {
+		return fmt.Errorf("topicNamespace/EntityUnLink: %w", err)
+	}
+	return ns.tr.EntityUnLink(scoped, entity)
+}
+
+// Returned values will be invalidated by the next LinkedEntities call
+func (ns *Namespace) LinkedEntities(topic []byte, entities *[]interface{}) error {
+	scoped, err := ns.scope(topic)
+	if err != nil {
+		return fmt.Errorf("topicNamespace/LinkedEntities: %w", err)
+	}
+	return ns.tr.LinkedEntities(scoped, entities)
+}
+
+// LinkedCaptures is the LinkedCaptures of the tree within the namespace. The
+// levels captured are never those of the mountpoint, which has no wildcards.
+func (ns *Namespace) LinkedCaptures(topic []byte, matches *[]CaptureMatch) error {
+	scoped, err := ns.scope(topic)
+	if err != nil {
+		return fmt.Errorf("topicNamespace/LinkedCaptures: %w", err)
+	}
+	return ns.tr.LinkedCaptures(scoped, matches)
+}
+
+// LinkedParams is the LinkedParams of the tree within the namespace
+func (ns *Namespace) LinkedParams(topic []byte, matches *[]ParamMatch) error {
+	scoped, err := ns.scope(topic)
+	if err != nil {
+		return fmt.Errorf("topicNamespace/LinkedParams: %w", err)
+	}
+	return ns.tr.LinkedParams(scoped, matches)
+}
+
+// scope returns the topic prefixed with the mountpoint. An empty topic would
+// be the mountpoint itself, outside the namespace.
+func (ns *Namespace) scope(topic []byte) ([]byte, error) {
+	if len(topic) == 0 {
+		return nil, &TopicError{Err: ErrEmptyTopic}
+	}
+	return append(append(make([]byte, 0, len(ns.prefix)+len(topic)), ns.prefix...), topic...), nil
+}
+
+func validMountpoint(sx *Syntax, prefix []byte) error {
+	if len(prefix) == 0 {
+		return errors.New("empty mountpoint")
+	}
+	if bytes.IndexByte(prefix, sx.SingleWildcard) >= 0 || bytes.IndexByte(prefix, sx.MultiWildcard) >= 0 {
+		return errors.New("wildcards in mountpoint")
+	}
+	if sx.Globs && bytes.ContainsAny(prefix, globChars) {
+		return errors.New("glob in mountpoint")
+	}
+	if bytes.ContainsAny(prefix, "{}") {
+		return errors.New("parameter in mountpoint")
+	}
+	if prefix[0] == sx.Separator || prefix[len(prefix)-1] == sx.Separator || bytes.Contains(prefix, []byte{sx.Separator, sx.Separator}) {
+		return errors.New("empty level in mountpoint")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package cabinet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestNamespace(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	for _, prefix := range []string{"", "a/+", "a/#", "/a", "a/", "a//b", "{tenant}", "a/{b}"} {
+		_, err := tt.Namespace([]byte(prefix))
+		require.Error(t, err, prefix)
+	}
+
+	acme, err := tt.Namespace([]byte("tenants/acme"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("tenants/acme"), acme.Prefix())
+	globex, err := tt.Namespace([]byte("tenants/globex"))
+	require.NoError(t, err)
+
+	require.NoError(t, acme.EntityLink([]byte("#"), "ent1"))
+	require.NoError(t, acme.EntityLink([]byte("sport/+"), "ent2"))
+	require.NoError(t, globex.EntityLink([]byte("#"), "ent3"))
+	require.NoError(t, tt.EntityLink([]byte("tenants/+/sport/tennis"), "ent4"))
+
+	entities := make([]interface{}, 0, 5)
+	require.NoError(t, acme.LinkedEntities([]byte("sport/tennis"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent1", "ent2", "ent4"}, entities)
+	require.NoError(t, globex.LinkedEntities([]byte("sport/golf"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent3"}, entities)
+
+	// Neither wildcards nor empty levels escape the namespace
+	require.NoError(t, tt.LinkedEntities([]byte("tenants"), &entities))
+	require.Empty(t, entities)
+	require.NoError(t, tt.LinkedEntities([]byte("news"), &entities))
+	require.Empty(t, entities)
+	require.NoError(t, acme.LinkedEntities([]byte("/x"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent1"}, entities)
+
+	// Namespaces nest
+	eu, err := acme.Namespace([]byte("eu"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("tenants/acme/eu"), eu.Prefix())
+	require.NoError(t, eu.EntityLink([]byte("+"), "ent5"))
+	require.NoError(t, acme.LinkedEntities([]byte("eu/paris"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent1", "ent5"}, entities)
+
+	require.NoError(t, acme.EntityUnLink([]byte("#"), "ent1"))
+	require.Error(t, globex.EntityUnLink([]byte("sport/+"), "ent2"))
+	require.NoError(t, acme.LinkedEntities([]byte("sport/tennis"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent2", "ent4"}, entities)
+
+	// Empty topics are not the mountpoint
+	for _, err := range []error{
+		acme.EntityLink(nil, "ent6"),
+		acme.EntityUnLink(nil, "ent6"),
+		acme.LinkedEntities(nil, &entities),
+	} {
+		require.True(t, errors.Is(err, ErrEmptyTopic), "%v", err)
+	}
+	require.NoError(t, tt.LinkedEntities([]byte("tenants/acme/"), &entities))
+	require.Empty(t, entities)
+
+	// Captures and parameters are those of the namespace
+	params := *MQTT
+	params.Params = true
+	pt := NewTopicTree(WithSyntax(&params))
+	defer func() {
+		require.NoError(t, pt.Close())
+	}()
+	ns, err := pt.Namespace([]byte("tenants/acme"))
+	require.NoError(t, err)
+	require.NoError(t, ns.EntityLink([]byte("weather/{city}/+"), "ent7"))
+	captures := make([]CaptureMatch, 0, 1)
+	require.NoError(t, ns.LinkedCaptures([]byte("weather/paris/temp"), &captures))
+	require.Len(t, captures, 1)
+	require.Equal(t, [][]byte{[]byte("paris"), []byte("temp")}, captures[0].Levels)
+	matches := make([]ParamMatch, 0, 1)
+	require.NoError(t, ns.LinkedParams([]byte("weather/paris/temp"), &matches))
+	require.Equal(t, []ParamMatch{{Entity: "ent7", Params: map[string]string{"city": "paris"}}}, matches)
+	require.True(t, errors.Is(ns.LinkedCaptures(nil, &captures), ErrEmptyTopic))
+	require.True(t, errors.Is(ns.LinkedParams(nil, &matches), ErrEmptyTopic))
+
+	// Namespaces are linkers, for the session store to use
+	var _ Linker = acme
+}
@@ -1,18 +1,21 @@
 package cabinet
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
+	"regexp"
+	"sort"
 )
 
 const (
-	// MWC is the multi-level wildcard
+	// MWC is the multi-level wildcard of MQTT
 	MWC = "#"
 
-	// SWC is the single level wildcard
+	// SWC is the single level wildcard of MQTT
 	SWC = "+"
 
-	// SEP is the topic level separator
+	// SEP is the topic level separator of MQTT
 	SEP = "/"
 
 	// SYS is the starting character of the system level topics
@@ -22,6 +25,9 @@ const (
 	_WC = "#+"
 )
 
+// ErrNotLinked is returned when unlinking an entity from a topic it is not linked to
+var ErrNotLinked = errors.New("not linked")
+
 const (
 	stateCHR byte = iota // Regular character
 	stateMWC             // Multi-level wildcard
@@ -34,8 +40,20 @@ type tNode struct {
 	// If this is the end of the topic string, the add entity here
 	entities []interface{}
 
+	// and the text of its filter when it is not that of the node, normalized,
+	// or nil when no entity has such a text
+	texts []string
+
 	// Otherwise add the next topic level here
 	nltNodes map[string]*tNode
+
+	// or here for a glob level, or a regular expression one, the maps being
+	// created with their first level
+	globs   map[string]*tNode
+	regexps map[string]*tNode
+
+	// The expression of the level of a regular expression node
+	re *regexp.Regexp
 }
 
 func newTopicNode() *tNode {
@@ -44,6 +62,7 @@ func newTopicNode() *tNode {
 
 func (tn *tNode) close() error {
 	tn.entities = tn.entities[0:0]
+	tn.texts = tn.texts[0:0]
 	for level, nltn := range tn.nltNodes {
 		delete(tn.nltNodes, level)
 		err := nltn.close()
@@ -51,7 +70,16 @@ func (tn *tNode) close() error {
 			return fmt.Errorf("%s, found in next level: '%s'", err, level)
 		}
 	}
-	if len(tn.entities) == 0 && len(tn.nltNodes) == 0 {
+	for _, children := range [...]map[string]*tNode{tn.globs, tn.regexps} {
+		for level, nltn := range children {
+			delete(children, level)
+			err := nltn.close()
+			if err != nil {
+				return fmt.Errorf("%s, found in next level: '%s'", err, level)
+			}
+		}
+	}
+	if tn.empty() {
 		topicNodePool.release(tn)
 		return nil
 	} else {
@@ -59,7 +87,62 @@ func (tn *tNode) close() error {
 	}
 }
 
-func (tn *tNode) insertEntity(topic []byte, entity interface{}) error {
+// empty reports whether a node has neither entities nor next level nodes
+func (tn *tNode) empty() bool {
+	return len(tn.entities) == 0 && len(tn.nltNodes) == 0 && len(tn.globs) == 0 && len(tn.regexps) == 0
+}
+
+// children returns the index of the children of tn a level belongs to, and
+// creates it when asked to
+func (tn *tNode) children(sx *Syntax, level string, create bool) map[string]*tNode {
+	switch {
+	case sx.isRegexp(level):
+		if tn.regexps == nil && create {
+			tn.regexps = make(map[string]*tNode)
+		}
+		return tn.regexps
+	case sx.isGlob(level):
+		if tn.globs == nil && create {
+			tn.globs = make(map[string]*tNode)
+		}
+		return tn.globs
+	}
+	return tn.nltNodes
+}
+
+// newChild returns a new node for a level, compiling its regular expression,
+// validated with the filter, once for all the matches
+func newChild(sx *Syntax, level string) (*tNode, error) {
+	var re *regexp.Regexp
+	switch {
+	case sx.isRegexp(level):
+		var err error
+		if re, err = compileRegexp(level); err != nil {
+			return nil, err
+		}
+	}
+	tn := newTopicNode()
+	tn.re = re
+	return tn, nil
+}
+
+// nodeOp carries the state of a tree operation through the node recursion,
+// and records what it changed. A nil *nodeOp records nothing.
+type nodeOp struct {
+	added   bool          // the entity was inserted
+	removed []interface{} // the entities removed
+	first   bool          // the topic gained its first entity
+	last    bool          // the topic lost its last entity
+
+	text string // the text of the filter, when linked normalized
+
+	nodes    int  // the nodes created, or released when negative
+	bytes    int  // the memory allocated, or freed when negative
+	depth    int  // the levels of the filter
+	wildcard bool // the filter has wildcards
+}
+
+func (tn *tNode) insertEntity(sx *Syntax, topic []byte, entity interface{}, op *nodeOp) error {
 	// If there's no more topic levels, that means we are at the matching tNode
 	// to insert the body. So let's see if there's such entity,
 	// if so, return. Otherwise insert it.
@@ -71,7 +154,30 @@ func (tn *tNode) insertEntity(topic []byte, entity interface{}) error {
 			}
 		}
 		// Otherwise add.
+		if op != nil {
+			op.added = true
+			op.first = len(tn.entities) == 0
+		}
 		tn.entities = append(tn.entities, entity)
+		if op != nil {
+			op.bytes += linkBytes + len(op.text)
+		}
+		if op != nil && op.text != "" || len(tn.texts) > 0 {
+			for len(tn.texts) < len(tn.entities)-1 {
+				tn.texts = append(tn.texts, "")
+				if op != nil {
+					op.bytes += linkTextBytes
+				}
+			}
+			var text string
+			if op != nil {
+				text = op.text
+			}
+			tn.texts = append(tn.texts, text)
+			if op != nil {
+				op.bytes += linkTextBytes
+			}
+		}
 
 		return nil
 	}
@@ -80,7 +186,7 @@ func (tn *tNode) insertEntity(topic []byte, entity interface{}) error {
 	// recursively call it's insert().
 
 	// ntl = next topic level
-	ntl, rem, err := nextTopicLevel(topic)
+	ntl, rem, err := sx.nextLevel(topic)
 	if err != nil {
 		return err
 	}
@@ -88,23 +194,42 @@ func (tn *tNode) insertEntity(topic []byte, entity interface{}) error {
 	level := string(ntl)
 
 	// Add tNode if it doesn't already exist
-	nltn, ok := tn.nltNodes[level]
+	children := tn.children(sx, level, true)
+	nltn, ok := children[level]
 	if !ok {
-		nltn = newTopicNode()
-		tn.nltNodes[level] = nltn
+		if nltn, err = newChild(sx, level); err != nil {
+			return err
+		}
+		children[level] = nltn
+		if op != nil {
+			op.nodes++
+			op.bytes += nodeBytes + childBytes + len(level)
+		}
+	}
+	if op != nil {
+		op.depth++
+		op.wildcard = op.wildcard || sx.isWildcard(level)
 	}
 
-	return nltn.insertEntity(rem, entity)
+	return nltn.insertEntity(sx, rem, entity, op)
 }
 
 // the entity matches then it's removed
-func (tn *tNode) removeEntity(topic []byte, entity interface{}) error {
+func (tn *tNode) removeEntity(sx *Syntax, topic []byte, entity interface{}, op *nodeOp) error {
 	// If the topic is empty, it means we are at the final matching tNode. If so,
 	// let's find the matching entities and remove them.
 	if len(topic) == 0 {
 		// If entity == nil, then it's signal to remove ALL entities
 		if entity == nil {
+			if op != nil {
+				op.removed = append(op.removed, tn.entities...)
+				op.last = len(tn.entities) > 0
+				for i := range tn.entities {
+					op.bytes -= tn.linkBytes(i)
+				}
+			}
 			tn.entities = tn.entities[0:0]
+			tn.texts = tn.texts[0:0]
 			return nil
 		}
 
@@ -112,18 +237,28 @@ func (tn *tNode) removeEntity(topic []byte, entity interface{}) error {
 		// we just overwrite the slot by shifting all other items up by one.
 		for i := range tn.entities {
 			if equal(tn.entities[i], entity) {
+				if op != nil {
+					op.bytes -= tn.linkBytes(i)
+				}
 				tn.entities = append(tn.entities[:i], tn.entities[i+1:]...)
+				if len(tn.texts) > 0 {
+					tn.texts = append(tn.texts[:i], tn.texts[i+1:]...)
+				}
+				if op != nil {
+					op.removed = append(op.removed, entity)
+					op.last = len(tn.entities) == 0
+				}
 				return nil
 			}
 		}
 
-		return fmt.Errorf("topicNode/remove: No topic found for entity")
+		return fmt.Errorf("topicNode/remove: No topic found for entity: %w", ErrNotLinked)
 	}
 	// Not the last level, so let's find the next level tNode, and recursively
 	// call it's remove().
 
 	// ntl = next topic level
-	ntl, rem, err := nextTopicLevel(topic)
+	ntl, rem, err := sx.nextLevel(topic)
 	if err != nil {
 		return err
 	}
@@ -131,37 +266,143 @@ func (tn *tNode) removeEntity(topic []byte, entity interface{}) error {
 	level := string(ntl)
 
 	// Find the tNode that matches the topic level
-	nltn, ok := tn.nltNodes[level]
+	children := tn.children(sx, level, false)
+	nltn, ok := children[level]
 	if !ok {
-		return fmt.Errorf("topicNode/remove: No topic found")
+		return fmt.Errorf("topicNode/remove: No topic found: %w", ErrNotLinked)
+	}
+	if op != nil {
+		op.depth++
+		op.wildcard = op.wildcard || sx.isWildcard(level)
 	}
 
 	// Remove the entity from the next level tNode
-	if err := nltn.removeEntity(rem, entity); err != nil {
+	if err := nltn.removeEntity(sx, rem, entity, op); err != nil {
 		return err
 	}
 
 	// If there are no more entities and nltNodes to the next level we just visited
 	// let's remove it
-	if len(nltn.entities) == 0 && len(nltn.nltNodes) == 0 {
-		delete(tn.nltNodes, level)
+	if nltn.empty() {
+		delete(children, level)
 		topicNodePool.release(nltn)
+		if op != nil {
+			op.nodes--
+			op.bytes -= nodeBytes + childBytes + len(level)
+		}
 	}
 
 	return nil
 }
 
+// linkBytes returns the approximate memory of the ith link of the node
+func (tn *tNode) linkBytes(i int) int {
+	if i < len(tn.texts) {
+		return linkBytes + linkTextBytes + len(tn.texts[i])
+	}
+	return linkBytes
+}
+
 func (tn *tNode) appendEntities(entities *[]interface{}) {
 	for _, entity := range tn.entities {
 		*entities = append(*entities, entity)
 	}
 }
 
+// walkLinks calls fn with every entity of the subtree and the topic filter it
+// is linked to, as linked when normalized, which is only valid during the call. Levels are visited in
+// order, so that a tree is always walked the same way.
+func (tn *tNode) walkLinks(sx *Syntax, filter []byte, fn func(filter []byte, entity interface{})) {
+	for i, entity := range tn.entities {
+		if i < len(tn.texts) && tn.texts[i] != "" {
+			fn([]byte(tn.texts[i]), entity)
+			continue
+		}
+		fn(filter, entity)
+	}
+
+	levels := make([]string, 0, len(tn.nltNodes)+len(tn.globs)+len(tn.regexps))
+	for _, children := range [...]map[string]*tNode{tn.nltNodes, tn.globs, tn.regexps} {
+		for level := range children {
+			levels = append(levels, level)
+		}
+	}
+	sort.Strings(levels)
+
+	for _, level := range levels {
+		nlf := filter
+		if len(filter) > 0 {
+			nlf = append(nlf, sx.Separator)
+		}
+		nltn, ok := tn.nltNodes[level]
+		if !ok {
+			if nltn, ok = tn.globs[level]; !ok {
+				nltn = tn.regexps[level]
+			}
+		}
+		nltn.walkLinks(sx, append(nlf, level...), fn)
+	}
+}
+
+// walkOverlaps calls fn with the entities of every node of the subtree whose
+// filter overlaps the levels of a filter, and that filter, which is only
+// valid during the call. Nodes are visited in no particular order.
+func (tn *tNode) walkOverlaps(sx *Syntax, levels [][]byte, filter []byte, fn func(filter []byte, entities []interface{})) {
+	if len(levels) == 0 {
+		if len(tn.entities) > 0 {
+			fn(filter, tn.entities)
+		}
+		return
+	}
+
+	q := string(levels[0])
+	if sx.isWildcard(q) || sx.Params {
+		// A wildcard overlaps every level, and so does a named parameter of
+		// the tree, which cannot be looked up
+		for k, nltn := range tn.nltNodes {
+			nltn.walkOverlapsLevel(sx, levels, filter, k, fn)
+		}
+		return
+	}
+
+	// A level overlaps itself and the wildcards only
+	for _, k := range [...]string{q, string(byteLevel(sx.SingleWildcard)), string(byteLevel(sx.MultiWildcard))} {
+		if nltn, ok := tn.nltNodes[k]; ok {
+			nltn.walkOverlapsLevel(sx, levels, filter, k, fn)
+		}
+	}
+}
+
+// walkOverlapsLevel walks the child of a node at level, the levels being those
+// of the filter left at the node
+func (tn *tNode) walkOverlapsLevel(sx *Syntax, levels [][]byte, filter []byte, level string, fn func(filter []byte, entities []interface{})) {
+	nlf := filter
+	if len(filter) > 0 {
+		nlf = append(nlf, sx.Separator)
+	}
+	nlf = append(nlf, level...)
+
+	q := string(levels[0])
+	switch {
+	case sx.isMWC(q):
+		// '#' matches this level and any below
+		if len(tn.entities) > 0 {
+			fn(nlf, tn.entities)
+		}
+		tn.walkOverlaps(sx, levels, nlf, fn)
+	case sx.isMWC(level):
+		// and so does a '#' of the tree, levels being left
+		fn(nlf, tn.entities)
+	case sx.isSWC(q) || level == q || sx.isSWC(level):
+		tn.walkOverlaps(sx, levels[1:], nlf, fn)
+	}
+}
+
 // match() returns all the entities that are link to the topic. Given a topic
 // with no wildcards (publish topic), it returns a list of entities that link
 // to the topic. For each of the level names, it's a match
 // - if there are entities to '#', then all the entities are added to result set
-func (tn *tNode) matchEntities(topic []byte, entities *[]interface{}) error {
+func (tn *tNode) matchEntities(sx *Syntax, topic []byte, entities *[]interface{}) error {
 	// If the topic is empty, it means we are at the final matching tNode. If so,
 	// let's find the entities, and append them to the list.
 	if len(topic) == 0 {
@@ -170,7 +411,7 @@ func (tn *tNode) matchEntities(topic []byte, entities *[]interface{}) error {
 	}
 
 	// ntl = next topic level
-	ntl, rem, err := nextTopicLevel(topic)
+	ntl, rem, err := sx.nextLevel(topic)
 	if err != nil {
 		return err
 	}
@@ -179,69 +420,39 @@ func (tn *tNode) matchEntities(topic []byte, entities *[]interface{}) error {
 
 	for k, nltn := range tn.nltNodes {
 		// If the key is "#", then these entities are added to the result set
-		if k == MWC {
+		if sx.isMWC(k) {
 			nltn.appendEntities(entities)
-		} else if k == SWC || k == level {
-			if err := nltn.matchEntities(rem, entities); err != nil {
+		} else if k == level || sx.isSWC(k) {
+			if err := nltn.matchEntities(sx, rem, entities); err != nil {
 				return err
 			}
 		}
 	}
 
-	return nil
-}
-
-// Returns topic level, remaining topic levels and any errors
-func nextTopicLevel(topic []byte) ([]byte, []byte, error) {
-	s := stateCHR
-
-	for i, c := range topic {
-		switch c {
-		case '/':
-			if s == stateMWC {
-				return nil, nil, fmt.Errorf("topicNode/nextTopicLevel: Multi-level wildcard found in topic and it's not at the last level")
-			}
-
-			if i == 0 {
-				return []byte(SWC), topic[i+1:], nil
-			}
-
-			return topic[:i], topic[i+1:], nil
-
-		case '#':
-			if i != 0 {
-				return nil, nil, fmt.Errorf("topicNode/nextTopicLevel: Wildcard character '#' must occupy entire topic level")
-			}
-
-			s = stateMWC
-
-		case '+':
-			if i != 0 {
-				return nil, nil, fmt.Errorf("topicNode/nextTopicLevel: Wildcard character '+' must occupy entire topic level")
+	value := sx.levelValue(topic, ntl)
+	for k, nltn := range tn.globs {
+		if matchGlob(k, string(value)) {
+			if err := nltn.matchEntities(sx, rem, entities); err != nil {
+				return err
 			}
+		}
+	}
 
-			s = stateSWC
-
-			//case '$':
-			//	if i == 0 {
-			//		return nil, nil, fmt.Errorf("topicNode/nextTopicLevel: Cannot link to $ topics")
-			//	}
-
-			//	s = stateSYS
-
-		default:
-			if s == stateMWC || s == stateSWC {
-				return nil, nil, fmt.Errorf("topicNode/nextTopicLevel: Wildcard characters '#' and '+' must occupy entire topic level")
+	for _, nltn := range tn.regexps {
+		if nltn.re.Match(value) {
+			if err := nltn.matchEntities(sx, rem, entities); err != nil {
+				return err
 			}
-
-			s = stateCHR
 		}
 	}
 
-	// If we got here that means we didn't hit the separator along the way, so the
-	// topic is either empty, or does not contain a separator. Either way, we return
-	// the full topic
-	return topic, nil, nil
+	return nil
+}
+
+// Returns topic level, remaining topic levels and any errors, in the MQTT
+// syntax
+func nextTopicLevel(topic []byte) ([]byte, []byte, error) {
+	return mqttSyntax.nextLevel(topic)
 }
 
 func equal(k1, k2 interface{}) bool {
@@ -253,6 +464,12 @@ func equal(k1, k2 interface{}) bool {
 		return &k1 == &k2
 	}
 
+	// Entities which are not comparable, or hold such values, are never equal
+	// to another one, rather than panicking
+	if !isComparable(reflect.ValueOf(k1)) || !isComparable(reflect.ValueOf(k2)) {
+		return false
+	}
+
 	if k1 == k2 {
 		return true
 	}
@@ -98,7 +98,7 @@ func TestTopicNodeInsert1(t *testing.T) {
 
 	topic := []byte("sport/tennis/player1/#")
 
-	err := n.insertEntity(topic, "ent1")
+	err := n.insertEntity(MQTT, topic, "ent1", nil)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(n.nltNodes))
 	require.Equal(t, 0, len(n.entities))
@@ -136,7 +136,7 @@ func TestTopicNodeInsert2(t *testing.T) {
 
 	topic := []byte("#")
 
-	err := n.insertEntity(topic, "ent1")
+	err := n.insertEntity(MQTT, topic, "ent1", nil)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(n.nltNodes))
 	require.Equal(t, 0, len(n.entities))
@@ -159,7 +159,7 @@ func TestTopicNodeInsert3(t *testing.T) {
 
 	topic := []byte("+/tennis/#")
 
-	err := n.insertEntity(topic, "ent1")
+	err := n.insertEntity(MQTT, topic, "ent1", nil)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(n.nltNodes))
 	require.Equal(t, 0, len(n.entities))
@@ -192,7 +192,7 @@ func TestTopicNodeInsert4(t *testing.T) {
 
 	topic := []byte("/finance")
 
-	err := n.insertEntity(topic, "ent1")
+	err := n.insertEntity(MQTT, topic, "ent1", nil)
 
 	require.NoError(t, err)
 	require.Equal(t, 1, len(n.nltNodes))
@@ -221,8 +221,8 @@ func TestTopicNodeInsertDup(t *testing.T) {
 
 	topic := []byte("/finance")
 
-	err := n.insertEntity(topic, "ent1")
-	err = n.insertEntity(topic, "ent1")
+	err := n.insertEntity(MQTT, topic, "ent1", nil)
+	err = n.insertEntity(MQTT, topic, "ent1", nil)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(n.nltNodes))
 	require.Equal(t, 0, len(n.entities))
@@ -250,8 +250,8 @@ func TestTopicNodeRemove1(t *testing.T) {
 
 	topic := []byte("sport/tennis/player1/#")
 
-	require.NoError(t, n.insertEntity(topic, "ent1"))
-	err := n.removeEntity([]byte("sport/tennis/player1/#"), "ent1")
+	require.NoError(t, n.insertEntity(MQTT, topic, "ent1", nil))
+	err := n.removeEntity(MQTT, []byte("sport/tennis/player1/#"), "ent1", nil)
 	require.NoError(t, err)
 	require.Equal(t, 0, len(n.nltNodes))
 	require.Equal(t, 0, len(n.entities))
@@ -268,8 +268,8 @@ func TestTopicNodeRemove2(t *testing.T) {
 
 	topic := []byte("sport/tennis/player1/#")
 
-	require.NoError(t, n.insertEntity(topic, "ent1"))
-	err := n.removeEntity([]byte("sport/tennis/player1"), "ent1")
+	require.NoError(t, n.insertEntity(MQTT, topic, "ent1", nil))
+	err := n.removeEntity(MQTT, []byte("sport/tennis/player1"), "ent1", nil)
 	require.Error(t, err)
 	require.Equal(t, 1, len(n.nltNodes))
 	require.Equal(t, 0, len(n.entities))
@@ -286,9 +286,9 @@ func TestTopicNodeRemove3(t *testing.T) {
 
 	topic := []byte("sport/tennis/player1/#")
 
-	require.NoError(t, n.insertEntity(topic, "ent1"))
-	require.NoError(t, n.insertEntity(topic, "ent2"))
-	err := n.removeEntity([]byte("sport/tennis/player1/#"), nil)
+	require.NoError(t, n.insertEntity(MQTT, topic, "ent1", nil))
+	require.NoError(t, n.insertEntity(MQTT, topic, "ent2", nil))
+	err := n.removeEntity(MQTT, []byte("sport/tennis/player1/#"), nil, nil)
 	require.NoError(t, err)
 	require.Equal(t, 0, len(n.nltNodes))
 	require.Equal(t, 0, len(n.entities))
@@ -304,11 +304,11 @@ func TestTopicNodeMatch1(t *testing.T) {
 	}()
 
 	topic := []byte("sport/tennis/player1/#")
-	require.NoError(t, n.insertEntity(topic, "ent1"))
+	require.NoError(t, n.insertEntity(MQTT, topic, "ent1", nil))
 
 	entities := make([]interface{}, 0, 5)
 
-	err := n.matchEntities([]byte("sport/tennis/player1/tom"), &entities)
+	err := n.matchEntities(MQTT, []byte("sport/tennis/player1/tom"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(entities))
 }
@@ -322,12 +322,12 @@ func TestTopicNodeMatch2(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	require.NoError(t, n.insertEntity([]byte("sport/tennis/+/tom"), "ent1"))
-	require.NoError(t, n.insertEntity([]byte("sport/tennis/player1/tom"), "ent2"))
+	require.NoError(t, n.insertEntity(MQTT, []byte("sport/tennis/+/tom"), "ent1", nil))
+	require.NoError(t, n.insertEntity(MQTT, []byte("sport/tennis/player1/tom"), "ent2", nil))
 
 	entities := make([]interface{}, 0, 5)
 
-	err := n.matchEntities([]byte("sport/tennis/player1/tom"), &entities)
+	err := n.matchEntities(MQTT, []byte("sport/tennis/player1/tom"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 2, len(entities))
 }
@@ -341,12 +341,12 @@ func TestTopicNodeMatch3(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	require.NoError(t, n.insertEntity([]byte("sport/tennis/#"), "ent1"))
-	require.NoError(t, n.insertEntity([]byte("sport/tennis"), "ent2"))
+	require.NoError(t, n.insertEntity(MQTT, []byte("sport/tennis/#"), "ent1", nil))
+	require.NoError(t, n.insertEntity(MQTT, []byte("sport/tennis"), "ent2", nil))
 
 	entities := make([]interface{}, 0, 5)
 
-	err := n.matchEntities([]byte("sport/tennis/player1/tom"), &entities)
+	err := n.matchEntities(MQTT, []byte("sport/tennis/player1/tom"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(entities))
 	require.Equal(t, "ent1", entities[0])
@@ -361,11 +361,11 @@ func TestTopicNodeMatch4(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	require.NoError(t, n.insertEntity([]byte("+/+"), "ent1"))
+	require.NoError(t, n.insertEntity(MQTT, []byte("+/+"), "ent1", nil))
 
 	entities := make([]interface{}, 0, 5)
 
-	err := n.matchEntities([]byte("/finance"), &entities)
+	err := n.matchEntities(MQTT, []byte("/finance"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(entities))
 	require.Equal(t, "ent1", entities[0])
@@ -380,11 +380,11 @@ func TestTopicNodeMatch5(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	require.NoError(t, n.insertEntity([]byte("/+"), "ent1"))
+	require.NoError(t, n.insertEntity(MQTT, []byte("/+"), "ent1", nil))
 
 	entities := make([]interface{}, 0, 5)
 
-	err := n.matchEntities([]byte("/finance"), &entities)
+	err := n.matchEntities(MQTT, []byte("/finance"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 1, len(entities))
 	require.Equal(t, "ent1", entities[0])
@@ -399,11 +399,11 @@ func TestTopicNodeMatch9(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	require.NoError(t, n.insertEntity([]byte("+"), "ent1"))
+	require.NoError(t, n.insertEntity(MQTT, []byte("+"), "ent1", nil))
 
 	entities := make([]interface{}, 0, 5)
 
-	err := n.matchEntities([]byte("/finance"), &entities)
+	err := n.matchEntities(MQTT, []byte("/finance"), &entities)
 	require.NoError(t, err)
 	require.Equal(t, 0, len(entities))
 }
@@ -421,38 +421,38 @@ func BenchmarkTopicNode(b *testing.B) {
 
 	for i := 0; i < 32; i++ {
 		ti := []byte(fmt.Sprintf("sport/%d/#", i))
-		require.NoError(b, n.insertEntity(ti, "ent1"))
-		require.NoError(b, n.matchEntities(ti, &entities))
+		require.NoError(b, n.insertEntity(MQTT, ti, "ent1", nil))
+		require.NoError(b, n.matchEntities(MQTT, ti, &entities))
 		for j := 0; j < 32; j++ {
 			tj := []byte(fmt.Sprintf("sport/%d/+/%d/#", i, j))
-			require.NoError(b, n.insertEntity(tj, "ent2"))
-			require.NoError(b, n.matchEntities(tj, &entities))
+			require.NoError(b, n.insertEntity(MQTT, tj, "ent2", nil))
+			require.NoError(b, n.matchEntities(MQTT, tj, &entities))
 			for k := 0; k < 32; k++ {
 				tk := []byte(fmt.Sprintf("sport/%d/player/%d/%d", i, j, k))
-				require.NoError(b, n.insertEntity(tk, "ent3"))
-				require.NoError(b, n.matchEntities(tk, &entities))
+				require.NoError(b, n.insertEntity(MQTT, tk, "ent3", nil))
+				require.NoError(b, n.matchEntities(MQTT, tk, &entities))
 
-				require.NoError(b, n.removeEntity(tk, "ent3"))
-				require.NoError(b, n.matchEntities(tk, &entities))
+				require.NoError(b, n.removeEntity(MQTT, tk, "ent3", nil))
+				require.NoError(b, n.matchEntities(MQTT, tk, &entities))
 			}
 			for k := 0; k < 32; k++ {
 				tk := []byte(fmt.Sprintf("sport/%d/tom/%d/%d", i, j, k))
-				require.NoError(b, n.insertEntity(tk, "ent4"))
-				require.NoError(b, n.matchEntities(tk, &entities))
+				require.NoError(b, n.insertEntity(MQTT, tk, "ent4", nil))
+				require.NoError(b, n.matchEntities(MQTT, tk, &entities))
 
-				require.NoError(b, n.removeEntity(tk, "ent4"))
-				require.NoError(b, n.matchEntities(tk, &entities))
+				require.NoError(b, n.removeEntity(MQTT, tk, "ent4", nil))
+				require.NoError(b, n.matchEntities(MQTT, tk, &entities))
 			}
 			for k := 0; k < 32; k++ {
 				tk := []byte(fmt.Sprintf("sport/%d/jack/%d/%d", i, j, k))
-				require.NoError(b, n.insertEntity(tk, "ent5"))
-				require.NoError(b, n.matchEntities(tk, &entities))
+				require.NoError(b, n.insertEntity(MQTT, tk, "ent5", nil))
+				require.NoError(b, n.matchEntities(MQTT, tk, &entities))
 
-				require.NoError(b, n.removeEntity(tk, "ent5"))
-				require.NoError(b, n.matchEntities(tk, &entities))
+				require.NoError(b, n.removeEntity(MQTT, tk, "ent5", nil))
+				require.NoError(b, n.matchEntities(MQTT, tk, &entities))
 			}
-			require.NoError(b, n.removeEntity(tj, "ent2"))
+			require.NoError(b, n.removeEntity(MQTT, tj, "ent2", nil))
 		}
-		require.NoError(b, n.removeEntity(ti, "ent1"))
+		require.NoError(b, n.removeEntity(MQTT, ti, "ent1", nil))
 	}
 }
@@ -0,0 +1,71 @@
+package cabinet
+
+import (
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Normalizer appends the normal form of a topic or filter to dst, and returns
+// the extended buffer, like the Append method of the forms of
+// golang.org/x/text/unicode/norm. It must leave the separators and wildcards
+// of the syntax of the tree unchanged.
+//
+// Normalizers chain by appending to a buffer of the previous one, so that
+// case folding the NFC form of golang.org/x/text/unicode/norm is:
+//
+//	func(dst, topic []byte) []byte {
+//		return cabinet.FoldCase(dst, norm.NFC.Bytes(topic))
+//	}
+//
+// NFC composes some runes with the combining marks following them, like a
+// NATS '>' followed by U+0338 into U+226F, which a Normalizer must not do to
+// the separators and wildcards.
+type Normalizer func(dst, topic []byte) []byte
+
+// FoldCase is the Normalizer folding the case of letters, so that 'Sensors/Temp'
+// matches 'sensors/temp'. ASCII letters are lowered, and the other ones mapped
+// to the lower case of their upper case, which folds the variants of a letter
+// like the Kelvin sign into the same one. Invalid UTF-8 is left unchanged.
+func FoldCase(dst, topic []byte) []byte {
+	for i := 0; i < len(topic); {
+		c := topic[i]
+		if c < utf8.RuneSelf {
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			dst = append(dst, c)
+			i++
+			continue
+		}
+
+		r, n := utf8.DecodeRune(topic[i:])
+		if r == utf8.RuneError && n == 1 {
+			dst = append(dst, c)
+			i++
+			continue
+		}
+		var b [utf8.UTFMax]byte
+		dst = append(dst, b[:utf8.EncodeRune(b[:], unicode.ToLower(unicode.ToUpper(r)))]...)
+		i += n
+	}
+	return dst
+}
+
+// WithNormalizer makes the tree normalize the filters it links and unlinks, and
+// the topics it matches, with n. A filter is unlinked by any filter having the
+// same normal form, and listed, as by Snapshot, with the text it was first
+// linked with. OverlappingFilters and the hooks report normal forms, while the
+// levels of LinkedCaptures and LinkedParams are those of the topic matched.
+func WithNormalizer(n Normalizer) TreeOption {
+	return func(tr *TTree) {
+		tr.normalizer = n
+	}
+}
+
+// normBuffers keeps the buffers of the normal forms of the matched topics, so
+// that matching does not allocate
+var normBuffers = sync.Pool{New: func() interface{} {
+	b := make([]byte, 0, 64)
+	return &b
+}}
@@ -0,0 +1,103 @@
+package cabinet
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestFoldCase(t *testing.T) {
+	for topic, want := range map[string]string{
+		"sensors/temp":     "sensors/temp",
+		"Sensors/TEMP/+/#": "sensors/temp/+/#",
+		"Ärger/ÉTÉ":        "ärger/été",
+		"\u212a/\u017f":    "k/s", // Kelvin sign and long s
+		"bad/\xff/Utf8":    "bad/\xff/utf8",
+		"":                 "",
+		"ΣΊΣΥΦΟΣ/straße/Ǆ": "σίσυφοσ/straße/ǆ",
+	} {
+		require.Equal(t, want, string(FoldCase(nil, []byte(topic))), topic)
+	}
+	require.Equal(t, "a/b", string(FoldCase([]byte("a/"), []byte("B"))))
+}
+
+func TestNormalizer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var added [][]byte
+	tt := NewTopicTree(WithNormalizer(FoldCase), WithHooks(Hooks{
+		OnFilterAdded: func(filter []byte) { added = append(added, filter) },
+	}))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	require.NoError(t, tt.EntityLink([]byte("Sensors/Temp"), "a"))
+	require.NoError(t, tt.EntityLink([]byte("sensors/temp"), "b"))
+	require.NoError(t, tt.EntityLink([]byte("SENSORS/+"), "c"))
+	require.Equal(t, [][]byte{[]byte("sensors/temp"), []byte("sensors/+")}, added)
+
+	entities := make([]interface{}, 0, 3)
+	for _, topic := range []string{"sensors/temp", "Sensors/Temp", "SENSORS/TEMP"} {
+		require.NoError(t, tt.LinkedEntities([]byte(topic), &entities))
+		require.ElementsMatch(t, []interface{}{"a", "b", "c"}, entities, topic)
+	}
+
+	// Filters are listed as linked
+	links, _ := tt.links()
+	filters := make([]string, 0, len(links))
+	for _, l := range links {
+		filters = append(filters, string(l.filter))
+	}
+	sort.Strings(filters)
+	require.Equal(t, []string{"SENSORS/+", "Sensors/Temp", "sensors/temp"}, filters)
+
+	// and restored as linked
+	var buf bytes.Buffer
+	require.NoError(t, tt.Snapshot(&buf, stringCodec{}))
+	rt := NewTopicTree(WithNormalizer(FoldCase))
+	require.NoError(t, rt.Restore(&buf, stringCodec{}))
+	rlinks, _ := rt.links()
+	require.ElementsMatch(t, links, rlinks)
+	require.NoError(t, rt.Close())
+
+	// The levels captured are those of the topic, not of its normal form
+	captures := make([]CaptureMatch, 0, 3)
+	require.NoError(t, tt.LinkedCaptures([]byte("Sensors/Hum"), &captures))
+	require.Len(t, captures, 1)
+	require.Equal(t, "c", captures[0].Entity)
+	require.Equal(t, [][]byte{[]byte("Hum")}, captures[0].Levels)
+
+	// Even when the normal form of a level has another length
+	wt := NewTopicTree(WithNormalizer(FoldCase))
+	require.NoError(t, wt.EntityLink([]byte("k/+/#"), "k"))
+	require.NoError(t, wt.LinkedCaptures([]byte("\u212a/\u212a\u212a/A/\u212a"), &captures))
+	require.Len(t, captures, 1)
+	require.Equal(t, [][]byte{[]byte("\u212a\u212a"), []byte("A/\u212a")}, captures[0].Levels)
+	require.NoError(t, wt.Close())
+
+	// Matching ASCII topics does not allocate once warm, nor does capturing
+	// reusing the matches
+	topic := []byte("Sensors/Temp")
+	if !raceEnabled {
+		allocs := testing.AllocsPerRun(100, func() {
+			require.NoError(t, tt.LinkedEntities(topic, &entities))
+		})
+		require.Equal(t, 0.0, allocs)
+		allocs = testing.AllocsPerRun(100, func() {
+			require.NoError(t, tt.LinkedCaptures(topic, &captures))
+		})
+		require.Equal(t, 0.0, allocs)
+	}
+
+	// Any filter of the same normal form unlinks
+	require.NoError(t, tt.EntityUnLink([]byte("SENSORS/TEMP"), "a"))
+	require.NoError(t, tt.EntityUnLink([]byte("sensors/+"), "c"))
+	links, _ = tt.links()
+	require.Len(t, links, 1)
+	require.Equal(t, "sensors/temp", string(links[0].filter))
+	require.Equal(t, "b", links[0].entity)
+}
@@ -0,0 +1,110 @@
+package cabinet
+
+import (
+	"fmt"
+)
+
+// In a syntax with Params, a level '{name}' of a filter is a named parameter.
+// It matches any level like '+', and the level it matched is reported under
+// its name by LinkedParams. Names start with a letter or '_', followed by
+// letters, digits or '_'; any other level in braces is a regular one.
+
+// ParamMatch is an entity matched by LinkedParams, with the levels matched by
+// the named parameters of its filter
+type ParamMatch struct {
+	Entity interface{}
+
+	// Params is nil when the filter has no named parameters. A name repeated
+	// in a filter has the value of its last level.
+	Params map[string]string
+}
+
+// isParam reports whether a level is a named parameter
+func (sx *Syntax) isParam(level string) bool {
+	return sx.Params && len(level) > 2 && level[0] == '{' && level[len(level)-1] == '}' && isIdent(level[1:len(level)-1])
+}
+
+// isIdent reports whether a name is one of a parameter
+func isIdent(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case i > 0 && '0' <= c && c <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// LinkedParams returns the entities linked to the filters matching topic, like
+// LinkedEntities, along with the values of the named parameters of each
+// filter. Returned values will be invalidated by the next LinkedParams call.
+func (tr *TTree) LinkedParams(topic []byte, matches *[]ParamMatch) error {
+	if tr.syntax.MultiWildcardAnywhere {
+		return fmt.Errorf("topicTree/LinkedParams: %w", ErrUnsupportedSyntax)
+	}
+	if tr.topicRewriter != nil {
+		topic = tr.topicRewriter.Rewrite(topic)
+	}
+	if err := tr.syntax.ValidateTopicName(topic); err != nil {
+		return fmt.Errorf("topicTree/LinkedParams: %w", err)
+	}
+	if err := tr.checkTopic(topic); err != nil {
+		return fmt.Errorf("topicTree/LinkedParams: %w", err)
+	}
+	original, normal := topic, []byte(nil)
+	if tr.normalizer != nil {
+		buf := normBuffers.Get().(*[]byte)
+		defer normBuffers.Put(buf)
+		*buf = tr.normalizer((*buf)[:0], topic)
+		topic, normal = *buf, *buf
+	}
+
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+
+	*matches = (*matches)[0:0]
+
+	return tr.root.matchCapturesPooled(tr.syntax, topic, func(tn *tNode, caps []capture) {
+		tn.paramMatches(tr.syntax, caps, normal, original, matches)
+	})
+}
+
+// paramName returns the name of a named parameter level, with or without a
+// regular expression
+func (sx *Syntax) paramName(level string) (string, bool) {
+	if sx.isParam(level) {
+		return level[1 : len(level)-1], true
+	}
+	if sx.isRegexp(level) {
+		return regexpLevel(level)
+	}
+	return "", false
+}
+
+// paramMatches appends the entities of tn to matches, with the named
+// parameters among the captures, mapped back to topic from its normal form
+// when not nil
+func (tn *tNode) paramMatches(sx *Syntax, caps []capture, normal, topic []byte, matches *[]ParamMatch) {
+	for _, entity := range tn.entities {
+		m := ParamMatch{Entity: entity}
+		for _, c := range caps {
+			name, ok := sx.paramName(c.wildcard)
+			if !ok {
+				continue
+			}
+			if m.Params == nil {
+				m.Params = make(map[string]string, len(caps))
+			}
+			if normal != nil {
+				c.level = sx.original(c, normal, topic)
+			}
+			m.Params[name] = string(c.level)
+		}
+		*matches = append(*matches, m)
+	}
+}
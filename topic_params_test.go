@@ -0,0 +1,113 @@
+package cabinet
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestIsParam(t *testing.T) {
+	params := &Syntax{Params: true}
+	for level, want := range map[string]bool{
+		"{id}":     true,
+		"{_x1}":    true,
+		"{Sport}":  true,
+		"{}":       false,
+		"{1x}":     false,
+		"{a-b}":    false,
+		"{id":      false,
+		"x{id}":    false,
+		"{id:[0]}": false,
+	} {
+		require.Equal(t, want, params.isParam(level), level)
+	}
+	require.False(t, MQTT.isParam("{id}"))
+}
+
+func TestLinkedParams(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	params := *MQTT
+	params.Params = true
+	tt := NewTopicTree(WithSyntax(&params))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	require.NoError(t, tt.EntityLink([]byte("sport/{sport}/player/{id}"), "ent1"))
+	require.NoError(t, tt.EntityLink([]byte("sport/{game}/#"), "ent2"))
+	require.NoError(t, tt.EntityLink([]byte("sport/+/player/+"), "ent3"))
+	require.NoError(t, tt.EntityLink([]byte("sport/tennis/player/{id}"), "ent4"))
+	require.NoError(t, tt.EntityLink([]byte("sport/{1x}/player/7"), "ent5"))
+	require.NoError(t, tt.EntityLink([]byte("{root}"), "ent6"))
+
+	matches := make([]ParamMatch, 0, 4)
+	require.NoError(t, tt.LinkedParams([]byte("sport/tennis/player/7"), &matches))
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Entity.(string) < matches[j].Entity.(string)
+	})
+	require.Equal(t, []ParamMatch{
+		{Entity: "ent1", Params: map[string]string{"sport": "tennis", "id": "7"}},
+		{Entity: "ent2", Params: map[string]string{"game": "tennis"}},
+		{Entity: "ent3"},
+		{Entity: "ent4", Params: map[string]string{"id": "7"}},
+	}, matches)
+
+	// Named parameters match like '+' everywhere else
+	entities := make([]interface{}, 0, 4)
+	require.NoError(t, tt.LinkedEntities([]byte("sport/golf/player/9"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent1", "ent2", "ent3"}, entities)
+	require.NoError(t, tt.LinkedEntities([]byte("sport/{1x}/player/7"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent1", "ent2", "ent3", "ent5"}, entities)
+
+	// A leading separator is an empty level
+	require.NoError(t, tt.LinkedParams([]byte("/"), &matches))
+	require.Equal(t, []ParamMatch{{Entity: "ent6", Params: map[string]string{"root": ""}}}, matches)
+	require.NoError(t, tt.LinkedParams([]byte("news"), &matches))
+	require.Equal(t, []ParamMatch{{Entity: "ent6", Params: map[string]string{"root": "news"}}}, matches)
+
+	ok, err := params.Covers([]byte("sport/{sport}/#"), []byte("sport/+/player/{id}"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = params.Covers([]byte("sport/tennis/#"), []byte("sport/{sport}/player"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, tt.EntityUnLink([]byte("sport/{sport}/player/{id}"), "ent1"))
+	require.NoError(t, tt.LinkedEntities([]byte("sport/golf/player/9"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent2", "ent3"}, entities)
+
+	// The values are those of the topic, not of its normal form
+	nt := NewTopicTree(WithSyntax(&params), WithNormalizer(FoldCase))
+	require.NoError(t, nt.EntityLink([]byte("Sport/{sport}/#"), "ent1"))
+	require.NoError(t, nt.LinkedParams([]byte("SPORT/\u212aendo/Player"), &matches))
+	require.Equal(t, []ParamMatch{{Entity: "ent1", Params: map[string]string{"sport": "\u212aendo"}}}, matches)
+	require.NoError(t, nt.Close())
+}
+
+func TestParamsSyntax(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// Parameters are regular levels without the option
+	tt := NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	require.NoError(t, tt.EntityLink([]byte("sport/{sport}"), "ent1"))
+	entities := make([]interface{}, 0, 1)
+	require.NoError(t, tt.LinkedEntities([]byte("sport/tennis"), &entities))
+	require.Empty(t, entities)
+	require.NoError(t, tt.LinkedEntities([]byte("sport/{sport}"), &entities))
+	require.Equal(t, []interface{}{"ent1"}, entities)
+
+	matches := make([]ParamMatch, 0, 1)
+	require.NoError(t, tt.LinkedParams([]byte("sport/{sport}"), &matches))
+	require.Equal(t, []ParamMatch{{Entity: "ent1"}}, matches)
+
+	ok, err := Covers([]byte("sport/{sport}"), []byte("sport/tennis"))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
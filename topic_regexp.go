@@ -0,0 +1,66 @@
+package cabinet
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// With the Regexps syntax option, a level '{name:expr}' of a filter is a named
+// parameter matching only the levels matched entirely by the regular
+// expression expr: 'device/{id:[0-9]+}/status' matches 'device/42/status' but
+// not 'device/x/status', and LinkedParams reports the level under id. The
+// expression may hold wildcard characters, but not the separator. It is
+// compiled once, when the first filter having the level is linked, and only
+// evaluated at the nodes having such levels.
+
+// isRegexp reports whether a filter level is a regular expression one
+func (sx *Syntax) isRegexp(level string) bool {
+	if !sx.Regexps {
+		return false
+	}
+	_, ok := regexpLevel(level)
+	return ok
+}
+
+// regexpLevel returns the name of a level '{name:expr}', and whether it is one
+func regexpLevel(level string) (name string, ok bool) {
+	if len(level) < 4 || level[0] != '{' || level[len(level)-1] != '}' {
+		return "", false
+	}
+	for i := 1; i < len(level)-1; i++ {
+		if level[i] == ':' {
+			return level[1:i], isIdent(level[1:i])
+		}
+	}
+	return "", false
+}
+
+// compileRegexp compiles the expression of a regular expression level, to
+// match levels entirely, or returns a *TopicError
+func compileRegexp(level string) (*regexp.Regexp, error) {
+	name, _ := regexpLevel(level)
+	re, err := regexp.Compile("^(?:" + level[len(name)+2:len(level)-1] + ")$")
+	if err != nil {
+		return nil, &TopicError{Level: level, Err: err}
+	}
+	return re, nil
+}
+
+// nextRegexpLevel returns the regular expression level starting a topic, the
+// remaining levels, and whether there is one
+func (sx *Syntax) nextRegexpLevel(topic []byte) ([]byte, []byte, bool) {
+	if !sx.Regexps || len(topic) == 0 || topic[0] != '{' {
+		return nil, nil, false
+	}
+	level, rem := topic, []byte(nil)
+	if i := bytes.IndexByte(topic, sx.Separator); i >= 0 {
+		level, rem = topic[:i], topic[i+1:]
+		if len(rem) == 0 && !sx.EmptyLevelWildcard {
+			return nil, nil, false
+		}
+	}
+	if _, ok := regexpLevel(string(level)); !ok {
+		return nil, nil, false
+	}
+	return level, rem, true
+}
@@ -0,0 +1,121 @@
+package cabinet
+
+import (
+	"errors"
+	"regexp/syntax"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestRegexpMatch(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	mqtt := *MQTT
+	mqtt.Regexps, mqtt.Params = true, true
+	tt := NewTopicTree(WithSyntax(&mqtt))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	filters := []string{"device/{id:[0-9]+}/status", "device/{id}/status", "device/{name:[a-z]+|x-1}/#", "{v:|a}/x"}
+	for _, f := range filters {
+		require.NoError(t, tt.EntityLink([]byte(f), f))
+	}
+
+	entities := make([]interface{}, 0, len(filters))
+	for topic, want := range map[string][]interface{}{
+		"device/42/status":  {"device/{id:[0-9]+}/status", "device/{id}/status"},
+		"device/4a/status":  {"device/{id}/status"},
+		"device/abc/status": {"device/{id}/status", "device/{name:[a-z]+|x-1}/#"},
+		"device/x-1/status": {"device/{id}/status", "device/{name:[a-z]+|x-1}/#"},
+		"device/abc/a/b":    {"device/{name:[a-z]+|x-1}/#"},
+		"/x":                {"{v:|a}/x"},
+		"a/x":               {"{v:|a}/x"},
+		"b/x":               nil,
+	} {
+		require.NoError(t, tt.LinkedEntities([]byte(topic), &entities))
+		require.ElementsMatch(t, want, entities, topic)
+	}
+
+	// The levels matched are named parameters
+	params := make([]ParamMatch, 0, 2)
+	require.NoError(t, tt.LinkedParams([]byte("device/42/status"), &params))
+	require.ElementsMatch(t, []ParamMatch{
+		{Entity: "device/{id:[0-9]+}/status", Params: map[string]string{"id": "42"}},
+		{Entity: "device/{id}/status", Params: map[string]string{"id": "42"}},
+	}, params)
+
+	// Expressions are listed and unlinked as linked
+	links, _ := tt.links()
+	require.Len(t, links, len(filters))
+	require.NoError(t, tt.EntityUnLink([]byte("device/{id:[0-9]+}/status"), "device/{id:[0-9]+}/status"))
+	require.NoError(t, tt.LinkedEntities([]byte("device/42/status"), &entities))
+	require.Equal(t, []interface{}{"device/{id}/status"}, entities)
+
+	// Matching does not allocate once warm
+	topic := []byte("device/abc/a/b")
+	if !raceEnabled {
+		allocs := testing.AllocsPerRun(100, func() {
+			require.NoError(t, tt.LinkedEntities(topic, &entities))
+		})
+		require.Equal(t, 0.0, allocs)
+	}
+
+	var serr *syntax.Error
+	require.True(t, errors.As(tt.EntityLink([]byte("device/{id:[0-9}/status"), "bad"), &serr))
+	require.Error(t, tt.EntityLink([]byte("device/{1d:[0-9]+}/status"), "bad"))
+
+	_, err := tt.OverlappingFilters([]byte("device/#"))
+	require.True(t, errors.Is(err, ErrUnsupportedSyntax))
+}
+
+func TestRegexpInvalid(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	mqtt := *MQTT
+	mqtt.Regexps = true
+	tt := NewTopicTree(WithSyntax(&mqtt), WithLimits(Limits{MaxNodes: 2}))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	// Malformed expressions are rejected before any node is added
+	var terr *TopicError
+	require.True(t, errors.As(mqtt.ValidateFilter([]byte("x/{id:[}")), &terr))
+	require.Equal(t, "{id:[}", terr.Level)
+	require.True(t, errors.As(tt.EntityLink([]byte("x/{id:[}"), "bad"), &terr))
+	require.Equal(t, Stats{}, tt.Stats())
+
+	// and consume none of the nodes allowed
+	require.NoError(t, tt.EntityLink([]byte("a/b"), "ent1"))
+	require.Equal(t, 2, tt.Stats().Nodes)
+}
+
+func TestRegexpSyntax(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// Expressions are regular levels without the option
+	tt := NewTopicTree()
+	require.NoError(t, tt.EntityLink([]byte("device/{id:[0-9]}/status"), "re"))
+	entities := make([]interface{}, 0, 1)
+	require.NoError(t, tt.LinkedEntities([]byte("device/4/status"), &entities))
+	require.Empty(t, entities)
+	require.NoError(t, tt.LinkedEntities([]byte("device/{id:[0-9]}/status"), &entities))
+	require.Equal(t, []interface{}{"re"}, entities)
+	require.Error(t, tt.EntityLink([]byte("device/{id:[0-9]+}/status"), "re"))
+	require.NoError(t, tt.Close())
+
+	// and globs are not expressions
+	nats := *NATS
+	nats.Regexps, nats.Globs = true, true
+	tt = NewTopicTree(WithSyntax(&nats))
+	require.NoError(t, tt.EntityLink([]byte("logs.{n:a*}.err"), "re"))
+	require.NoError(t, tt.EntityLink([]byte("logs.a*.err"), "glob"))
+	require.NoError(t, tt.LinkedEntities([]byte("logs.aaa.err"), &entities))
+	require.ElementsMatch(t, []interface{}{"re", "glob"}, entities)
+	require.NoError(t, tt.LinkedEntities([]byte("logs.ab.err"), &entities))
+	require.ElementsMatch(t, []interface{}{"glob"}, entities)
+	require.NoError(t, tt.Close())
+}
@@ -0,0 +1,481 @@
+package cabinet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+var (
+	// ErrLeaderClosed is returned by Leader.Serve after Close
+	ErrLeaderClosed = errors.New("replication leader closed")
+
+	// ErrReplicationGap is returned by Follower.Run when a change is missing
+	// from the stream
+	ErrReplicationGap = errors.New("replication gap")
+)
+
+// DefaultReplicationBacklog is the number of changes a leader keeps for the
+// followers catching up
+const DefaultReplicationBacklog = 1024
+
+// maxFrameLen bounds the length of a frame, so that a corrupt or hostile
+// length is not allocated. Snapshots of larger trees cannot be replicated.
+const maxFrameLen = 1 << 30
+
+// Replication frame types
+const (
+	frameHello byte = iota + 1
+	frameSnapshot
+	frameChange
+)
+
+// Leader streams the changes of a tree to followers. A follower reconnecting
+// within the backlog resumes from the last change it applied, otherwise it
+// catches up from a snapshot, and so does a follower falling behind.
+type Leader struct {
+	tr    *TTree
+	codec EntityCodec
+	id    uint64
+	size  int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	w       *Watcher
+	backlog []Change
+	first   uint64 // sequence number of backlog[0], or of the next change
+	closed  bool
+	done    chan struct{}
+}
+
+// NewLeader returns a leader for tr keeping the last backlog changes, or
+// DefaultReplicationBacklog when 0
+func NewLeader(tr *TTree, codec EntityCodec, backlog int) *Leader {
+	if backlog <= 0 {
+		backlog = DefaultReplicationBacklog
+	}
+
+	var id [8]byte
+	rand.Read(id[:])
+
+	l := &Leader{tr: tr, codec: codec, id: binary.BigEndian.Uint64(id[:]), size: backlog, done: make(chan struct{})}
+	l.cond = sync.NewCond(&l.mu)
+
+	var seq uint64
+	l.w, seq = tr.Watch(backlog)
+	l.first = seq + 1
+
+	go l.pump()
+	return l
+}
+
+// last returns the sequence number of the last change of the backlog
+func (l *Leader) last() uint64 {
+	return l.first + uint64(len(l.backlog)) - 1
+}
+
+// pump moves the changes of the tree to the backlog. When it falls behind, the
+// backlog starts over and the followers behind catch up from a snapshot.
+func (l *Leader) pump() {
+	defer close(l.done)
+
+	for {
+		l.mu.Lock()
+		w := l.w
+		l.mu.Unlock()
+
+		for c := range w.C {
+			l.mu.Lock()
+			if len(l.backlog) == l.size {
+				copy(l.backlog, l.backlog[1:])
+				l.backlog = l.backlog[:l.size-1]
+				l.first++
+			}
+			l.backlog = append(l.backlog, c)
+			l.mu.Unlock()
+			l.cond.Broadcast()
+		}
+
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return
+		}
+		var seq uint64
+		l.w, seq = l.tr.Watch(l.size)
+		l.backlog = l.backlog[:0]
+		l.first = seq + 1
+		l.mu.Unlock()
+		l.cond.Broadcast()
+	}
+}
+
+// Serve streams the changes of the tree to the follower at the other end of
+// conn, until it disconnects or the leader is closed. The caller should close
+// conn once it returns.
+func (l *Leader) Serve(conn io.ReadWriter) error {
+	br, bw := bufio.NewReader(conn), bufio.NewWriter(conn)
+
+	typ, payload, err := readFrame(br)
+	if err != nil {
+		return err
+	}
+	pr := bytes.NewReader(payload)
+	id, err1 := binary.ReadUvarint(pr)
+	cursor, err2 := binary.ReadUvarint(pr)
+	if typ != frameHello || err1 != nil || err2 != nil {
+		return errors.New("replication/Serve: invalid hello")
+	}
+
+	// The follower sends nothing after the hello, so reading tells when it
+	// disconnects
+	var gone error
+	go func() {
+		_, err := io.Copy(ioutil.Discard, br)
+		if err == nil {
+			err = io.EOF
+		}
+		l.mu.Lock()
+		gone = err
+		l.mu.Unlock()
+		l.cond.Broadcast()
+	}()
+
+	l.mu.Lock()
+	resync := id != l.id || cursor+1 < l.first || cursor > l.last()
+	l.mu.Unlock()
+
+	var rec []byte
+	for {
+		if resync {
+			if cursor, err = l.writeSnapshot(bw); err != nil {
+				return err
+			}
+			resync = false
+		}
+
+		l.mu.Lock()
+		for !l.closed && gone == nil && cursor >= l.last() && cursor+1 >= l.first {
+			l.cond.Wait()
+		}
+		if l.closed {
+			l.mu.Unlock()
+			return ErrLeaderClosed
+		}
+		if gone != nil {
+			l.mu.Unlock()
+			return gone
+		}
+		if cursor+1 < l.first {
+			resync = true
+			l.mu.Unlock()
+			continue
+		}
+		changes := append([]Change(nil), l.backlog[cursor+1-l.first:]...)
+		l.mu.Unlock()
+
+		for _, c := range changes {
+			var ub [binary.MaxVarintLen64]byte
+			rec = append(rec[:0], ub[:binary.PutUvarint(ub[:], c.Seq)]...)
+			op := walLink
+			if c.Op == ChangeUnLink {
+				op = walUnLink
+			}
+			if rec, err = appendRecord(rec, op, c.Topic, c.Entity, l.codec); err != nil {
+				return fmt.Errorf("replication/Serve: %w", err)
+			}
+			writeFrame(bw, frameChange, rec)
+			cursor = c.Seq
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// writeSnapshot sends a snapshot of the tree, and returns the sequence number
+// of the last change it includes
+func (l *Leader) writeSnapshot(bw *bufio.Writer) (uint64, error) {
+	links, seq := l.tr.links()
+
+	var buf bytes.Buffer
+	var ub [binary.MaxVarintLen64]byte
+	buf.Write(ub[:binary.PutUvarint(ub[:], l.id)])
+	buf.Write(ub[:binary.PutUvarint(ub[:], seq)])
+	if err := writeSnapshot(&buf, l.codec, links); err != nil {
+		return 0, fmt.Errorf("replication/Serve: %w", err)
+	}
+
+	writeFrame(bw, frameSnapshot, buf.Bytes())
+	return seq, bw.Flush()
+}
+
+// Close stops the leader, and makes Serve return ErrLeaderClosed
+func (l *Leader) Close() {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	w := l.w
+	l.mu.Unlock()
+
+	w.Close()
+	<-l.done
+	l.cond.Broadcast()
+}
+
+// Follower applies the changes streamed by a leader to its tree
+type Follower struct {
+	tr    *TTree
+	codec EntityCodec
+
+	mu     sync.Mutex
+	leader uint64
+	seq    uint64
+}
+
+// NewFollower returns a follower replicating to tr, which should only be
+// changed by the follower
+func NewFollower(tr *TTree, codec EntityCodec) *Follower {
+	return &Follower{tr: tr, codec: codec}
+}
+
+// Seq returns the sequence number, on the leader, of the last change applied
+func (f *Follower) Seq() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.seq
+}
+
+// Run applies the changes received on conn until reading from it fails. It
+// can be called again with a new connection to resume.
+func (f *Follower) Run(conn io.ReadWriter) error {
+	br, bw := bufio.NewReader(conn), bufio.NewWriter(conn)
+
+	f.mu.Lock()
+	var (
+		hello []byte
+		ub    [binary.MaxVarintLen64]byte
+	)
+	hello = append(hello, ub[:binary.PutUvarint(ub[:], f.leader)]...)
+	hello = append(hello, ub[:binary.PutUvarint(ub[:], f.seq)]...)
+	f.mu.Unlock()
+
+	writeFrame(bw, frameHello, hello)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		typ, payload, err := readFrame(br)
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case frameSnapshot:
+			err = f.applySnapshot(payload)
+		case frameChange:
+			err = f.applyChange(payload)
+		default:
+			err = fmt.Errorf("replication/Run: unknown frame type %d", typ)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (f *Follower) applySnapshot(payload []byte) error {
+	pr := bytes.NewReader(payload)
+	id, err1 := binary.ReadUvarint(pr)
+	seq, err2 := binary.ReadUvarint(pr)
+	if err1 != nil || err2 != nil {
+		return fmt.Errorf("replication/Run: invalid snapshot: %w", ErrInvalidSnapshot)
+	}
+	links, err := readSnapshot(pr, f.codec)
+	if err != nil {
+		return err
+	}
+	if err := f.tr.replace(links); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.leader, f.seq = id, seq
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *Follower) applyChange(payload []byte) error {
+	seq, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return errors.New("replication/Run: invalid change")
+	}
+	op, topic, entity, err := decodeRecord(payload[n:], f.codec)
+	if err != nil {
+		return fmt.Errorf("replication/Run: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if seq != f.seq+1 {
+		return fmt.Errorf("replication/Run: change %d after %d: %w", seq, f.seq, ErrReplicationGap)
+	}
+	if err := f.tr.apply(op, topic, entity); err != nil {
+		return fmt.Errorf("replication/Run: change %d: %w", seq, err)
+	}
+	f.seq = seq
+	return nil
+}
+
+// apply links or unlinks a change of the leader, where it was rewritten and
+// limited already, and notifies the watchers and hooks of the tree
+func (tr *TTree) apply(op byte, topic []byte, entity interface{}) error {
+	if tr.err != nil {
+		return tr.err
+	}
+	if err := tr.syntax.validateFilter(topic); err != nil {
+		return err
+	}
+
+	var (
+		nop    nodeOp
+		err    error
+		seq    uint64
+		change = ChangeLink
+	)
+	tr.mu.Lock()
+	if op == walLink {
+		err = tr.insert(topic, entity, &nop)
+	} else {
+		change = ChangeUnLink
+		err = tr.remove(topic, entity, &nop)
+	}
+	if err == nil {
+		seq = tr.notify(change, topic, entity)
+	}
+	tr.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tr.runHooks(seq, topic, entity, &nop)
+	return nil
+}
+
+// replace swaps the links of the tree for the given ones, unlinking and
+// linking the differences as changes, so that the watchers and the hooks of
+// the tree follow, as a chained follower does
+func (tr *TTree) replace(links []link) error {
+	if tr.err != nil {
+		return tr.err
+	}
+	for _, l := range links {
+		if err := tr.syntax.validateFilter(l.filter); err != nil {
+			return fmt.Errorf("topicTree/replace: %w", err)
+		}
+	}
+
+	type applied struct {
+		link
+		seq uint64
+		op  nodeOp
+	}
+	var (
+		changes []applied
+		err     error
+	)
+	tr.mu.Lock()
+	current, _ := tr.linksLocked()
+	have := groupLinks(current)
+	want := groupLinks(links)
+	for _, l := range current {
+		if !containsEntity(want[string(l.filter)], l.entity) {
+			c := applied{link: l}
+			tr.remove(l.filter, l.entity, &c.op)
+			c.seq = tr.notify(ChangeUnLink, l.filter, l.entity)
+			changes = append(changes, c)
+		}
+	}
+	for _, l := range links {
+		if containsEntity(have[string(l.filter)], l.entity) {
+			continue
+		}
+		c := applied{link: l}
+		if err = tr.insert(l.filter, l.entity, &c.op); err != nil {
+			err = fmt.Errorf("topicTree/replace: %s: %w", l.filter, err)
+			break
+		}
+		have[string(l.filter)] = append(have[string(l.filter)], l.entity)
+		c.seq = tr.notify(ChangeLink, l.filter, l.entity)
+		changes = append(changes, c)
+	}
+	tr.mu.Unlock()
+
+	for i := range changes {
+		c := &changes[i]
+		tr.runHooks(c.seq, c.filter, c.entity, &c.op)
+	}
+	return err
+}
+
+// groupLinks returns the entities of links by filter
+func groupLinks(links []link) map[string][]interface{} {
+	m := make(map[string][]interface{}, len(links))
+	for _, l := range links {
+		m[string(l.filter)] = append(m[string(l.filter)], l.entity)
+	}
+	return m
+}
+
+// containsEntity reports whether entity is one of entities
+func containsEntity(entities []interface{}, entity interface{}) bool {
+	for _, e := range entities {
+		if equal(e, entity) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFrame(bw *bufio.Writer, typ byte, payload []byte) {
+	var ub [binary.MaxVarintLen64]byte
+	bw.WriteByte(typ)
+	bw.Write(ub[:binary.PutUvarint(ub[:], uint64(len(payload)))])
+	bw.Write(payload)
+}
+
+func readFrame(br *bufio.Reader) (byte, []byte, error) {
+	typ, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > maxFrameLen {
+		return 0, nil, fmt.Errorf("replication: frame of %d bytes too long", n)
+	}
+
+	// The payload grows as it is read, rather than trusting its length
+	var payload bytes.Buffer
+	if _, err := io.CopyN(&payload, br, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return typ, payload.Bytes(), nil
+}
@@ -0,0 +1,205 @@
+package cabinet
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// replicate connects follower to leader through an in-memory pipe, and returns
+// the errors of both ends once the pipe is closed
+func replicate(l *Leader, f *Follower) (net.Conn, <-chan error) {
+	lc, fc := net.Pipe()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- l.Serve(lc)
+		lc.Close()
+	}()
+	go func() {
+		errs <- f.Run(fc)
+		fc.Close()
+	}()
+	return fc, errs
+}
+
+func requireReplicated(t *testing.T, leader, follower *TTree, f *Follower) {
+	require.Eventually(t, func() bool {
+		return f.Seq() == leader.Seq()
+	}, 5*time.Second, time.Millisecond)
+
+	var want, got bytes.Buffer
+	require.NoError(t, leader.Snapshot(&want, stringCodec{}))
+	require.NoError(t, follower.Snapshot(&got, stringCodec{}))
+	require.Equal(t, want.Bytes(), got.Bytes())
+}
+
+func TestReplication(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	lt, ft := NewTopicTree(), NewTopicTree()
+	defer func() {
+		require.NoError(t, lt.Close())
+		require.NoError(t, ft.Close())
+	}()
+
+	require.NoError(t, lt.EntityLink([]byte("sport/tennis/+"), "ent1"))
+	require.NoError(t, lt.EntityLink([]byte("sport/#"), "ent2"))
+
+	l := NewLeader(lt, stringCodec{}, 4)
+	f := NewFollower(ft, stringCodec{})
+
+	// The follower starts from a snapshot, then applies the changes
+	conn, errs := replicate(l, f)
+	requireReplicated(t, lt, ft, f)
+	require.NoError(t, lt.EntityLink([]byte("news/+"), "ent3"))
+	require.NoError(t, lt.EntityUnLink([]byte("sport/#"), "ent2"))
+	requireReplicated(t, lt, ft, f)
+	conn.Close()
+	<-errs
+	<-errs
+
+	// It resumes within the backlog
+	require.NoError(t, lt.EntityLink([]byte("news/+"), "ent4"))
+	conn, errs = replicate(l, f)
+	requireReplicated(t, lt, ft, f)
+	conn.Close()
+	<-errs
+	<-errs
+
+	// and catches up from a snapshot beyond it
+	for _, ent := range []string{"ent5", "ent6", "ent7", "ent8", "ent9"} {
+		require.NoError(t, lt.EntityLink([]byte("weather/+"), ent))
+	}
+	require.NoError(t, lt.EntityUnLink([]byte("news/+"), nil))
+	conn, errs = replicate(l, f)
+	requireReplicated(t, lt, ft, f)
+
+	l.Close()
+	require.True(t, errors.Is(<-errs, ErrLeaderClosed))
+	conn.Close()
+	<-errs
+}
+
+func TestReplicationLimits(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// Changes are applied as the leader applied them, not limited again
+	lt, ft := NewTopicTree(), NewTopicTree(WithLimits(Limits{MaxLinksPerEntity: 1}))
+	defer func() {
+		require.NoError(t, lt.Close())
+		require.NoError(t, ft.Close())
+	}()
+
+	l := NewLeader(lt, stringCodec{}, 4)
+	f := NewFollower(ft, stringCodec{})
+	conn, errs := replicate(l, f)
+	require.NoError(t, lt.EntityLink([]byte("sport/#"), "ent1"))
+	require.NoError(t, lt.EntityLink([]byte("news/+"), "ent1"))
+	requireReplicated(t, lt, ft, f)
+
+	l.Close()
+	require.True(t, errors.Is(<-errs, ErrLeaderClosed))
+	conn.Close()
+	<-errs
+}
+
+func TestReplicationChained(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// A follower, watched by its own followers and hooks, publishes the
+	// differences of the snapshots it catches up from
+	filters := make(map[string]bool)
+	lt, ct := NewTopicTree(), NewTopicTree()
+	ft := NewTopicTree(WithHooks(Hooks{
+		OnFilterAdded:   func(filter []byte) { filters[string(filter)] = true },
+		OnFilterRemoved: func(filter []byte) { delete(filters, string(filter)) },
+	}))
+	defer func() {
+		require.NoError(t, lt.Close())
+		require.NoError(t, ft.Close())
+		require.NoError(t, ct.Close())
+	}()
+
+	require.NoError(t, lt.EntityLink([]byte("sport/tennis/+"), "ent1"))
+	require.NoError(t, lt.EntityLink([]byte("sport/#"), "ent2"))
+
+	l1, l2 := NewLeader(lt, stringCodec{}, 4), NewLeader(ft, stringCodec{}, 4)
+	f1, f2 := NewFollower(ft, stringCodec{}), NewFollower(ct, stringCodec{})
+	conn2, errs2 := replicate(l2, f2)
+	conn1, errs1 := replicate(l1, f1)
+	requireReplicated(t, lt, ft, f1)
+	requireReplicated(t, ft, ct, f2)
+	require.Equal(t, map[string]bool{"sport/tennis/+": true, "sport/#": true}, filters)
+	conn1.Close()
+	<-errs1
+	<-errs1
+
+	// beyond the backlog of the leader
+	require.NoError(t, lt.EntityUnLink([]byte("sport/#"), "ent2"))
+	for _, ent := range []string{"ent3", "ent4", "ent5", "ent6", "ent7"} {
+		require.NoError(t, lt.EntityLink([]byte("weather/+"), ent))
+	}
+	conn1, errs1 = replicate(l1, f1)
+	requireReplicated(t, lt, ft, f1)
+	requireReplicated(t, ft, ct, f2)
+	require.Equal(t, map[string]bool{"sport/tennis/+": true, "weather/+": true}, filters)
+
+	l1.Close()
+	require.True(t, errors.Is(<-errs1, ErrLeaderClosed))
+	conn1.Close()
+	<-errs1
+	l2.Close()
+	require.True(t, errors.Is(<-errs2, ErrLeaderClosed))
+	conn2.Close()
+	<-errs2
+}
+
+func TestReadFrame(t *testing.T) {
+	// Frames of hostile lengths are rejected without being allocated
+	for _, frame := range [][]byte{
+		{1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 1},
+		{1, 0xff, 0xff, 0xff, 0xff, 0x0f, 1, 2, 3},
+	} {
+		_, _, err := readFrame(bufio.NewReader(bytes.NewReader(frame)))
+		require.Error(t, err)
+	}
+
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	writeFrame(bw, frameChange, []byte("change"))
+	require.NoError(t, bw.Flush())
+	typ, payload, err := readFrame(bufio.NewReader(&buf))
+	require.NoError(t, err)
+	require.Equal(t, frameChange, typ)
+	require.Equal(t, []byte("change"), payload)
+}
+
+func TestWatcherLagged(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	w, seq := tt.Watch(1)
+	require.Equal(t, uint64(0), seq)
+	require.NoError(t, tt.EntityLink([]byte("sport/#"), "ent1"))
+	require.Error(t, tt.EntityUnLink([]byte("sport/#"), "ent2"))
+	require.NoError(t, tt.EntityLink([]byte("sport/#"), "ent2"))
+
+	c, ok := <-w.C
+	require.True(t, ok)
+	require.Equal(t, Change{Seq: 1, Op: ChangeLink, Topic: []byte("sport/#"), Entity: "ent1"}, c)
+	_, ok = <-w.C
+	require.False(t, ok)
+	require.True(t, w.Lagged())
+	require.Equal(t, uint64(2), tt.Seq())
+	w.Close()
+}
@@ -0,0 +1,168 @@
+package cabinet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrInvalidRewrite is returned for a rewrite rule with an invalid pattern or
+// template, and when a rewritten filter is invalid
+var ErrInvalidRewrite = errors.New("invalid rewrite")
+
+// RewriteRule rewrites the topics matched by Pattern, a topic filter, to
+// Template. A level '{n}' of the template is replaced by the level(s) matched
+// by the nth wildcard of the pattern, counting from 1: 'dev/+/t' rewritten to
+// 'devices/{1}/telemetry' turns 'dev/42/t' into 'devices/42/telemetry'.
+type RewriteRule struct {
+	Pattern  []byte
+	Template []byte
+}
+
+// Rewriter rewrites topics and filters with the first of its rules matching
+// them. It is safe for concurrent use.
+type Rewriter struct {
+	syntax *Syntax
+	rules  []rewriteRule
+}
+
+type rewriteRule struct {
+	pattern  [][]byte
+	template [][]byte
+	refs     []int // wildcard referenced by each level of the template, or 0
+}
+
+// NewRewriter returns a rewriter applying rules in order, in the MQTT syntax
+func NewRewriter(rules ...RewriteRule) (*Rewriter, error) {
+	return NewSyntaxRewriter(&mqttSyntax, rules...)
+}
+
+// NewSyntaxRewriter returns a rewriter applying rules in order, in a copy of
+// the syntax sx, which must be the one of the trees it is given to
+func NewSyntaxRewriter(sx *Syntax, rules ...RewriteRule) (*Rewriter, error) {
+	c := *sx
+	sx = &c
+	rw := &Rewriter{syntax: sx, rules: make([]rewriteRule, 0, len(rules))}
+	for _, r := range rules {
+		pattern, err := sx.levels(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("topicRewriter/NewRewriter: %s: %v: %w", r.Pattern, err, ErrInvalidRewrite)
+		}
+		var wildcards int
+		for _, level := range pattern {
+			if sx.isSWC(string(level)) || sx.isMWC(string(level)) {
+				wildcards++
+			}
+		}
+
+		if len(r.Template) == 0 {
+			return nil, fmt.Errorf("topicRewriter/NewRewriter: %s: empty template: %w", r.Pattern, ErrInvalidRewrite)
+		}
+		rr := rewriteRule{pattern: pattern, template: bytes.Split(r.Template, sx.sep())}
+		for _, level := range rr.template {
+			n := 0
+			if len(level) > 2 && level[0] == '{' && level[len(level)-1] == '}' {
+				if n, err = strconv.Atoi(string(level[1 : len(level)-1])); err != nil || n < 1 || n > wildcards {
+					return nil, fmt.Errorf("topicRewriter/NewRewriter: %s: no wildcard %s: %w", r.Template, level, ErrInvalidRewrite)
+				}
+			}
+			rr.refs = append(rr.refs, n)
+		}
+		rw.rules = append(rw.rules, rr)
+	}
+	return rw, nil
+}
+
+// Rewrite returns the topic name rewritten by the first rule matching it, or
+// topic itself when none does. The topic is split into levels as the tree
+// parses it, and left to the tree to reject when invalid.
+func (rw *Rewriter) Rewrite(topic []byte) []byte {
+	levels, err := rw.syntax.values(topic)
+	if err != nil {
+		return topic
+	}
+	for i := range rw.rules {
+		if captures, ok := rw.rules[i].match(rw.syntax, levels); ok {
+			return rw.rules[i].expand(rw.syntax, captures)
+		}
+	}
+	return topic
+}
+
+// RewriteFilter returns the topic filter rewritten by the first rule whose
+// pattern covers it, or filter itself when none does. Wildcards of the filter
+// are captured as any level: with the rule of RewriteRule, 'dev/+/t' becomes
+// 'devices/+/telemetry'. A filter only overlapping a pattern is not rewritten,
+// as some of the topics it matches would not be.
+func (rw *Rewriter) RewriteFilter(filter []byte) ([]byte, error) {
+	sx := rw.syntax
+	levels, err := sx.levels(filter)
+	if err != nil {
+		return nil, fmt.Errorf("topicRewriter/RewriteFilter: %w", err)
+	}
+	for i := range rw.rules {
+		if !sx.covers(rw.rules[i].pattern, levels) {
+			continue
+		}
+		captures, _ := rw.rules[i].match(sx, levels)
+		rewritten := rw.rules[i].expand(sx, captures)
+		if _, err := sx.levels(rewritten); err != nil {
+			return nil, fmt.Errorf("topicRewriter/RewriteFilter: %s to %s: %v: %w", filter, rewritten, err, ErrInvalidRewrite)
+		}
+		return rewritten, nil
+	}
+	return filter, nil
+}
+
+// match returns the levels matched by each wildcard of the pattern
+func (rr *rewriteRule) match(sx *Syntax, levels [][]byte) ([][]byte, bool) {
+	var captures [][]byte
+	for i, p := range rr.pattern {
+		switch {
+		case sx.isMWC(string(p)):
+			if i >= len(levels) {
+				return nil, false
+			}
+			return append(captures, bytes.Join(levels[i:], sx.sep())), true
+		case i >= len(levels):
+			return nil, false
+		case sx.isSWC(string(p)):
+			captures = append(captures, levels[i])
+		case !bytes.Equal(p, levels[i]):
+			return nil, false
+		}
+	}
+	return captures, len(rr.pattern) == len(levels)
+}
+
+func (rr *rewriteRule) expand(sx *Syntax, captures [][]byte) []byte {
+	var b []byte
+	for i, level := range rr.template {
+		if i > 0 {
+			b = append(b, sx.Separator)
+		}
+		if n := rr.refs[i]; n > 0 {
+			level = captures[n-1]
+		}
+		b = append(b, level...)
+	}
+	return b
+}
+
+// WithRewriter rewrites the topics given to LinkedEntities with rw. The tree
+// links nothing when rw is of another syntax; see Err.
+func WithRewriter(rw *Rewriter) TreeOption {
+	return func(tr *TTree) {
+		tr.topicRewriter = rw
+	}
+}
+
+// WithFilterRewriter rewrites the filters given to EntityLink and EntityUnLink
+// with rw, so that the tree only holds rewritten filters. The tree links
+// nothing when rw is of another syntax; see Err.
+func WithFilterRewriter(rw *Rewriter) TreeOption {
+	return func(tr *TTree) {
+		tr.filterRewriter = rw
+	}
+}
@@ -0,0 +1,134 @@
+package cabinet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestRewriter(t *testing.T) {
+	rw, err := NewRewriter(
+		RewriteRule{Pattern: []byte("dev/+/t"), Template: []byte("devices/{1}/telemetry")},
+		RewriteRule{Pattern: []byte("dev/+/+"), Template: []byte("devices/{1}/{2}")},
+		RewriteRule{Pattern: []byte("legacy/#"), Template: []byte("v2/{1}")},
+		RewriteRule{Pattern: []byte("swap/+/+"), Template: []byte("swap/{2}/{1}/{2}")},
+		RewriteRule{Pattern: []byte("alias"), Template: []byte("real/topic")},
+	)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		topic, want string
+	}{
+		{"dev/42/t", "devices/42/telemetry"},
+		{"dev/42/status", "devices/42/status"},
+		{"dev/42", "dev/42"},
+		{"dev/42/t/x", "dev/42/t/x"},
+		{"dev//t", "devices//telemetry"},
+		{"dev/42/", "dev/42/"}, // parsed as 'dev/42' by the tree
+		{"legacy/", "legacy/"},
+		{"legacy//a", "v2//a"},
+		{"dev/a+/t", "dev/a+/t"}, // invalid, left to the tree
+		{"legacy/a/b/c", "v2/a/b/c"},
+		{"legacy", "legacy"},
+		{"swap/a/b", "swap/b/a/b"},
+		{"alias", "real/topic"},
+		{"other", "other"},
+	} {
+		require.Equal(t, c.want, string(rw.Rewrite([]byte(c.topic))), c.topic)
+	}
+
+	for _, c := range []struct {
+		filter, want string
+	}{
+		{"dev/+/t", "devices/+/telemetry"},
+		{"dev/42/t", "devices/42/telemetry"},
+		{"dev/+/+", "devices/+/+"},
+		{"dev/#", "dev/#"}, // only overlaps the patterns
+		{"legacy/+/#", "v2/+/#"},
+		{"legacy/#", "v2/#"},
+		{"alias", "real/topic"},
+		{"+", "+"},
+	} {
+		filter, err := rw.RewriteFilter([]byte(c.filter))
+		require.NoError(t, err)
+		require.Equal(t, c.want, string(filter), c.filter)
+	}
+	_, err = rw.RewriteFilter([]byte("dev/#/t"))
+	require.Error(t, err)
+
+	// A wildcard captured by a filter must end up where it is valid
+	rw, err = NewRewriter(RewriteRule{Pattern: []byte("a/#"), Template: []byte("b/{1}/c")})
+	require.NoError(t, err)
+	_, err = rw.RewriteFilter([]byte("a/x/#"))
+	require.True(t, errors.Is(err, ErrInvalidRewrite))
+
+	for _, r := range []RewriteRule{
+		{Pattern: []byte("a/#/b"), Template: []byte("b")},
+		{Pattern: []byte("a/+"), Template: []byte("b/{2}")},
+		{Pattern: []byte("a/+"), Template: []byte("b/{0}")},
+		{Pattern: []byte("a/+"), Template: []byte("b/{x}")},
+		{Pattern: []byte("a"), Template: nil},
+	} {
+		_, err := NewRewriter(r)
+		require.True(t, errors.Is(err, ErrInvalidRewrite), "%s %s", r.Pattern, r.Template)
+	}
+}
+
+func TestTreeRewrite(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	rw, err := NewRewriter(RewriteRule{Pattern: []byte("dev/+/t"), Template: []byte("devices/{1}/telemetry")})
+	require.NoError(t, err)
+
+	tt := NewTopicTree(WithRewriter(rw), WithFilterRewriter(rw))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	require.NoError(t, tt.EntityLink([]byte("devices/+/telemetry"), "ent1"))
+	require.NoError(t, tt.EntityLink([]byte("dev/7/t"), "ent2"))
+
+	entities := make([]interface{}, 0, 2)
+	require.NoError(t, tt.LinkedEntities([]byte("dev/7/t"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent1", "ent2"}, entities)
+	require.NoError(t, tt.LinkedEntities([]byte("devices/7/telemetry"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent1", "ent2"}, entities)
+
+	require.NoError(t, tt.EntityUnLink([]byte("dev/7/t"), "ent2"))
+	require.NoError(t, tt.EntityUnLink([]byte("dev/+/t"), "ent1"))
+	require.NoError(t, tt.LinkedEntities([]byte("dev/7/t"), &entities))
+	require.Empty(t, entities)
+}
+
+func TestTreeRewriteSyntax(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	rw, err := NewSyntaxRewriter(NATS, RewriteRule{Pattern: []byte("dev.*.t"), Template: []byte("devices.{1}.telemetry")})
+	require.NoError(t, err)
+	filter, err := rw.RewriteFilter([]byte("dev.>"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("dev.>"), filter)
+
+	tt := NewTopicTree(WithSyntax(NATS), WithRewriter(rw), WithFilterRewriter(rw))
+	require.NoError(t, tt.Err())
+	require.NoError(t, tt.EntityLink([]byte("dev.*.t"), "ent1"))
+
+	entities := make([]interface{}, 0, 1)
+	require.NoError(t, tt.LinkedEntities([]byte("devices.7.telemetry"), &entities))
+	require.Equal(t, []interface{}{"ent1"}, entities)
+	require.NoError(t, tt.Close())
+
+	// Rewriters of another syntax fail the tree
+	mqtt, err := NewRewriter(RewriteRule{Pattern: []byte("dev/+/t"), Template: []byte("devices/{1}/telemetry")})
+	require.NoError(t, err)
+	tt = NewTopicTree(WithSyntax(NATS), WithFilterRewriter(mqtt))
+	require.True(t, errors.Is(tt.Err(), ErrInvalidRewrite))
+	require.True(t, errors.Is(tt.EntityLink([]byte("dev.*.t"), "ent1"), ErrInvalidRewrite))
+	require.True(t, errors.Is(tt.apply(walLink, []byte("dev.*.t"), "ent1"), ErrInvalidRewrite))
+	require.True(t, errors.Is(tt.replace([]link{{filter: []byte("dev.*.t"), entity: "ent1"}}), ErrInvalidRewrite))
+	require.NoError(t, tt.LinkedEntities([]byte("devices.7.telemetry"), &entities))
+	require.Empty(t, entities)
+	require.NoError(t, tt.Close())
+}
@@ -0,0 +1,386 @@
+package cabinet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrNoSession is returned by session backends loading an unknown session
+var ErrNoSession = errors.New("no session")
+
+// Linker links entities to topic filters. TTree is a Linker, and protocol
+// packages may wrap it to handle their own filter syntax.
+type Linker interface {
+	EntityLink(filter []byte, entity interface{}) error
+	EntityUnLink(filter []byte, entity interface{}) error
+}
+
+// SessionLink is a topic filter recorded in a session
+type SessionLink struct {
+	Filter []byte
+
+	// Data is kept along with the filter, like the options of a subscription
+	Data []byte
+}
+
+// SessionBackend persists the links of the sessions by identifier
+type SessionBackend interface {
+	// Load returns ErrNoSession for an unknown session
+	Load(id string) ([]SessionLink, error)
+	Save(id string, links []SessionLink) error
+	Delete(id string) error
+}
+
+// SessionStore records the links of each session while linking them to the
+// tree, so that they can be linked again to the entities of a new connection
+// when the session resumes, possibly after a restart. A session must be
+// resumed before linking to it.
+type SessionStore struct {
+	l       Linker
+	backend SessionBackend
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	links    map[string]SessionLink
+	entities map[string]interface{} // nil while detached
+}
+
+// NewSessionStore returns a store linking through l and persisting to backend
+func NewSessionStore(l Linker, backend SessionBackend) *SessionStore {
+	return &SessionStore{l: l, backend: backend, sessions: make(map[string]*session)}
+}
+
+// Resume links every filter recorded in session id to the entity returned for
+// it, and reports whether the session existed. Links of a session still
+// attached are first unlinked from their previous entities.
+func (s *SessionStore) Resume(id string, entity func(l SessionLink) interface{}) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss, err := s.session(id)
+	if err != nil {
+		return false, err
+	}
+	if ss == nil {
+		s.sessions[id] = &session{links: make(map[string]SessionLink), entities: make(map[string]interface{})}
+		return false, nil
+	}
+
+	s.detach(ss)
+	ss.entities = make(map[string]interface{}, len(ss.links))
+	for key, l := range ss.links {
+		e := entity(l)
+		if err := s.l.EntityLink(l.Filter, e); err != nil {
+			return true, fmt.Errorf("sessionStore/Resume: %s: %w", l.Filter, err)
+		}
+		ss.entities[key] = e
+	}
+	return true, nil
+}
+
+// Link links entity to filter and records it in session id, replacing the
+// entity previously linked to the same filter
+func (s *SessionStore) Link(id string, filter []byte, data []byte, entity interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss, err := s.attached(id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.l.EntityLink(filter, entity); err != nil {
+		return err
+	}
+	key := string(filter)
+	old, hadOld := ss.entities[key]
+	replaced := hadOld && !equal(old, entity)
+	if replaced {
+		s.l.EntityUnLink(filter, old)
+	}
+	prev, recorded := ss.links[key]
+	ss.entities[key] = entity
+	ss.links[key] = SessionLink{Filter: append([]byte(nil), filter...), Data: append([]byte(nil), data...)}
+
+	if err := s.save(id, ss); err != nil {
+		// Roll back, so that no link is left unrecorded
+		if !hadOld || replaced {
+			s.l.EntityUnLink(filter, entity)
+		}
+		if hadOld {
+			if replaced {
+				s.l.EntityLink(filter, old)
+			}
+			ss.entities[key] = old
+		} else {
+			delete(ss.entities, key)
+		}
+		if recorded {
+			ss.links[key] = prev
+		} else {
+			delete(ss.links, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// UnLink unlinks filter and removes it from session id
+func (s *SessionStore) UnLink(id string, filter []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss, err := s.attached(id)
+	if err != nil {
+		return err
+	}
+
+	key := string(filter)
+	entity, ok := ss.entities[key]
+	if !ok {
+		return fmt.Errorf("sessionStore/UnLink: %s: %w", filter, ErrNotLinked)
+	}
+	delete(ss.entities, key)
+	delete(ss.links, key)
+	if err := s.l.EntityUnLink(filter, entity); err != nil {
+		return err
+	}
+
+	return s.save(id, ss)
+}
+
+// Detach unlinks the entities of session id and keeps its links recorded, as
+// when the connection of a persistent session is lost
+func (s *SessionStore) Detach(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ss, ok := s.sessions[id]; ok {
+		s.detach(ss)
+	}
+}
+
+// Remove unlinks the entities of session id and deletes its links, as when
+// the session ends. A new session then starts with the next Resume.
+func (s *SessionStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ss, ok := s.sessions[id]; ok {
+		s.detach(ss)
+		delete(s.sessions, id)
+	}
+	return s.backend.Delete(id)
+}
+
+// Links returns the links recorded in session id, sorted by filter
+func (s *SessionStore) Links(id string) ([]SessionLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss, err := s.session(id)
+	if err != nil || ss == nil {
+		return nil, err
+	}
+	return sortedLinks(ss), nil
+}
+
+// session returns the session id, loading it from the backend if needed. It
+// returns nil for an unknown session.
+func (s *SessionStore) session(id string) (*session, error) {
+	if ss, ok := s.sessions[id]; ok {
+		return ss, nil
+	}
+
+	links, err := s.backend.Load(id)
+	if errors.Is(err, ErrNoSession) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sessionStore/load: %w", err)
+	}
+
+	ss := &session{links: make(map[string]SessionLink, len(links))}
+	for _, l := range links {
+		ss.links[string(l.Filter)] = l
+	}
+	s.sessions[id] = ss
+	return ss, nil
+}
+
+// attached returns the session id, which must have been resumed
+func (s *SessionStore) attached(id string) (*session, error) {
+	ss, ok := s.sessions[id]
+	if !ok || ss.entities == nil {
+		return nil, fmt.Errorf("sessionStore: session %q is not resumed", id)
+	}
+	return ss, nil
+}
+
+func (s *SessionStore) detach(ss *session) {
+	for key, e := range ss.entities {
+		s.l.EntityUnLink(ss.links[key].Filter, e)
+	}
+	ss.entities = nil
+}
+
+func (s *SessionStore) save(id string, ss *session) error {
+	if err := s.backend.Save(id, sortedLinks(ss)); err != nil {
+		return fmt.Errorf("sessionStore/save: %w", err)
+	}
+	return nil
+}
+
+func sortedLinks(ss *session) []SessionLink {
+	links := make([]SessionLink, 0, len(ss.links))
+	for _, l := range ss.links {
+		links = append(links, l)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return string(links[i].Filter) < string(links[j].Filter)
+	})
+	return links
+}
+
+// MemorySessionBackend keeps the sessions in memory, so that they survive
+// reconnects but not restarts
+type MemorySessionBackend struct {
+	mu       sync.Mutex
+	sessions map[string][]SessionLink
+}
+
+// NewMemorySessionBackend returns an empty in-memory backend
+func NewMemorySessionBackend() *MemorySessionBackend {
+	return &MemorySessionBackend{sessions: make(map[string][]SessionLink)}
+}
+
+func (b *MemorySessionBackend) Load(id string) ([]SessionLink, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	links, ok := b.sessions[id]
+	if !ok {
+		return nil, ErrNoSession
+	}
+	return append([]SessionLink(nil), links...), nil
+}
+
+func (b *MemorySessionBackend) Save(id string, links []SessionLink) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sessions[id] = append([]SessionLink(nil), links...)
+	return nil
+}
+
+func (b *MemorySessionBackend) Delete(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.sessions, id)
+	return nil
+}
+
+// FileSessionBackend keeps each session in a JSON file of a directory, named
+// after the client identifier, or its hash when too long for a file name. The
+// identifier is kept in the file. Files are replaced atomically, so a crash
+// leaves either version of a session.
+type FileSessionBackend struct {
+	dir string
+}
+
+// NewFileSessionBackend returns a backend storing the sessions in dir, which
+// is created if needed
+func NewFileSessionBackend(dir string) (*FileSessionBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileSessionBackend{dir: dir}, nil
+}
+
+// maxSessionName bounds the length of the hex encoded identifiers naming the
+// files, below the 255 bytes file names are limited to
+const maxSessionName = 200
+
+// sessionFile is the content of the file of a session
+type sessionFile struct {
+	ID    string        `json:"id"`
+	Links []SessionLink `json:"links"`
+}
+
+// path returns the file of session id. Identifiers are hex encoded, as they
+// may hold any character, and longer ones hashed.
+func (b *FileSessionBackend) path(id string) string {
+	name := hex.EncodeToString([]byte(id))
+	if len(name) > maxSessionName {
+		sum := sha256.Sum256([]byte(id))
+		name = "sha256-" + hex.EncodeToString(sum[:])
+	}
+	return filepath.Join(b.dir, name+".session")
+}
+
+func (b *FileSessionBackend) Load(id string) ([]SessionLink, error) {
+	data, err := ioutil.ReadFile(b.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNoSession
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sf sessionFile
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return nil, fmt.Errorf("fileSessionBackend/Load: %s: %w", id, err)
+	}
+	if sf.ID != id {
+		// The file of another identifier of the same hash
+		return nil, ErrNoSession
+	}
+	return sf.Links, nil
+}
+
+func (b *FileSessionBackend) Save(id string, links []SessionLink) error {
+	data, err := json.Marshal(sessionFile{ID: id, Links: links})
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(b.dir, ".session-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), b.path(id))
+}
+
+func (b *FileSessionBackend) Delete(id string) error {
+	err := os.Remove(b.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,192 @@
+package cabinet
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestSessionStore(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+	backend := NewMemorySessionBackend()
+	ss := NewSessionStore(tt, backend)
+
+	entities := make([]interface{}, 0, 4)
+
+	// A new session is not present, and must be resumed to be linked
+	require.Error(t, ss.Link("dev1", []byte("sport/#"), nil, "conn1"))
+	present, err := ss.Resume("dev1", nil)
+	require.NoError(t, err)
+	require.False(t, present)
+
+	require.NoError(t, ss.Link("dev1", []byte("sport/#"), []byte{1}, "conn1"))
+	require.NoError(t, ss.Link("dev1", []byte("news/+"), nil, "conn1"))
+	require.NoError(t, tt.LinkedEntities([]byte("sport/tennis"), &entities))
+	require.Equal(t, []interface{}{"conn1"}, entities)
+
+	// Linking the same filter again replaces the entity
+	require.NoError(t, ss.Link("dev1", []byte("news/+"), []byte{2}, "conn1/news"))
+	require.NoError(t, tt.LinkedEntities([]byte("news/today"), &entities))
+	require.Equal(t, []interface{}{"conn1/news"}, entities)
+
+	links, err := backend.Load("dev1")
+	require.NoError(t, err)
+	require.Equal(t, []SessionLink{
+		{Filter: []byte("news/+"), Data: []byte{2}},
+		{Filter: []byte("sport/#"), Data: []byte{1}},
+	}, links)
+
+	// Detaching keeps the links recorded
+	ss.Detach("dev1")
+	require.NoError(t, tt.LinkedEntities([]byte("sport/tennis"), &entities))
+	require.Empty(t, entities)
+
+	// A new store, as after a restart, resumes them for a new connection
+	ss = NewSessionStore(tt, backend)
+	present, err = ss.Resume("dev1", func(l SessionLink) interface{} {
+		return "conn2:" + string(l.Filter)
+	})
+	require.NoError(t, err)
+	require.True(t, present)
+	require.NoError(t, tt.LinkedEntities([]byte("sport/tennis"), &entities))
+	require.Equal(t, []interface{}{"conn2:sport/#"}, entities)
+
+	require.NoError(t, ss.UnLink("dev1", []byte("sport/#")))
+	require.True(t, errors.Is(ss.UnLink("dev1", []byte("sport/#")), ErrNotLinked))
+	links, err = ss.Links("dev1")
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+
+	// Removing ends the session
+	require.NoError(t, ss.Remove("dev1"))
+	require.NoError(t, tt.LinkedEntities([]byte("news/today"), &entities))
+	require.Empty(t, entities)
+	_, err = backend.Load("dev1")
+	require.True(t, errors.Is(err, ErrNoSession))
+}
+
+// failingBackend fails to save once fail is set
+type failingBackend struct {
+	*MemorySessionBackend
+	fail bool
+}
+
+func (b *failingBackend) Save(id string, links []SessionLink) error {
+	if b.fail {
+		return errors.New("disk full")
+	}
+	return b.MemorySessionBackend.Save(id, links)
+}
+
+func TestSessionStoreRollback(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+	backend := &failingBackend{MemorySessionBackend: NewMemorySessionBackend()}
+	ss := NewSessionStore(tt, backend)
+
+	_, err := ss.Resume("dev1", nil)
+	require.NoError(t, err)
+	require.NoError(t, ss.Link("dev1", []byte("news/+"), []byte{1}, "conn1"))
+	backend.fail = true
+
+	// A failed save leaves neither the tree nor the session changed
+	entities := make([]interface{}, 0, 4)
+	require.Error(t, ss.Link("dev1", []byte("sport/#"), nil, "conn1"))
+	require.NoError(t, tt.LinkedEntities([]byte("sport/tennis"), &entities))
+	require.Empty(t, entities)
+
+	require.Error(t, ss.Link("dev1", []byte("news/+"), []byte{2}, "conn1/news"))
+	require.NoError(t, tt.LinkedEntities([]byte("news/today"), &entities))
+	require.Equal(t, []interface{}{"conn1"}, entities)
+
+	require.Error(t, ss.Link("dev1", []byte("news/+"), []byte{3}, "conn1"))
+	require.NoError(t, tt.LinkedEntities([]byte("news/today"), &entities))
+	require.Equal(t, []interface{}{"conn1"}, entities)
+
+	links, err := ss.Links("dev1")
+	require.NoError(t, err)
+	require.Equal(t, []SessionLink{{Filter: []byte("news/+"), Data: []byte{1}}}, links)
+
+	// Nor do later links of the session
+	backend.fail = false
+	require.NoError(t, ss.Link("dev1", []byte("news/+"), []byte{2}, "conn1/news"))
+	require.NoError(t, tt.LinkedEntities([]byte("news/today"), &entities))
+	require.Equal(t, []interface{}{"conn1/news"}, entities)
+}
+
+func TestFileSessionBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cabinet-sessions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	b, err := NewFileSessionBackend(dir)
+	require.NoError(t, err)
+
+	_, err = b.Load("dev/1")
+	require.True(t, errors.Is(err, ErrNoSession))
+
+	links := []SessionLink{{Filter: []byte("sport/#"), Data: []byte{1}}}
+	require.NoError(t, b.Save("dev/1", links))
+	require.NoError(t, b.Save("dev/2", nil))
+
+	b, err = NewFileSessionBackend(dir)
+	require.NoError(t, err)
+	loaded, err := b.Load("dev/1")
+	require.NoError(t, err)
+	require.Equal(t, links, loaded)
+
+	require.NoError(t, b.Delete("dev/1"))
+	require.NoError(t, b.Delete("dev/1"))
+	_, err = b.Load("dev/1")
+	require.True(t, errors.Is(err, ErrNoSession))
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	// Identifiers too long for a file name are hashed, and kept in the file
+	long := strings.Repeat("d", 65535)
+	require.NoError(t, b.Save(long, links))
+	loaded, err = b.Load(long)
+	require.NoError(t, err)
+	require.Equal(t, links, loaded)
+	_, err = b.Load(long[1:])
+	require.True(t, errors.Is(err, ErrNoSession))
+	require.NoError(t, b.Delete(long))
+	_, err = b.Load(long)
+	require.True(t, errors.Is(err, ErrNoSession))
+}
+
+func TestSessionStoreNotComparable(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+	ss := NewSessionStore(tt, NewMemorySessionBackend())
+
+	// Relinking entities which are not comparable does not panic
+	_, err := ss.Resume("dev1", nil)
+	require.NoError(t, err)
+	require.NoError(t, ss.Link("dev1", []byte("news/+"), nil, []int{1}))
+	require.NoError(t, ss.Link("dev1", []byte("news/+"), nil, []int{2}))
+	require.NoError(t, ss.Link("dev1", []byte("news/+"), nil, "conn1"))
+	links, err := ss.Links("dev1")
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+}
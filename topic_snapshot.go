@@ -0,0 +1,235 @@
+package cabinet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// ErrInvalidSnapshot is returned when restoring a corrupt or unknown snapshot
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// snapshotMagic starts every snapshot, followed by the format version
+const snapshotMagic = "CBTS"
+
+const snapshotVersion byte = 1
+
+// link is an entity and the topic filter it is linked to
+type link struct {
+	filter []byte
+	entity interface{}
+}
+
+// links returns every link of the tree and the sequence number of the last
+// change they include, taken under the read lock
+func (tr *TTree) links() ([]link, uint64) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+
+	return tr.linksLocked()
+}
+
+// linksLocked returns what links does, under the lock held by the caller
+func (tr *TTree) linksLocked() ([]link, uint64) {
+	var links []link
+	tr.root.walkLinks(tr.syntax, make([]byte, 0, 64), func(filter []byte, entity interface{}) {
+		links = append(links, link{filter: append([]byte(nil), filter...), entity: entity})
+	})
+	return links, tr.seq
+}
+
+// Snapshot writes every link of the tree to w. The links are collected under
+// the read lock, and only encoded and written once it is released.
+//
+// The format is the magic 'CBTS', a version byte, the uvarint count of links,
+// then for each link the uvarint length prefixed filter and encoded entity,
+// and finally the big-endian CRC-32C of all that precedes. The tree keeps no
+// options along with its links, the version leaves room to add them.
+func (tr *TTree) Snapshot(w io.Writer, codec EntityCodec) error {
+	links, _ := tr.links()
+	return writeSnapshot(w, codec, links)
+}
+
+func writeSnapshot(w io.Writer, codec EntityCodec, links []link) error {
+	crc := crc32.New(walTable)
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	var b [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		bw.Write(b[:binary.PutUvarint(b[:], v)])
+	}
+
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+	putUvarint(uint64(len(links)))
+	for _, l := range links {
+		data, err := codec.EncodeEntity(l.entity)
+		if err != nil {
+			return fmt.Errorf("topicTree/Snapshot: %s: %w", l.filter, err)
+		}
+		putUvarint(uint64(len(l.filter)))
+		bw.Write(l.filter)
+		putUvarint(uint64(len(data)))
+		bw.Write(data)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(b[:4], crc.Sum32())
+	_, err := w.Write(b[:4])
+	return err
+}
+
+// Restore links the entities of a snapshot read from r to the tree, usually
+// empty. The whole snapshot is read and verified before the tree is locked,
+// so nothing is linked from a corrupt one, and the links are restored all or
+// none. They are published as changes to the watchers and the hooks, as if
+// linked in order, but not appended to the write-ahead log of the tree, which
+// a snapshot is meant to replace.
+func (tr *TTree) Restore(r io.Reader, codec EntityCodec) error {
+	if tr.err != nil {
+		return tr.err
+	}
+	links, err := readSnapshot(r, codec)
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		if err := tr.syntax.validateFilter(l.filter); err != nil {
+			return fmt.Errorf("topicTree/Restore: %w", err)
+		}
+	}
+
+	ops := make([]nodeOp, len(links))
+	tr.mu.Lock()
+	for i, l := range links {
+		if err := tr.insert(l.filter, l.entity, &ops[i]); err != nil {
+			// Unlink what was linked by the restore only
+			for j := i - 1; j >= 0; j-- {
+				if ops[j].added {
+					tr.remove(links[j].filter, links[j].entity, nil)
+				}
+			}
+			tr.mu.Unlock()
+			return fmt.Errorf("topicTree/Restore: %s: %w", l.filter, err)
+		}
+	}
+	seq := tr.seq
+	for _, l := range links {
+		tr.notify(ChangeLink, l.filter, l.entity)
+	}
+	tr.mu.Unlock()
+
+	for i, l := range links {
+		tr.runHooks(seq+uint64(i)+1, l.filter, l.entity, &ops[i])
+	}
+	return nil
+}
+
+// readSnapshot reads the links of a snapshot, decoding their entities once the
+// checksum of the whole snapshot is verified
+func readSnapshot(r io.Reader, codec EntityCodec) ([]link, error) {
+	sr := &snapshotReader{r: bufio.NewReader(r), crc: crc32.New(walTable)}
+
+	magic := make([]byte, len(snapshotMagic)+1)
+	sr.read(magic)
+	if sr.err == nil && (string(magic[:len(snapshotMagic)]) != snapshotMagic || magic[len(snapshotMagic)] != snapshotVersion) {
+		return nil, fmt.Errorf("topicTree/Restore: unknown format %q: %w", magic, ErrInvalidSnapshot)
+	}
+
+	n := sr.uvarint()
+	var (
+		links []link
+		data  [][]byte
+	)
+	for i := uint64(0); i < n && sr.err == nil; i++ {
+		filter := sr.bytes()
+		d := sr.bytes()
+		if sr.err != nil {
+			break
+		}
+		links = append(links, link{filter: filter})
+		data = append(data, d)
+	}
+
+	sum := sr.crc.Sum32()
+	var b [4]byte
+	sr.read(b[:])
+	if sr.err != nil {
+		return nil, fmt.Errorf("topicTree/Restore: %s: %w", sr.err, ErrInvalidSnapshot)
+	}
+	if binary.BigEndian.Uint32(b[:]) != sum {
+		return nil, fmt.Errorf("topicTree/Restore: checksum mismatch: %w", ErrInvalidSnapshot)
+	}
+
+	for i := range links {
+		entity, err := codec.DecodeEntity(data[i])
+		if err != nil {
+			return nil, fmt.Errorf("topicTree/Restore: %s: %w", links[i].filter, err)
+		}
+		links[i].entity = entity
+	}
+	return links, nil
+}
+
+// snapshotReader reads a snapshot, keeping the first error and the checksum of
+// what it read
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	err error
+}
+
+func (sr *snapshotReader) read(p []byte) {
+	if sr.err != nil {
+		return
+	}
+	if _, sr.err = io.ReadFull(sr.r, p); sr.err == nil {
+		sr.crc.Write(p)
+	}
+}
+
+func (sr *snapshotReader) uvarint() uint64 {
+	var (
+		v uint64
+		b [1]byte
+	)
+	for shift := uint(0); shift < 64; shift += 7 {
+		sr.read(b[:])
+		if sr.err != nil {
+			return 0
+		}
+		v |= uint64(b[0]&0x7f) << shift
+		if b[0] < 0x80 {
+			return v
+		}
+	}
+	sr.err = errors.New("uvarint overflow")
+	return 0
+}
+
+// bytes reads a length prefixed byte string, without trusting the length for
+// the allocation
+func (sr *snapshotReader) bytes() []byte {
+	n := sr.uvarint()
+	if sr.err != nil {
+		return nil
+	}
+	var p []byte
+	for n > 0 && sr.err == nil {
+		chunk := n
+		if chunk > 4096 {
+			chunk = 4096
+		}
+		buf := make([]byte, chunk)
+		sr.read(buf)
+		p = append(p, buf...)
+		n -= chunk
+	}
+	return p
+}
@@ -0,0 +1,128 @@
+package cabinet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestSnapshot(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+	require.NoError(t, tt.EntityLink([]byte("sport/tennis/+"), "ent1"))
+	require.NoError(t, tt.EntityLink([]byte("sport/#"), "ent2"))
+	require.NoError(t, tt.EntityLink([]byte("sport/#"), "ent3"))
+	require.NoError(t, tt.EntityLink([]byte("/finance"), "ent4"))
+	require.NoError(t, tt.EntityLink([]byte("#"), "ent5"))
+
+	var buf bytes.Buffer
+	require.NoError(t, tt.Snapshot(&buf, stringCodec{}))
+	snapshot := append([]byte(nil), buf.Bytes()...)
+
+	rt := NewTopicTree()
+	defer func() {
+		require.NoError(t, rt.Close())
+	}()
+	require.NoError(t, rt.Restore(&buf, stringCodec{}))
+
+	entities := make([]interface{}, 0, 5)
+	require.NoError(t, rt.LinkedEntities([]byte("sport/tennis/final"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent1", "ent2", "ent3", "ent5"}, entities)
+	require.NoError(t, rt.LinkedEntities([]byte("/finance"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent4", "ent5"}, entities)
+
+	// The restored tree is identical, so is its snapshot
+	buf.Reset()
+	require.NoError(t, rt.Snapshot(&buf, stringCodec{}))
+	require.Equal(t, snapshot, buf.Bytes())
+
+	// Entities the codec cannot encode fail the snapshot
+	require.NoError(t, rt.EntityLink([]byte("sport"), 5))
+	require.Error(t, rt.Snapshot(&buf, stringCodec{}))
+
+	// Nothing is linked from a corrupt or truncated snapshot
+	et := NewTopicTree()
+	defer func() {
+		require.NoError(t, et.Close())
+	}()
+	corrupt := append([]byte(nil), snapshot...)
+	corrupt[10] ^= 0xff
+	for _, b := range [][]byte{corrupt, snapshot[:len(snapshot)-1], []byte("CBTS\x09")} {
+		err := et.Restore(bytes.NewReader(b), stringCodec{})
+		require.True(t, errors.Is(err, ErrInvalidSnapshot))
+		require.Empty(t, et.root.nltNodes)
+	}
+
+	// The checksum is verified before the entities are decoded
+	err := et.Restore(bytes.NewReader(corrupt), failingCodec{})
+	require.True(t, errors.Is(err, ErrInvalidSnapshot), "%v", err)
+	err = et.Restore(bytes.NewReader(snapshot), failingCodec{})
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrInvalidSnapshot))
+
+	// and the links restored all or none
+	buf.Reset()
+	require.NoError(t, writeSnapshot(&buf, stringCodec{}, []link{
+		{filter: []byte("a"), entity: "ent1"},
+		{filter: []byte("b/#/c"), entity: "ent1"},
+	}))
+	require.Error(t, et.Restore(&buf, stringCodec{}))
+	require.Empty(t, et.root.nltNodes)
+	require.Equal(t, Stats{}, et.Stats())
+}
+
+// failingCodec encodes string entities, and fails to decode them
+type failingCodec struct {
+	stringCodec
+}
+
+func (failingCodec) DecodeEntity(data []byte) (interface{}, error) {
+	return nil, errors.New("cannot decode")
+}
+
+func TestSnapshotChanges(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+	require.NoError(t, tt.EntityLink([]byte("sport/#"), "ent1"))
+	require.NoError(t, tt.EntityLink([]byte("news/+"), "ent2"))
+	var buf bytes.Buffer
+	require.NoError(t, tt.Snapshot(&buf, stringCodec{}))
+
+	// Restored links are published to the watchers and the hooks
+	var added []string
+	rt := NewTopicTree(WithHooks(Hooks{
+		OnLink: func(filter []byte, entity interface{}) { added = append(added, string(filter)) },
+	}))
+	defer func() {
+		require.NoError(t, rt.Close())
+	}()
+	require.NoError(t, rt.EntityLink([]byte("weather"), "ent3"))
+	w, seq := rt.Watch(4)
+	defer w.Close()
+	require.NoError(t, rt.Restore(&buf, stringCodec{}))
+
+	require.Equal(t, []string{"weather", "news/+", "sport/#"}, added)
+	for _, topic := range []string{"news/+", "sport/#"} {
+		c := <-w.C
+		seq++
+		require.Equal(t, seq, c.Seq)
+		require.Equal(t, ChangeLink, c.Op)
+		require.Equal(t, topic, string(c.Topic))
+	}
+	require.Equal(t, seq, rt.Seq())
+
+	// and the hooks keep running in order after them
+	require.NoError(t, rt.EntityLink([]byte("weather/+"), "ent3"))
+	require.Equal(t, "weather/+", added[len(added)-1])
+}
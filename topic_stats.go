@@ -0,0 +1,133 @@
+package cabinet
+
+import (
+	"reflect"
+)
+
+// Stats are the sizes of a tree, kept as it changes rather than walked
+type Stats struct {
+	Nodes           int // but the root, one for each level of the distinct filters
+	Links           int // of entities to filters
+	Entities        int // distinct, counting each link of the entities not comparable
+	Filters         int // distinct, linked to some entity
+	WildcardFilters int // distinct filters with wildcards
+	MaxDepth        int // the number of levels of the deepest filter
+	Bytes           int // approximate memory of the nodes and links
+}
+
+// Stats returns the sizes of the tree
+func (tr *TTree) Stats() Stats {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+
+	c := &tr.counts
+	return Stats{
+		Nodes:           c.nodes,
+		Links:           c.links,
+		Entities:        len(c.entities) + c.others,
+		Filters:         c.filters,
+		WildcardFilters: c.wildcards,
+		MaxDepth:        len(c.depths),
+		Bytes:           c.bytes,
+	}
+}
+
+// The approximate memory of the parts of a tree
+var (
+	nodeBytes     = int(reflect.TypeOf(tNode{}).Size()) + 48 // and its empty map
+	childBytes    = 32                                       // a level and a node in a map
+	linkBytes     = int(reflect.TypeOf((*interface{})(nil)).Elem().Size())
+	linkTextBytes = int(reflect.TypeOf("").Size()) // its text, normalized
+)
+
+// counts are the sizes of a tree, kept as it changes
+type counts struct {
+	nodes     int
+	links     int
+	filters   int
+	wildcards int
+	bytes     int
+
+	entities map[interface{}]int // filters linked to each comparable entity
+	others   int                 // links of the entities not comparable
+
+	depths []int // the number of filters of each depth, from 1 to the max
+}
+
+// record counts the changes of a tree operation on entity
+func (c *counts) record(entity interface{}, op *nodeOp) {
+	c.nodes += op.nodes
+	c.bytes += op.bytes
+	if op.added && op.first || op.last {
+		n := 1
+		if op.last {
+			n = -1
+		}
+		c.filters += n
+		if op.wildcard {
+			c.wildcards += n
+		}
+		c.depth(op.depth, n)
+	}
+	if op.added {
+		c.link(entity, 1)
+	}
+	for _, e := range op.removed {
+		c.link(e, -1)
+	}
+}
+
+// depth counts n more filters of a depth
+func (c *counts) depth(depth, n int) {
+	if depth == 0 {
+		return
+	}
+	for len(c.depths) < depth {
+		c.depths = append(c.depths, 0)
+	}
+	c.depths[depth-1] += n
+	for len(c.depths) > 0 && c.depths[len(c.depths)-1] == 0 {
+		c.depths = c.depths[:len(c.depths)-1]
+	}
+}
+
+// link counts n more links of entity
+func (c *counts) link(entity interface{}, n int) {
+	c.links += n
+	if !isComparable(reflect.ValueOf(entity)) {
+		c.others += n
+		return
+	}
+	if c.entities == nil {
+		c.entities = make(map[interface{}]int)
+	}
+	if n += c.entities[entity]; n > 0 {
+		c.entities[entity] = n
+	} else {
+		delete(c.entities, entity)
+	}
+}
+
+// isComparable reports whether a value may be a map key, its type being
+// comparable and so the dynamic values of its interfaces
+func isComparable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Func, reflect.Map, reflect.Slice:
+		return false
+	case reflect.Interface:
+		return v.IsNil() || isComparable(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !isComparable(v.Field(i)) {
+				return false
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !isComparable(v.Index(i)) {
+				return false
+			}
+		}
+	}
+	return true
+}
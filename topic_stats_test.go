@@ -0,0 +1,91 @@
+package cabinet
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// walkStats returns the stats of a tree by walking it, but for the bytes
+func walkStats(tr *TTree) Stats {
+	var st Stats
+	entities := make(map[interface{}]bool)
+	var walk func(tn *tNode, depth int, wildcard bool)
+	walk = func(tn *tNode, depth int, wildcard bool) {
+		if len(tn.entities) > 0 {
+			st.Filters++
+			if wildcard {
+				st.WildcardFilters++
+			}
+			if depth > st.MaxDepth {
+				st.MaxDepth = depth
+			}
+		}
+		for _, e := range tn.entities {
+			st.Links++
+			entities[e] = true
+		}
+		for _, children := range []map[string]*tNode{tn.nltNodes, tn.globs, tn.regexps} {
+			for level, nltn := range children {
+				st.Nodes++
+				walk(nltn, depth+1, wildcard || tr.syntax.isWildcard(level))
+			}
+		}
+	}
+	walk(tr.root, 0, false)
+	st.Entities = len(entities)
+	return st
+}
+
+func TestStats(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree(WithNormalizer(FoldCase))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+	require.Equal(t, Stats{}, tt.Stats())
+
+	levels := []string{"a", "B", "+", "c"}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		filter := levels[rnd.Intn(len(levels))]
+		for n := rnd.Intn(4); n > 0; n-- {
+			filter += "/" + levels[rnd.Intn(len(levels))]
+		}
+		if rnd.Intn(8) == 0 {
+			filter += "/#"
+		}
+		entity := string(rune('a' + rnd.Intn(10)))
+
+		if rnd.Intn(3) == 0 {
+			err := tt.EntityUnLink([]byte(filter), entity)
+			require.True(t, err == nil || errors.Is(err, ErrNotLinked), "%v", err)
+		} else {
+			require.NoError(t, tt.EntityLink([]byte(filter), entity))
+		}
+
+		st := tt.Stats()
+		require.True(t, st.Bytes >= st.Nodes*nodeBytes+st.Links*linkBytes, "%+v", st)
+		st.Bytes = 0
+		require.Equal(t, walkStats(tt), st, filter)
+	}
+
+	// Restored trees count alike, and free what they counted
+	var buf bytes.Buffer
+	require.NoError(t, tt.Snapshot(&buf, stringCodec{}))
+	rt := NewTopicTree(WithNormalizer(FoldCase))
+	require.NoError(t, rt.Restore(&buf, stringCodec{}))
+	require.Equal(t, tt.Stats(), rt.Stats())
+
+	links, _ := rt.links()
+	for _, l := range links {
+		require.NoError(t, rt.EntityUnLink(l.filter, l.entity))
+	}
+	require.Equal(t, Stats{}, rt.Stats())
+	require.NoError(t, rt.Close())
+}
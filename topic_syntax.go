@@ -0,0 +1,355 @@
+package cabinet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidSyntax is returned, by Err, for a tree given a syntax whose
+// characters are not distinct
+var ErrInvalidSyntax = errors.New("invalid syntax")
+
+// Syntax is the dialect of the topics of a tree: the separator of their levels
+// and the wildcards of their filters. Wildcards must occupy an entire level,
+// and unless MultiWildcardAnywhere, the multi-level wildcard must be the last
+// one. The three characters must differ.
+type Syntax struct {
+	Separator      byte
+	SingleWildcard byte
+	MultiWildcard  byte
+
+	// EmptyLevelWildcard matches an empty level, as in 'a//b', like the single
+	// level wildcard, as the tree always did for MQTT. Empty levels are
+	// invalid otherwise, and so is a trailing separator.
+	EmptyLevelWildcard bool
+
+	// MultiWildcardAnywhere allows the multi-level wildcard at any level,
+	// matching zero or more levels, as in AMQP: 'a.#.z' matches 'a.z' and
+	// 'a.b.c.z'. Otherwise it matches one or more levels, not its parent: in
+	// MQTT 'a/#' matches 'a/b' but not 'a'. Captures, parameters and the
+	// filter algebra are unsupported in this mode.
+	MultiWildcardAnywhere bool
+
+	// Params makes the levels '{name}' of filters named parameters matching
+	// any level, like the single level wildcard; see LinkedParams. They are
+	// regular levels otherwise.
+	Params bool
+
+	// Globs makes the levels of filters holding glob characters patterns
+	// matching single levels, as in 'logs/*.err'; see isGlob. The filter
+	// algebra is unsupported in this mode, and OverlappingFilters too.
+	Globs bool
+
+	// Regexps makes the levels '{name:expr}' of filters named parameters
+	// constrained by regular expressions; see isRegexp. The filter algebra is
+	// unsupported in this mode, and OverlappingFilters too.
+	Regexps bool
+}
+
+var (
+	// MQTT is the syntax of MQTT topics, the default one: 'sport/+/player/#'
+	MQTT = &Syntax{Separator: '/', SingleWildcard: '+', MultiWildcard: '#', EmptyLevelWildcard: true}
+
+	// NATS is the syntax of NATS subjects: 'sport.*.player.>'
+	NATS = &Syntax{Separator: '.', SingleWildcard: '*', MultiWildcard: '>'}
+
+	// AMQP is the syntax of AMQP topic exchange routing keys: 'sport.*.#.score'
+	AMQP = &Syntax{Separator: '.', SingleWildcard: '*', MultiWildcard: '#', MultiWildcardAnywhere: true}
+)
+
+// mqttSyntax is the MQTT syntax of the package and of the trees by default, out
+// of reach of the changes to MQTT
+var mqttSyntax = *MQTT
+
+// WithSyntax makes the tree use a copy of sx for its topics and filters,
+// instead of MQTT. The tree links nothing when the characters of sx are not
+// distinct; see Err.
+func WithSyntax(sx *Syntax) TreeOption {
+	return func(tr *TTree) {
+		if sx.Separator == sx.SingleWildcard || sx.Separator == sx.MultiWildcard || sx.SingleWildcard == sx.MultiWildcard {
+			if tr.err == nil {
+				tr.err = fmt.Errorf("topicTree/WithSyntax: characters must differ: %w", ErrInvalidSyntax)
+			}
+			return
+		}
+		c := *sx
+		tr.syntax = &c
+	}
+}
+
+// byteLevels holds every byte, for the levels made of a single one to be
+// sliced from it without allocating
+var byteLevels = func() (b [256]byte) {
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return
+}()
+
+func byteLevel(c byte) []byte {
+	return byteLevels[c : int(c)+1]
+}
+
+// sep returns the separator as a level
+func (sx *Syntax) sep() []byte {
+	return byteLevel(sx.Separator)
+}
+
+// patterned reports whether the levels of filters may be patterns, globs or
+// regular expressions, which the filter algebra cannot compare
+func (sx *Syntax) patterned() bool {
+	return sx.Globs || sx.Regexps
+}
+
+// isMWC reports whether a level is the multi-level wildcard
+func (sx *Syntax) isMWC(level string) bool {
+	return len(level) == 1 && level[0] == sx.MultiWildcard
+}
+
+// isSWC reports whether a filter level matches any single level, being the
+// single level wildcard or a named parameter
+func (sx *Syntax) isSWC(level string) bool {
+	return len(level) == 1 && level[0] == sx.SingleWildcard || sx.isParam(level)
+}
+
+// isWildcard reports whether a filter level matches other levels than itself
+func (sx *Syntax) isWildcard(level string) bool {
+	return sx.isMWC(level) || sx.isSWC(level) || sx.isGlob(level) || sx.isRegexp(level)
+}
+
+// nextLevel returns the next level of a topic, the remaining levels and any
+// error
+func (sx *Syntax) nextLevel(topic []byte) ([]byte, []byte, error) {
+	if level, rem, ok := sx.nextRegexpLevel(topic); ok {
+		return level, rem, nil
+	}
+
+	s := stateCHR
+	// A single level wildcard glob character may be part of a glob level
+	glob := sx.Globs && isGlobChar(sx.SingleWildcard)
+
+	for i, c := range topic {
+		switch c {
+		case sx.Separator:
+			if s == stateMWC && !sx.MultiWildcardAnywhere {
+				return nil, nil, fmt.Errorf("topicNode/nextTopicLevel: Multi-level wildcard found in topic and it's not at the last level: %w", sx.levelError(topic, ErrMisplacedWildcard))
+			}
+
+			if i == 0 {
+				if !sx.EmptyLevelWildcard {
+					return nil, nil, fmt.Errorf("topicNode/nextTopicLevel: %w", &TopicError{Err: ErrEmptyLevel})
+				}
+				return byteLevel(sx.SingleWildcard), topic[i+1:], nil
+			}
+			if i == len(topic)-1 && !sx.EmptyLevelWildcard {
+				return nil, nil, fmt.Errorf("topicNode/nextTopicLevel: %w", &TopicError{Err: ErrEmptyLevel})
+			}
+
+			return topic[:i], topic[i+1:], nil
+
+		case sx.MultiWildcard:
+			if i != 0 {
+				return nil, nil, fmt.Errorf("topicNode/nextTopicLevel: Wildcard character '%c' must occupy entire topic level: %w", c, sx.levelError(topic, ErrMisplacedWildcard))
+			}
+
+			s = stateMWC
+
+		case sx.SingleWildcard:
+			if glob {
+				if i == 0 {
+					s = stateSWC
+				} else {
+					s = stateCHR
+				}
+				continue
+			}
+			if i != 0 {
+				return nil, nil, fmt.Errorf("topicNode/nextTopicLevel: Wildcard character '%c' must occupy entire topic level: %w", c, sx.levelError(topic, ErrMisplacedWildcard))
+			}
+
+			s = stateSWC
+
+		default:
+			if s == stateSWC && glob {
+				s = stateCHR
+				continue
+			}
+			if s == stateMWC || s == stateSWC {
+				return nil, nil, fmt.Errorf("topicNode/nextTopicLevel: Wildcard characters '%c' and '%c' must occupy entire topic level: %w", sx.MultiWildcard, sx.SingleWildcard, sx.levelError(topic, ErrMisplacedWildcard))
+			}
+
+			s = stateCHR
+		}
+	}
+
+	return topic, nil, nil
+}
+
+// levelValue returns the value of the next level ntl of a topic, for a leading
+// separator being an empty level rather than the wildcard it is stored under
+func (sx *Syntax) levelValue(topic, ntl []byte) []byte {
+	if topic[0] == sx.Separator {
+		return topic[:0]
+	}
+	return ntl
+}
+
+// levels splits a topic into the levels the tree stores it under
+func (sx *Syntax) levels(topic []byte) ([][]byte, error) {
+	var levels [][]byte
+	for len(topic) > 0 {
+		level, rem, err := sx.nextLevel(topic)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, level)
+		topic = rem
+	}
+	return levels, nil
+}
+
+// values splits a topic name into the values of the levels the tree matches it
+// with, a leading separator being an empty level
+func (sx *Syntax) values(topic []byte) ([][]byte, error) {
+	var values [][]byte
+	for len(topic) > 0 {
+		level, rem, err := sx.nextLevel(topic)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, sx.levelValue(topic, level))
+		topic = rem
+	}
+	return values, nil
+}
+
+// canonical returns the topic as walked back from the tree, so that the topics
+// linking the same node, like '/a' and '+/a' in MQTT, have the same form
+func (sx *Syntax) canonical(topic []byte) ([]byte, error) {
+	levels, err := sx.levels(topic)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join(levels, sx.sep()), nil
+}
+
+// covers reports whether every topic matched by filter b is matched by filter
+// a. As in the tree, the multi-level wildcard matches one or more levels, not
+// its parent level. Glob and regular expression levels are compared as regular
+// ones, conservatively.
+func (sx *Syntax) covers(a, b [][]byte) bool {
+	if sx.MultiWildcardAnywhere {
+		// Conservatively, only a lone wildcard or the same filter
+		return len(a) == 1 && sx.isMWC(string(a[0])) || equalLevels(a, b)
+	}
+	for i, level := range a {
+		if sx.isMWC(string(level)) {
+			return i < len(b)
+		}
+		if i >= len(b) {
+			return false
+		}
+		switch {
+		case sx.isSWC(string(level)):
+			if sx.isMWC(string(b[i])) {
+				return false
+			}
+		case !bytes.Equal(level, b[i]):
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+// overlaps reports whether some topic is matched by both filters a and b
+func (sx *Syntax) overlaps(a, b [][]byte) bool {
+	if sx.MultiWildcardAnywhere || sx.patterned() {
+		// Conservatively, as any two filters may
+		return true
+	}
+	_, ok := sx.intersect(a, b)
+	return ok
+}
+
+// intersect returns the filter matching exactly the topics matched by both
+// filters a and b, and whether there is any
+func (sx *Syntax) intersect(a, b [][]byte) ([][]byte, bool) {
+	var levels [][]byte
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch {
+		case sx.isMWC(string(a[i])):
+			return append(levels, b[i:]...), true
+		case sx.isMWC(string(b[i])):
+			return append(levels, a[i:]...), true
+		case sx.isSWC(string(a[i])):
+			levels = append(levels, b[i])
+		case sx.isSWC(string(b[i])), bytes.Equal(a[i], b[i]):
+			levels = append(levels, a[i])
+		default:
+			return nil, false
+		}
+	}
+	return levels, len(a) == len(b)
+}
+
+// Covers reports whether every topic matched by filter b is also matched by
+// filter a: in MQTT, 'a/#' covers 'a/b/+' but not 'a'.
+func (sx *Syntax) Covers(a, b []byte) (bool, error) {
+	al, bl, err := sx.filterPair(a, b)
+	if err != nil {
+		return false, fmt.Errorf("topicFilter/Covers: %w", err)
+	}
+	return sx.covers(al, bl), nil
+}
+
+// Overlaps reports whether some topic is matched by both filters a and b
+func (sx *Syntax) Overlaps(a, b []byte) (bool, error) {
+	al, bl, err := sx.filterPair(a, b)
+	if err != nil {
+		return false, fmt.Errorf("topicFilter/Overlaps: %w", err)
+	}
+	return sx.overlaps(al, bl), nil
+}
+
+// Intersect returns the filter matching exactly the topics matched by both
+// filters a and b, in canonical form, or nil when they do not overlap: in
+// MQTT, 'sport/+/score' and '+/tennis/#' intersect as 'sport/tennis/score'.
+func (sx *Syntax) Intersect(a, b []byte) ([]byte, error) {
+	al, bl, err := sx.filterPair(a, b)
+	if err != nil {
+		return nil, fmt.Errorf("topicFilter/Intersect: %w", err)
+	}
+	levels, ok := sx.intersect(al, bl)
+	if !ok {
+		return nil, nil
+	}
+	return bytes.Join(levels, sx.sep()), nil
+}
+
+func (sx *Syntax) filterPair(a, b []byte) ([][]byte, [][]byte, error) {
+	if sx.MultiWildcardAnywhere || sx.patterned() {
+		return nil, nil, ErrUnsupportedSyntax
+	}
+	al, err := sx.levels(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	bl, err := sx.levels(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return al, bl, nil
+}
+
+func equalLevels(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package cabinet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestSyntaxNextLevel(t *testing.T) {
+	for _, c := range []struct {
+		sx     *Syntax
+		topic  string
+		levels []string // nil when invalid
+	}{
+		{NATS, "sport.*.player.>", []string{"sport", "*", "player", ">"}},
+		{NATS, "sport/tennis.+.#", []string{"sport/tennis", "+", "#"}},
+		{NATS, ">", []string{">"}},
+		{NATS, "sport.>.player", nil},
+		{NATS, "sport.ten*", nil},
+		{NATS, "sport..player", nil},
+		{NATS, ".sport", nil},
+		{NATS, "sport.", nil},
+		{AMQP, "sport.*.#", []string{"sport", "*", "#"}},
+		{AMQP, "sport.#.x", []string{"sport", "#", "x"}},
+		{AMQP, "sport.#x", nil},
+		{MQTT, "/sport//x/", []string{"+", "sport", "+", "x"}},
+	} {
+		levels, err := c.sx.levels([]byte(c.topic))
+		if c.levels == nil {
+			require.Error(t, err, c.topic)
+			continue
+		}
+		require.NoError(t, err, c.topic)
+		require.Equal(t, c.levels, func() (s []string) {
+			for _, l := range levels {
+				s = append(s, string(l))
+			}
+			return
+		}(), c.topic)
+	}
+
+	ok, err := NATS.Covers([]byte("sport.>"), []byte("sport.*.player"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	filter, err := NATS.Intersect([]byte("sport.*.score"), []byte("*.tennis.>"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("sport.tennis.score"), filter)
+
+	// Trees of invalid syntaxes link nothing
+	tt := NewTopicTree(WithSyntax(&Syntax{Separator: '.', SingleWildcard: '.', MultiWildcard: '#'}))
+	require.True(t, errors.Is(tt.Err(), ErrInvalidSyntax))
+	require.True(t, errors.Is(tt.EntityLink([]byte("a.#"), "ent1"), ErrInvalidSyntax))
+	require.NoError(t, tt.Close())
+
+	// and changing a syntax changes none of the trees using it
+	nats := *NATS
+	tt = NewTopicTree(WithSyntax(&nats))
+	nats.Separator = '/'
+	require.NoError(t, tt.EntityLink([]byte("sport.>"), "ent1"))
+	entities := make([]interface{}, 0, 1)
+	require.NoError(t, tt.LinkedEntities([]byte("sport.tennis"), &entities))
+	require.Equal(t, []interface{}{"ent1"}, entities)
+	require.NoError(t, tt.Close())
+}
+
+func TestSyntaxTree(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	nats := *NATS
+	nats.Params = true
+	var added [][]byte
+	tt := NewTopicTree(WithSyntax(&nats), WithHooks(Hooks{
+		OnFilterAdded: func(filter []byte) {
+			added = append(added, filter)
+		},
+	}))
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	require.NoError(t, tt.EntityLink([]byte("sport.*.player.>"), "ent1"))
+	require.NoError(t, tt.EntityLink([]byte(">"), "ent2"))
+	require.NoError(t, tt.EntityLink([]byte("sport/tennis.+"), "ent3"))
+	require.NoError(t, tt.EntityLink([]byte("sport.{name}"), "ent4"))
+	require.Error(t, tt.EntityLink([]byte("sport..x"), "ent5"))
+	require.Error(t, tt.EntityLink([]byte("sport.>.x"), "ent5"))
+
+	entities := make([]interface{}, 0, 4)
+	require.NoError(t, tt.LinkedEntities([]byte("sport.tennis.player.7"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent1", "ent2"}, entities)
+	require.NoError(t, tt.LinkedEntities([]byte("sport/tennis.+"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent2", "ent3"}, entities)
+	require.NoError(t, tt.LinkedEntities([]byte("sport/tennis.x"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent2"}, entities)
+
+	captures := make([]CaptureMatch, 0, 4)
+	require.NoError(t, tt.LinkedCaptures([]byte("sport.golf"), &captures))
+	require.Len(t, captures, 2)
+	for _, c := range captures {
+		if c.Entity == "ent4" {
+			require.Equal(t, [][]byte{[]byte("golf")}, c.Levels)
+		} else {
+			require.Equal(t, [][]byte{[]byte("sport.golf")}, c.Levels)
+		}
+	}
+
+	overlapping, err := tt.OverlappingFilters([]byte("sport.tennis.*.*"))
+	require.NoError(t, err)
+	require.Len(t, overlapping, 2)
+	require.Equal(t, []byte(">"), overlapping[0].Filter)
+	require.Equal(t, []byte("sport.*.player.>"), overlapping[1].Filter)
+
+	ns, err := tt.Namespace([]byte("tenants.acme"))
+	require.NoError(t, err)
+	require.NoError(t, ns.EntityLink([]byte(">"), "ent6"))
+	require.NoError(t, tt.LinkedEntities([]byte("tenants.acme.x"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent2", "ent6"}, entities)
+	_, err = tt.Namespace([]byte("tenants.*"))
+	require.Error(t, err)
+
+	// Snapshots keep the syntax of the tree
+	var buf bytes.Buffer
+	require.NoError(t, tt.Snapshot(&buf, stringCodec{}))
+	restored := NewTopicTree(WithSyntax(NATS))
+	defer func() {
+		require.NoError(t, restored.Close())
+	}()
+	require.NoError(t, restored.Restore(&buf, stringCodec{}))
+	require.NoError(t, restored.LinkedEntities([]byte("tenants.acme.x"), &entities))
+	require.ElementsMatch(t, []interface{}{"ent2", "ent6"}, entities)
+
+	require.Equal(t, []string{"sport.*.player.>", ">", "sport/tennis.+", "sport.{name}", "tenants.acme.>"}, func() (s []string) {
+		for _, f := range added {
+			s = append(s, string(f))
+		}
+		return
+	}())
+}
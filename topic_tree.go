@@ -9,42 +9,206 @@ type TTree struct {
 	mu sync.RWMutex
 
 	root *tNode // topic tree root node
+
+	syntax *Syntax // of the topics, MQTT by default
+
+	wal *WAL // logs the mutations when set
+
+	topicRewriter  *Rewriter // rewrites the topics to match, when set
+	filterRewriter *Rewriter // rewrites the filters to link, when set
+
+	normalizer Normalizer // normalizes the topics and filters, when set
+
+	limits Limits // bounding the tree, when set
+	counts counts // the sizes of the tree
+
+	err error // of the options, failing the links when set
+
+	seq      uint64 // sequence number of the last change
+	watchers map[*Watcher]struct{}
+
+	hooks []Hooks
+	hmu   sync.Mutex
+	hcond *sync.Cond
+	hseq  uint64 // sequence number of the last change the hooks ran for
 }
 
-func NewTopicTree() *TTree {
-	return &TTree{root: newTopicNode()}
+// TreeOption configures a topic tree
+type TreeOption func(tr *TTree)
+
+func NewTopicTree(opts ...TreeOption) *TTree {
+	tr := &TTree{root: newTopicNode(), syntax: &mqttSyntax}
+	tr.hcond = sync.NewCond(&tr.hmu)
+	for _, opt := range opts {
+		opt(tr)
+	}
+	for _, rw := range []*Rewriter{tr.topicRewriter, tr.filterRewriter} {
+		if rw != nil && *rw.syntax != *tr.syntax && tr.err == nil {
+			tr.err = fmt.Errorf("topicTree/NewTopicTree: rewriter of another syntax: %w", ErrInvalidRewrite)
+		}
+	}
+	return tr
+}
+
+// Err returns the error of the options of the tree, if any. A tree with one
+// links nothing, EntityLink, EntityUnLink, Restore and the replays returning
+// it.
+func (tr *TTree) Err() error {
+	return tr.err
 }
 
 func (tr *TTree) EntityLink(topic []byte, entity interface{}) error {
 	if entity == nil {
 		return fmt.Errorf("topicTree/EntityLink: entry cannot be nil")
 	}
+	if tr.err != nil {
+		return tr.err
+	}
+
+	if tr.filterRewriter != nil {
+		var err error
+		if topic, err = tr.filterRewriter.RewriteFilter(topic); err != nil {
+			return err
+		}
+	}
+	if err := tr.syntax.validateFilter(topic); err != nil {
+		return fmt.Errorf("topicTree/EntityLink: %w", err)
+	}
+
+	var op nodeOp
+	seq, err := tr.link(topic, entity, &op)
+	if err != nil {
+		return err
+	}
+
+	tr.runHooks(seq, topic, entity, &op)
+	return nil
+}
+
+func (tr *TTree) link(topic []byte, entity interface{}, op *nodeOp) (uint64, error) {
 	tr.mu.Lock()
 	defer tr.mu.Unlock()
 
-	return tr.root.insertEntity(topic, entity)
+	if err := tr.checkLink(topic, entity); err != nil {
+		return 0, fmt.Errorf("topicTree/EntityLink: %w", err)
+	}
+	if tr.wal != nil {
+		if err := tr.wal.append(walLink, topic, entity); err != nil {
+			return 0, fmt.Errorf("topicTree/EntityLink: %w", err)
+		}
+	}
+	if err := tr.insert(topic, entity, op); err != nil {
+		return 0, err
+	}
+
+	return tr.notify(ChangeLink, topic, entity), nil
 }
 
 func (tr *TTree) EntityUnLink(topic []byte, entity interface{}) error {
+	if tr.err != nil {
+		return tr.err
+	}
+	if tr.filterRewriter != nil {
+		var err error
+		if topic, err = tr.filterRewriter.RewriteFilter(topic); err != nil {
+			return err
+		}
+	}
+	if err := tr.syntax.validateFilter(topic); err != nil {
+		return fmt.Errorf("topicTree/EntityUnLink: %w", err)
+	}
+
+	var op nodeOp
+	seq, err := tr.unlink(topic, entity, &op)
+	if err != nil {
+		return err
+	}
+
+	tr.runHooks(seq, topic, entity, &op)
+	return nil
+}
+
+func (tr *TTree) unlink(topic []byte, entity interface{}, op *nodeOp) (uint64, error) {
 	tr.mu.Lock()
 	defer tr.mu.Unlock()
 
-	return tr.root.removeEntity(topic, entity)
+	if tr.wal != nil {
+		if err := tr.wal.append(walUnLink, topic, entity); err != nil {
+			return 0, fmt.Errorf("topicTree/EntityUnLink: %w", err)
+		}
+	}
+	if err := tr.remove(topic, entity, op); err != nil {
+		return 0, err
+	}
+
+	return tr.notify(ChangeUnLink, topic, entity), nil
 }
 
 // Returned values will be invalidated by the next ConnectedEntities call
 func (tr *TTree) LinkedEntities(topic []byte, entities *[]interface{}) error {
+	if tr.topicRewriter != nil {
+		topic = tr.topicRewriter.Rewrite(topic)
+	}
+
+	if err := tr.syntax.ValidateTopicName(topic); err != nil {
+		return fmt.Errorf("topicTree/LinkedEntities: %w", err)
+	}
+	if err := tr.checkTopic(topic); err != nil {
+		return fmt.Errorf("topicTree/LinkedEntities: %w", err)
+	}
+	if tr.normalizer != nil {
+		buf := normBuffers.Get().(*[]byte)
+		defer normBuffers.Put(buf)
+		*buf = tr.normalizer((*buf)[:0], topic)
+		topic = *buf
+	}
+
 	tr.mu.RLock()
 	defer tr.mu.RUnlock()
 
 	*entities = (*entities)[0:0]
 
-	return tr.root.matchEntities(topic, entities)
+	if tr.syntax.MultiWildcardAnywhere {
+		return tr.root.matchEntitiesAnywhere(tr.syntax, topic, entities)
+	}
+	return tr.root.matchEntities(tr.syntax, topic, entities)
+}
+
+// insert links entity to filter, normalizing filter and recording its text
+// when it differs from its normal form, and counts the change
+func (tr *TTree) insert(filter []byte, entity interface{}, op *nodeOp) error {
+	if op == nil {
+		op = &nodeOp{}
+	}
+	if tr.normalizer != nil {
+		normal := tr.normalizer(nil, filter)
+		if string(normal) != string(filter) {
+			op.text = string(filter)
+		}
+		filter = normal
+	}
+	err := tr.root.insertEntity(tr.syntax, filter, entity, op)
+	tr.counts.record(entity, op)
+	return err
+}
+
+// remove unlinks entity from the normal form of filter, and counts the change
+func (tr *TTree) remove(filter []byte, entity interface{}, op *nodeOp) error {
+	if op == nil {
+		op = &nodeOp{}
+	}
+	if tr.normalizer != nil {
+		filter = tr.normalizer(nil, filter)
+	}
+	err := tr.root.removeEntity(tr.syntax, filter, entity, op)
+	tr.counts.record(entity, op)
+	return err
 }
 
 func (tr *TTree) Close() error {
 	err := tr.root.close()
 	tr.root = nil
+	tr.counts = counts{}
 
 	return err
 }
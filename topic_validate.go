@@ -0,0 +1,156 @@
+package cabinet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	// MaxTopicLength is the length in bytes of the longest topic name or filter,
+	// that of the longest string of MQTT
+	MaxTopicLength = 65535
+
+	// MaxTopicLevels is the number of levels of the deepest topic filter
+	MaxTopicLevels = 256
+)
+
+// The errors of invalid topic names and filters, wrapped in a *TopicError
+var (
+	ErrEmptyTopic        = errors.New("empty topic")
+	ErrEmptyLevel        = errors.New("empty topic level")
+	ErrTopicTooLong      = errors.New("topic too long")
+	ErrTopicTooDeep      = errors.New("topic too deep")
+	ErrMisplacedWildcard = errors.New("misplaced wildcard")
+	ErrInvalidUTF8       = errors.New("invalid UTF-8")
+	ErrNULCharacter      = errors.New("NUL character")
+	ErrMalformedShare    = errors.New("malformed shared subscription")
+)
+
+// TopicError is the error of an invalid topic name or filter, returned by the
+// methods of the tree and the validation functions. Err is one of the errors
+// above, so that errors.Is(err, ErrMisplacedWildcard) tells a misplaced
+// wildcard whatever method returned err, or the error of a malformed glob or
+// regular expression.
+type TopicError struct {
+	Level string // the level at fault, or the whole topic
+	Err   error
+}
+
+func (e *TopicError) Error() string {
+	return fmt.Sprintf("%v in '%s'", e.Err, e.Level)
+}
+
+func (e *TopicError) Unwrap() error {
+	return e.Err
+}
+
+// levelError returns the error of the first level of topic
+func (sx *Syntax) levelError(topic []byte, err error) error {
+	if i := bytes.IndexByte(topic, sx.Separator); i >= 0 {
+		topic = topic[:i]
+	}
+	return &TopicError{Level: string(topic), Err: err}
+}
+
+// ValidateTopicName returns a *TopicError when topic is not a valid MQTT topic
+// name, to publish to
+func ValidateTopicName(topic []byte) error {
+	return mqttSyntax.ValidateTopicName(topic)
+}
+
+// ValidateFilter returns a *TopicError when filter is not a valid MQTT topic
+// filter, to subscribe to, including a '$share/{group}/' prefix
+func ValidateFilter(filter []byte) error {
+	return mqttSyntax.ValidateFilter(filter)
+}
+
+// ValidateTopicName returns a *TopicError when topic is not a valid topic name
+// of the syntax, to publish to
+func (sx *Syntax) ValidateTopicName(topic []byte) error {
+	if err := sx.validate(topic); err != nil {
+		return err
+	}
+	if i := bytes.IndexAny(topic, string([]byte{sx.SingleWildcard, sx.MultiWildcard})); i >= 0 {
+		return &TopicError{Level: string(byteLevel(topic[i])), Err: ErrMisplacedWildcard}
+	}
+	_, err := sx.depth(topic)
+	return err
+}
+
+// ValidateFilter returns a *TopicError when filter is not a valid topic filter
+// of the syntax, to subscribe to, including a '$share{sep}{group}{sep}' prefix
+func (sx *Syntax) ValidateFilter(filter []byte) error {
+	_, filter, _, err := sx.splitShare(filter)
+	if err != nil {
+		return err
+	}
+	return sx.validateFilter(filter)
+}
+
+// validateFilter returns a *TopicError when filter is not one the tree can link
+func (sx *Syntax) validateFilter(filter []byte) error {
+	if err := sx.validate(filter); err != nil {
+		return err
+	}
+	if _, err := sx.depth(filter); err != nil {
+		return err
+	}
+	if sx.patterned() {
+		return sx.validatePatterns(filter)
+	}
+	return nil
+}
+
+// validatePatterns returns a *TopicError when a pattern level of a filter is
+// malformed, before it is linked
+func (sx *Syntax) validatePatterns(filter []byte) error {
+	for len(filter) > 0 {
+		ntl, rem, _ := sx.nextLevel(filter)
+		switch level := string(ntl); {
+		case sx.isRegexp(level):
+			if _, err := compileRegexp(level); err != nil {
+				return err
+			}
+		case sx.isGlob(level):
+			if err := validGlob(level); err != nil {
+				return err
+			}
+		}
+		filter = rem
+	}
+	return nil
+}
+
+// validate checks what all topic names and filters must be
+func (sx *Syntax) validate(topic []byte) error {
+	switch {
+	case len(topic) == 0:
+		return &TopicError{Err: ErrEmptyTopic}
+	case len(topic) > MaxTopicLength:
+		return &TopicError{Level: string(topic[:64]) + "...", Err: ErrTopicTooLong}
+	case bytes.IndexByte(topic, 0) >= 0:
+		i := bytes.IndexByte(topic, 0)
+		return sx.levelError(topic[bytes.LastIndexByte(topic[:i], sx.Separator)+1:], ErrNULCharacter)
+	case !utf8.Valid(topic):
+		return &TopicError{Level: string(topic), Err: ErrInvalidUTF8}
+	}
+	return nil
+}
+
+// depth returns the number of levels of a topic, checking each of them
+func (sx *Syntax) depth(topic []byte) (int, error) {
+	n := 0
+	for len(topic) > 0 {
+		_, rem, err := sx.nextLevel(topic)
+		if err != nil {
+			return n, err
+		}
+		if n++; n > MaxTopicLevels {
+			return n, sx.levelError(topic, ErrTopicTooDeep)
+		}
+		topic = rem
+	}
+	return n, nil
+}
@@ -0,0 +1,113 @@
+package cabinet
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestValidate(t *testing.T) {
+	deep := strings.Repeat("a/", MaxTopicLevels)
+	long := strings.Repeat("a", MaxTopicLength+1)
+
+	for _, tc := range []struct {
+		topic  string
+		name   error
+		filter error
+	}{
+		{"sport/tennis", nil, nil},
+		{"/sport//tennis/", nil, nil},
+		{"$SYS/broker", nil, nil},
+		{"sport/+/score/#", ErrMisplacedWildcard, nil},
+		{"sport/tennis+", ErrMisplacedWildcard, ErrMisplacedWildcard},
+		{"sport/#/score", ErrMisplacedWildcard, ErrMisplacedWildcard},
+		{"", ErrEmptyTopic, ErrEmptyTopic},
+		{long, ErrTopicTooLong, ErrTopicTooLong},
+		{deep + "a", ErrTopicTooDeep, ErrTopicTooDeep},
+		{deep[:len(deep)-1], nil, nil},
+		{"sport/\xfftennis", ErrInvalidUTF8, ErrInvalidUTF8},
+		{"sport/ten\x00nis", ErrNULCharacter, ErrNULCharacter},
+		{"$share/group/sport/#", ErrMisplacedWildcard, nil},
+		{"$share/group/", nil, ErrMalformedShare},
+		{"$share//sport", nil, ErrMalformedShare},
+		{"$share/gr+up/sport", ErrMisplacedWildcard, ErrMalformedShare},
+		{"$share/group", nil, ErrMalformedShare},
+		{"$share/gr.up/sport", nil, ErrMalformedShare},
+		{"$share/group_1-a/sport", nil, nil},
+	} {
+		err := ValidateTopicName([]byte(tc.topic))
+		if tc.name == nil {
+			require.NoError(t, err, tc.topic)
+		} else {
+			require.True(t, errors.Is(err, tc.name), "%s: %v", tc.topic, err)
+		}
+
+		err = ValidateFilter([]byte(tc.topic))
+		if tc.filter == nil {
+			require.NoError(t, err, tc.topic)
+		} else {
+			require.True(t, errors.Is(err, tc.filter), "%s: %v", tc.topic, err)
+		}
+	}
+
+	var terr *TopicError
+	require.True(t, errors.As(ValidateFilter([]byte("sport/ten\x00nis/x")), &terr))
+	require.Equal(t, "ten\x00nis", terr.Level)
+	require.True(t, errors.As(ValidateFilter([]byte("sport/a#/x")), &terr))
+	require.Equal(t, "a#", terr.Level)
+
+	// Empty levels are invalid in NATS
+	require.True(t, errors.Is(NATS.ValidateFilter([]byte("sport..>")), ErrEmptyLevel))
+	require.True(t, errors.Is(NATS.ValidateTopicName([]byte("sport.*")), ErrMisplacedWildcard))
+}
+
+func TestTreeTopicErrors(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+
+	var terr *TopicError
+	err := tt.EntityLink([]byte("sport/#/score"), "a")
+	require.True(t, errors.Is(err, ErrMisplacedWildcard))
+	require.True(t, errors.As(err, &terr))
+	require.Equal(t, "#", terr.Level)
+
+	require.True(t, errors.Is(tt.EntityLink(nil, "a"), ErrEmptyTopic))
+	require.True(t, errors.Is(tt.EntityLink([]byte("sport/\xff"), "a"), ErrInvalidUTF8))
+	require.True(t, errors.Is(tt.EntityLink([]byte(strings.Repeat("/", MaxTopicLevels+1)), "a"), ErrTopicTooDeep))
+	require.True(t, errors.Is(tt.EntityUnLink([]byte("sport/a+"), "a"), ErrMisplacedWildcard))
+
+	// Topics are validated as topic names by every lookup
+	require.NoError(t, tt.EntityLink([]byte("sport/+"), "a"))
+	entities := make([]interface{}, 0, 1)
+	captures := make([]CaptureMatch, 0, 1)
+	params := make([]ParamMatch, 0, 1)
+	for _, tc := range []struct {
+		topic string
+		err   error
+	}{
+		{"news/#/x", ErrMisplacedWildcard},
+		{"sport/+", ErrMisplacedWildcard},
+		{"a/#", ErrMisplacedWildcard},
+		{"", ErrEmptyTopic},
+		{"sport/ten\x00nis", ErrNULCharacter},
+	} {
+		for _, err := range []error{
+			tt.LinkedEntities([]byte(tc.topic), &entities),
+			tt.LinkedCaptures([]byte(tc.topic), &captures),
+			tt.LinkedParams([]byte(tc.topic), &params),
+		} {
+			require.True(t, errors.Is(err, tc.err), "%q: %v", tc.topic, err)
+			require.True(t, errors.As(err, &terr))
+		}
+	}
+
+	_, err = tt.OverlappingFilters([]byte("sport/a#"))
+	require.True(t, errors.Is(err, ErrMisplacedWildcard))
+}
@@ -0,0 +1,337 @@
+package cabinet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrWALClosed is returned when appending to a closed write-ahead log
+var ErrWALClosed = errors.New("wal closed")
+
+// ErrWALFailed is returned when appending to a write-ahead log which could not
+// remove a record it failed to write or sync
+var ErrWALFailed = errors.New("wal failed")
+
+// EntityCodec serializes the entities linked to a tree. Decoded entities must
+// be equal to the ones they were encoded from, so that they can be unlinked.
+type EntityCodec interface {
+	EncodeEntity(entity interface{}) ([]byte, error)
+	DecodeEntity(data []byte) (interface{}, error)
+}
+
+// SyncPolicy selects when the write-ahead log is flushed to stable storage
+type SyncPolicy byte
+
+const (
+	// SyncAlways syncs every record before the mutation returns
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval syncs in the background, losing at most the records of the
+	// last interval on a crash of the machine
+	SyncInterval
+
+	// SyncNever leaves the flushing to the operating system
+	SyncNever
+)
+
+// DefaultSyncInterval is the sync period of SyncInterval when not set
+const DefaultSyncInterval = time.Second
+
+// WALOptions configure a write-ahead log
+type WALOptions struct {
+	Sync SyncPolicy
+
+	// Interval is the period of SyncInterval, DefaultSyncInterval when 0
+	Interval time.Duration
+}
+
+// Operations of the WAL and replication records
+const (
+	walLink byte = iota + 1
+	walUnLink
+	walUnLinkAll
+)
+
+// walHeaderLen is the length and the CRC-32 of the record body
+const walHeaderLen = 8
+
+// walMaxRecordLen bounds the length of a record body, which is a topic of at
+// most MaxTopicLength bytes and an encoded entity, so that a corrupt length is
+// not allocated
+const walMaxRecordLen = 1 << 24
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WAL is an append-only log of the mutations of a tree. Each record holds the
+// operation, the topic and the encoded entity, and is checksummed, so that a
+// record torn by a crash is detected and dropped on replay.
+type WAL struct {
+	codec EntityCodec
+	opts  WALOptions
+
+	mu     sync.Mutex
+	f      walFile
+	size   int64 // of the records written and synced as the policy requires
+	err    error // the failure refusing the appends
+	dirty  bool
+	closed bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// walFile is the file of a log
+type walFile interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Truncate(size int64) error
+	Sync() error
+}
+
+// OpenWAL opens or creates the write-ahead log at path. An existing log should
+// be replayed before appending to it, so that a torn record is dropped first.
+func OpenWAL(path string, codec EntityCodec, opts WALOptions) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	w := &WAL{codec: codec, opts: opts, f: f, size: fi.Size()}
+	if opts.Sync == SyncInterval {
+		if w.opts.Interval <= 0 {
+			w.opts.Interval = DefaultSyncInterval
+		}
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// WithWAL appends the mutations of the tree to w. A mutation is logged before
+// being applied, and fails when it cannot be logged. Mutations rejected by the
+// tree are logged as well, and rejected again on replay.
+func WithWAL(w *WAL) TreeOption {
+	return func(tr *TTree) {
+		tr.wal = w
+	}
+}
+
+// Replay applies the records of the log to tr, which is usually empty. A torn
+// or corrupt record ends the log: it is truncated there, as nothing after it
+// can be trusted.
+func (w *WAL) Replay(tr *TTree) error {
+	if tr.err != nil {
+		return tr.err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	var (
+		offset int64
+		header [walHeaderLen]byte
+		body   []byte
+	)
+	for {
+		if _, err := io.ReadFull(w.f, header[:]); err != nil {
+			break
+		}
+		n := binary.BigEndian.Uint32(header[0:4])
+		if n > walMaxRecordLen {
+			break
+		}
+		if cap(body) < int(n) {
+			body = make([]byte, n)
+		}
+		body = body[:n]
+		if _, err := io.ReadFull(w.f, body); err != nil {
+			break
+		}
+		if crc32.Checksum(body, walTable) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+
+		op, topic, entity, err := decodeRecord(body, w.codec)
+		if err != nil {
+			return fmt.Errorf("wal/Replay: record at offset %d: %w", offset, err)
+		}
+		switch op {
+		case walLink:
+			tr.insert(topic, entity, nil)
+		case walUnLink, walUnLinkAll:
+			tr.remove(topic, entity, nil)
+		}
+		offset += walHeaderLen + int64(n)
+	}
+
+	if err := w.f.Truncate(offset); err != nil {
+		return err
+	}
+	w.size = offset
+	return nil
+}
+
+// append logs a mutation of the tree, a nil entity unlinking all of them
+func (w *WAL) append(op byte, topic []byte, entity interface{}) error {
+	rec, err := appendRecord(make([]byte, walHeaderLen, 64), op, topic, entity, w.codec)
+	if err != nil {
+		return fmt.Errorf("wal/append: %w", err)
+	}
+	if len(rec)-walHeaderLen > walMaxRecordLen {
+		return fmt.Errorf("wal/append: record of %d bytes too long", len(rec)-walHeaderLen)
+	}
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(rec)-walHeaderLen))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.Checksum(rec[walHeaderLen:], walTable))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrWALClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if _, err := w.f.Write(rec); err != nil {
+		return w.drop(err)
+	}
+	if w.opts.Sync == SyncAlways {
+		if err := w.f.Sync(); err != nil {
+			return w.drop(err)
+		}
+	} else {
+		w.dirty = true
+	}
+	w.size += int64(len(rec))
+	return nil
+}
+
+// drop truncates the log back to its size before the record it failed to
+// write or sync, so that the record is neither replayed, nor ends the log in
+// the middle of the records appended after it. The log refuses the appends
+// when it cannot.
+func (w *WAL) drop(err error) error {
+	if terr := w.f.Truncate(w.size); terr != nil {
+		w.err = fmt.Errorf("wal/append: %v, then %v: %w", err, terr, ErrWALFailed)
+		return w.err
+	}
+	return fmt.Errorf("wal/append: %w", err)
+}
+
+// appendRecord appends the operation, the uvarint length prefixed topic and
+// the encoded entity of a mutation to rec. A nil entity unlinks all of them.
+func appendRecord(rec []byte, op byte, topic []byte, entity interface{}, codec EntityCodec) ([]byte, error) {
+	if op == walUnLink && entity == nil {
+		op = walUnLinkAll
+	}
+
+	var data []byte
+	if op != walUnLinkAll {
+		var err error
+		if data, err = codec.EncodeEntity(entity); err != nil {
+			return nil, err
+		}
+	}
+
+	var ub [binary.MaxVarintLen64]byte
+	rec = append(rec, op)
+	rec = append(rec, ub[:binary.PutUvarint(ub[:], uint64(len(topic)))]...)
+	rec = append(rec, topic...)
+	return append(rec, data...), nil
+}
+
+// decodeRecord reverts appendRecord
+func decodeRecord(body []byte, codec EntityCodec) (byte, []byte, interface{}, error) {
+	if len(body) == 0 {
+		return 0, nil, nil, errors.New("empty record")
+	}
+	op := body[0]
+	tl, n := binary.Uvarint(body[1:])
+	if n <= 0 || uint64(len(body)-1-n) < tl {
+		return 0, nil, nil, errors.New("invalid topic length")
+	}
+	topic := append([]byte(nil), body[1+n:1+n+int(tl)]...)
+	data := body[1+n+int(tl):]
+
+	switch op {
+	case walLink, walUnLink:
+		entity, err := codec.DecodeEntity(data)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		return op, topic, entity, nil
+	case walUnLinkAll:
+		return op, topic, nil, nil
+	}
+	return 0, nil, nil, fmt.Errorf("unknown operation %d", op)
+}
+
+func (w *WAL) syncLoop() {
+	defer close(w.done)
+
+	t := time.NewTicker(w.opts.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-t.C:
+			w.Sync()
+		}
+	}
+}
+
+// Sync flushes the appended records to stable storage
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.f.Sync()
+}
+
+// Close syncs and closes the log
+func (w *WAL) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+		w.stop = nil
+	}
+
+	if err := w.Sync(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.f.Close()
+}
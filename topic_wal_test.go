@@ -0,0 +1,189 @@
+package cabinet
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// stringCodec encodes string entities
+type stringCodec struct{}
+
+func (stringCodec) EncodeEntity(entity interface{}) ([]byte, error) {
+	s, ok := entity.(string)
+	if !ok {
+		return nil, fmt.Errorf("not a string: %T", entity)
+	}
+	return []byte(s), nil
+}
+
+func (stringCodec) DecodeEntity(data []byte) (interface{}, error) {
+	return string(data), nil
+}
+
+func TestWAL(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := ioutil.TempDir("", "cabinet-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tree.wal")
+
+	w, err := OpenWAL(path, stringCodec{}, WALOptions{Sync: SyncInterval})
+	require.NoError(t, err)
+	tt := NewTopicTree(WithWAL(w))
+
+	require.NoError(t, tt.EntityLink([]byte("sport/tennis/+"), "ent1"))
+	require.NoError(t, tt.EntityLink([]byte("sport/#"), "ent2"))
+	require.NoError(t, tt.EntityLink([]byte("sport/#"), "ent3"))
+	require.NoError(t, tt.EntityLink([]byte("news/+"), "ent4"))
+	require.NoError(t, tt.EntityUnLink([]byte("sport/#"), "ent2"))
+	require.NoError(t, tt.EntityUnLink([]byte("news/+"), nil))
+	require.Error(t, tt.EntityUnLink([]byte("news/+"), "ent4"))
+
+	// Entities the codec cannot encode are not linked
+	require.Error(t, tt.EntityLink([]byte("sport/#"), 5))
+
+	require.NoError(t, tt.Close())
+	require.NoError(t, w.Close())
+	require.Error(t, w.append(walLink, []byte("sport"), "ent5"))
+
+	// A torn record at the end of the log is dropped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 9, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	for i := 0; i < 2; i++ {
+		w, err = OpenWAL(path, stringCodec{}, WALOptions{Sync: SyncAlways})
+		require.NoError(t, err)
+		tt = NewTopicTree(WithWAL(w))
+		require.NoError(t, w.Replay(tt))
+
+		entities := make([]interface{}, 0, 4)
+		require.NoError(t, tt.LinkedEntities([]byte("sport/tennis/final"), &entities))
+		require.ElementsMatch(t, []interface{}{"ent1", "ent3"}, entities)
+		require.NoError(t, tt.LinkedEntities([]byte("news/today"), &entities))
+		require.Empty(t, entities)
+
+		// Records appended after the replay survive the next one
+		require.NoError(t, tt.LinkedEntities([]byte("weather/today"), &entities))
+		require.Len(t, entities, i)
+		require.NoError(t, tt.EntityLink([]byte("weather/+"), "ent5"))
+		require.NoError(t, tt.Close())
+		require.NoError(t, w.Close())
+	}
+
+	// So is a record of a corrupt length, without allocating it
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w, err = OpenWAL(path, stringCodec{}, WALOptions{Sync: SyncNever})
+	require.NoError(t, err)
+	tt = NewTopicTree(WithWAL(w))
+	require.NoError(t, w.Replay(tt))
+	entities := make([]interface{}, 0, 4)
+	require.NoError(t, tt.LinkedEntities([]byte("weather/today"), &entities))
+	require.Equal(t, []interface{}{"ent5"}, entities)
+	require.NoError(t, tt.Close())
+	require.NoError(t, w.Close())
+
+	tfi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, fi.Size(), tfi.Size())
+}
+
+// failingFile fails the writes, after writing half of them, and the syncs and
+// truncations of a log when told so
+type failingFile struct {
+	walFile
+	write, sync, truncate bool
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.write {
+		n, _ := f.walFile.Write(p[:len(p)/2])
+		return n, errors.New("no space left on device")
+	}
+	return f.walFile.Write(p)
+}
+
+func (f *failingFile) Sync() error {
+	if f.sync {
+		return errors.New("input/output error")
+	}
+	return f.walFile.Sync()
+}
+
+func (f *failingFile) Truncate(size int64) error {
+	if f.truncate {
+		return errors.New("input/output error")
+	}
+	return f.walFile.Truncate(size)
+}
+
+func TestWALFailures(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := ioutil.TempDir("", "cabinet-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tree.wal")
+
+	w, err := OpenWAL(path, stringCodec{}, WALOptions{Sync: SyncAlways})
+	require.NoError(t, err)
+	ff := &failingFile{walFile: w.f}
+	w.f = ff
+	tt := NewTopicTree(WithWAL(w))
+
+	// Records failing to be written or synced are removed from the log, and
+	// their mutations rejected
+	require.NoError(t, tt.EntityLink([]byte("a"), "ent1"))
+	ff.write = true
+	require.Error(t, tt.EntityLink([]byte("b"), "ent1"))
+	ff.write, ff.sync = false, true
+	require.Error(t, tt.EntityLink([]byte("c"), "ent1"))
+	ff.sync = false
+	require.NoError(t, tt.EntityLink([]byte("d"), "ent1"))
+
+	// and the log refuses the appends once it cannot remove one
+	ff.sync, ff.truncate = true, true
+	require.True(t, errors.Is(tt.EntityLink([]byte("e"), "ent1"), ErrWALFailed))
+	ff.sync, ff.truncate = false, false
+	require.True(t, errors.Is(tt.EntityLink([]byte("f"), "ent1"), ErrWALFailed))
+
+	linked := func(tt *TTree, filters ...string) {
+		t.Helper()
+		entities := make([]interface{}, 0, 1)
+		for _, f := range []string{"a", "b", "c", "d", "e", "f"} {
+			require.NoError(t, tt.LinkedEntities([]byte(f), &entities))
+			require.Equal(t, strings.Contains(strings.Join(filters, ""), f), len(entities) == 1, f)
+		}
+	}
+	linked(tt, "a", "d")
+	require.NoError(t, tt.Close())
+	require.NoError(t, w.Close())
+
+	// The records written before the failures are replayed, and so is the one
+	// which could not be removed
+	w, err = OpenWAL(path, stringCodec{}, WALOptions{Sync: SyncAlways})
+	require.NoError(t, err)
+	tt = NewTopicTree(WithWAL(w))
+	require.NoError(t, w.Replay(tt))
+	linked(tt, "a", "d", "e")
+	require.NoError(t, tt.Close())
+	require.NoError(t, w.Close())
+}
@@ -0,0 +1,172 @@
+package cabinet
+
+import (
+	"sync"
+	"time"
+)
+
+// Will is a message published on behalf of an entity that disconnected
+// abnormally, to all the entities linked to its topic
+type Will struct {
+	Topic []byte
+
+	// Delay postpones the publication, giving the entity a chance to resume
+	Delay time.Duration
+
+	// Message is the opaque payload handed to the delivery function
+	Message interface{}
+}
+
+// WillRegistry holds the will of each connected entity and publishes it
+// through a topic tree when the entity disconnects abnormally. Entities are
+// keyed by value, so they must be comparable and stable across reconnects,
+// like a client identifier.
+type WillRegistry struct {
+	tr      *TTree
+	deliver func(w *Will, entities []interface{})
+
+	mu      sync.Mutex
+	closed  bool
+	wills   map[interface{}]*Will
+	pending map[interface{}]*pendingWill
+	wg      sync.WaitGroup
+}
+
+type pendingWill struct {
+	will  *Will
+	timer *time.Timer
+}
+
+// NewWillRegistry returns a registry calling deliver with each fired will and
+// the entities linked to its topic. deliver runs on a timer goroutine for
+// delayed wills.
+func NewWillRegistry(tr *TTree, deliver func(w *Will, entities []interface{})) *WillRegistry {
+	return &WillRegistry{
+		tr:      tr,
+		deliver: deliver,
+		wills:   make(map[interface{}]*Will),
+		pending: make(map[interface{}]*pendingWill),
+	}
+}
+
+// Set registers the will of a connected entity, replacing any previous one
+func (r *WillRegistry) Set(entity interface{}, w *Will) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.wills[entity] = w
+}
+
+// Discard drops the will of an entity without publishing it, as on a normal
+// disconnection
+func (r *WillRegistry) Discard(entity interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.wills, entity)
+}
+
+// Fire publishes the will of an entity that disconnected abnormally, after
+// its delay. It returns false when the entity has no will.
+func (r *WillRegistry) Fire(entity interface{}) bool {
+	r.mu.Lock()
+	w, ok := r.wills[entity]
+	if !ok || r.closed {
+		r.mu.Unlock()
+		return false
+	}
+	delete(r.wills, entity)
+
+	if w.Delay <= 0 {
+		r.wg.Add(1)
+		r.mu.Unlock()
+		r.publish(w)
+		return true
+	}
+
+	if p, ok := r.pending[entity]; ok {
+		p.timer.Stop()
+	}
+	p := &pendingWill{will: w}
+	p.timer = time.AfterFunc(w.Delay, func() {
+		r.mu.Lock()
+		if r.closed || r.pending[entity] != p {
+			r.mu.Unlock()
+			return
+		}
+		delete(r.pending, entity)
+		r.wg.Add(1)
+		r.mu.Unlock()
+
+		r.publish(w)
+	})
+	r.pending[entity] = p
+	r.mu.Unlock()
+
+	return true
+}
+
+// Resume cancels the delayed will of an entity whose session resumed, and
+// reports whether there was one
+func (r *WillRegistry) Resume(entity interface{}) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.pending[entity]
+	if !ok {
+		return false
+	}
+	p.timer.Stop()
+	delete(r.pending, entity)
+
+	return true
+}
+
+// Flush publishes the delayed will of an entity right away, as when its
+// session ends before the delay, and reports whether there was one
+func (r *WillRegistry) Flush(entity interface{}) bool {
+	r.mu.Lock()
+	p, ok := r.pending[entity]
+	if !ok || r.closed {
+		r.mu.Unlock()
+		return false
+	}
+	p.timer.Stop()
+	delete(r.pending, entity)
+	r.wg.Add(1)
+	r.mu.Unlock()
+
+	r.publish(p.will)
+	return true
+}
+
+// Pending returns the number of wills waiting for their delay
+func (r *WillRegistry) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.pending)
+}
+
+// Close cancels all the delayed wills, and waits for the deliveries in progress
+func (r *WillRegistry) Close() {
+	r.mu.Lock()
+	r.closed = true
+	for entity, p := range r.pending {
+		p.timer.Stop()
+		delete(r.pending, entity)
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+}
+
+func (r *WillRegistry) publish(w *Will) {
+	defer r.wg.Done()
+
+	entities := make([]interface{}, 0, 8)
+	if err := r.tr.LinkedEntities(w.Topic, &entities); err != nil {
+		return
+	}
+	r.deliver(w, entities)
+}
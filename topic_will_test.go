@@ -0,0 +1,104 @@
+package cabinet
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+type willRecorder struct {
+	mu    sync.Mutex
+	fired []interface{}
+	ents  [][]interface{}
+	ch    chan struct{}
+}
+
+func (wr *willRecorder) deliver(w *Will, entities []interface{}) {
+	wr.mu.Lock()
+	wr.fired = append(wr.fired, w.Message)
+	wr.ents = append(wr.ents, entities)
+	wr.mu.Unlock()
+	wr.ch <- struct{}{}
+}
+
+func TestWillRegistry(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+	require.NoError(t, tt.EntityLink([]byte("status/+"), "monitor"))
+
+	wr := &willRecorder{ch: make(chan struct{}, 8)}
+	r := NewWillRegistry(tt, wr.deliver)
+	defer r.Close()
+
+	// Without a will, nothing fires
+	require.False(t, r.Fire("dev1"))
+
+	// A normal disconnection discards the will
+	r.Set("dev1", &Will{Topic: []byte("status/dev1"), Message: "discarded"})
+	r.Discard("dev1")
+	require.False(t, r.Fire("dev1"))
+
+	// Without delay, the will is delivered before Fire returns
+	r.Set("dev1", &Will{Topic: []byte("status/dev1"), Message: "offline"})
+	require.True(t, r.Fire("dev1"))
+	require.False(t, r.Fire("dev1"))
+	<-wr.ch
+	require.Equal(t, []interface{}{"offline"}, wr.fired)
+	require.Equal(t, []interface{}{"monitor"}, wr.ents[0])
+}
+
+func TestWillRegistryDelay(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tt := NewTopicTree()
+	defer func() {
+		require.NoError(t, tt.Close())
+	}()
+	require.NoError(t, tt.EntityLink([]byte("status/+"), "monitor"))
+
+	wr := &willRecorder{ch: make(chan struct{}, 8)}
+	r := NewWillRegistry(tt, wr.deliver)
+	defer r.Close()
+
+	// Resuming within the delay cancels the will
+	r.Set("dev1", &Will{Topic: []byte("status/dev1"), Delay: 50 * time.Millisecond, Message: "resumed"})
+	require.True(t, r.Fire("dev1"))
+	require.Equal(t, 1, r.Pending())
+	require.True(t, r.Resume("dev1"))
+	require.False(t, r.Resume("dev1"))
+	require.Equal(t, 0, r.Pending())
+
+	// Otherwise it is delivered once the delay elapsed
+	r.Set("dev1", &Will{Topic: []byte("status/dev1"), Delay: 10 * time.Millisecond, Message: "offline"})
+	require.True(t, r.Fire("dev1"))
+	select {
+	case <-wr.ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("will not delivered")
+	}
+	require.Equal(t, 0, r.Pending())
+
+	// Flushing delivers it right away
+	r.Set("dev2", &Will{Topic: []byte("status/dev2"), Delay: time.Hour, Message: "ended"})
+	require.True(t, r.Fire("dev2"))
+	require.True(t, r.Flush("dev2"))
+	<-wr.ch
+
+	wr.mu.Lock()
+	require.Equal(t, []interface{}{"offline", "ended"}, wr.fired)
+	wr.mu.Unlock()
+
+	// Closing cancels the remaining ones
+	r.Set("dev3", &Will{Topic: []byte("status/dev3"), Delay: time.Hour, Message: "closed"})
+	require.True(t, r.Fire("dev3"))
+	r.Close()
+	require.Equal(t, 0, r.Pending())
+	require.False(t, r.Flush("dev3"))
+}